@@ -0,0 +1,683 @@
+// Package backup encrypts files and stores them as chunks in a chunkstore.ChunkStore, along with the metadata needed to restore them.
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/illicitonion/cloudbackup/chunkstore"
+	"github.com/illicitonion/cloudbackup/fscache"
+	"github.com/illicitonion/cloudbackup/meta"
+)
+
+const keySize = 32
+
+// maxMetadataConflicts is how many times the metadata is merged with concurrently stored metadata before a backup gives up.
+const maxMetadataConflicts = 5
+
+type Repository struct {
+	aesKey     []byte
+	hmacKey    []byte
+	chunkStore chunkstore.ChunkStore
+	metaFile   string
+	fsCache    *fscache.Cache
+	// metadataCacheDir is where chunks of the stored metadata are cached, or empty if they aren't.
+	metadataCacheDir string
+}
+
+// NewRepository returns a Repository which encrypts chunks with aesKey, authenticates them with hmacKey, and stores them in chunkStore.
+// If metaFile is non-empty, it is used as the metadata database instead of the one stored in chunkStore, and is never uploaded.
+func NewRepository(aesKey, hmacKey []byte, chunkStore chunkstore.ChunkStore, metaFile string) (*Repository, error) {
+	if len(aesKey) != keySize || len(hmacKey) != keySize {
+		return nil, ErrBadKeys
+	}
+	return &Repository{
+		aesKey:     aesKey,
+		hmacKey:    hmacKey,
+		chunkStore: chunkStore,
+		metaFile:   metaFile,
+		fsCache:    fscache.New(fscache.System{}),
+	}, nil
+}
+
+// SetLookup sets how the owners of files are looked up when backing up and restoring, replacing the system's user and group databases,
+// e.g. with a fscache.Database read from a container's passwd and group files. It must not be called concurrently with other methods.
+func (r *Repository) SetLookup(lookup fscache.Lookup) {
+	r.fsCache = fscache.New(lookup)
+}
+
+// SetMetadataCache keeps a copy of the chunks of the stored metadata in dir, which is created if it doesn't exist, so that only the parts
+// of the metadata which have changed since it was last fetched or stored are downloaded. The chunks are encrypted, as they are in the chunk store.
+// Chunks of metadata which is no longer current are removed from dir, so it must not be shared with another repository.
+// An empty dir means that nothing is cached. It must not be called concurrently with other methods.
+func (r *Repository) SetMetadataCache(dir string) {
+	r.metadataCacheDir = dir
+}
+
+// metadataStore returns chunkStore, reading and storing metadata through r's metadata cache, if it has one.
+func (r *Repository) metadataStore(chunkStore chunkstore.ChunkStore) (chunkstore.ChunkStore, error) {
+	if r.metadataCacheDir == "" {
+		return chunkStore, nil
+	}
+	return newMetadataCache(chunkStore, r.metadataCacheDir)
+}
+
+type BackupOptions struct {
+	// ChunkBytes is the number of bytes to store in each encrypted chunk. Smaller files (or trailing chunks) are padded such that all chunks are an identical size.
+	// It must be a positive multiple of aes.BlockSize, and at least as large as a single meta.Entry (which is about 256 bytes).
+	ChunkBytes int
+	// Reupload re-uploads chunks which have not changed in already uploaded files. They are saved again under their existing names,
+	// so when combined with SkipExisting, only chunks which are missing from the chunk store are uploaded.
+	Reupload bool
+	// SkipExisting skips uploading chunks which already exist in the chunk store, according to a listing taken at the start of the backup.
+	// Listing costs chunk store operations in proportion to its size, and new chunks have random IVs so are never already stored,
+	// so this is only worthwhile with Reupload.
+	SkipExisting bool
+	// PadChunks pads the number of chunks of each non-empty file up to the next power of two, or up to the next multiple of PadChunkQuantum if it is positive,
+	// with dummy chunks which are ignored on decryption, so that the number of chunks only roughly reveals the file's size.
+	PadChunks       bool
+	PadChunkQuantum int
+	// PadMetadata pads the number of chunks of the metadata file up to the next power of two, so that its size only roughly reveals how many files there are.
+	PadMetadata bool
+
+	// ExcludeNames are file or directory names to skip.
+	ExcludeNames []string
+	// MaxFileSize, if positive, skips files larger than this many bytes.
+	MaxFileSize int64
+	// NewerThan, if non-zero, skips files not modified after this time.
+	NewerThan time.Time
+	// OlderThan, if non-zero, skips files not modified before this time.
+	OlderThan time.Time
+	// OneFileSystem skips directories which are on a different filesystem to the path being backed up.
+	OneFileSystem bool
+	// ExcludeCaches skips directories containing a CACHEDIR.TAG file.
+	ExcludeCaches bool
+
+	// Obfuscate, if non-nil, makes it harder for someone watching uploads to work out which chunks belong to the same file.
+	Obfuscate *ObfuscateOptions
+
+	// Progress, if non-nil, is called with the backup's progress every ProgressInterval (or DefaultProgressInterval if it isn't positive), and once it is done.
+	// The files to back up are counted first, so that the totals are known.
+	Progress         func(Progress)
+	ProgressInterval time.Duration
+}
+
+// BackupStats describes the chunks stored by a backup.
+type BackupStats struct {
+	ChunksUploaded int
+	BytesUploaded  int64
+	// ChunksAlreadyStored and BytesAlreadyStored count chunks which were not uploaded because they were already in the chunk store.
+	ChunksAlreadyStored int
+	BytesAlreadyStored  int64
+	// Summary summarizes the whole backup. It is the zero Summary if the backup failed.
+	Summary Summary
+}
+
+type RestoreOptions struct {
+	// TempDir is where files are written before being atomically moved into place. If empty, the default directory for temporary files is used.
+	TempDir string
+	// NumericOwner restores owners by the numeric IDs recorded when they were backed up, rather than by name.
+	// Owners whose names don't exist on this system are always restored by ID, if one was recorded.
+	NumericOwner bool
+	// MapUsers and MapGroups restore files owned by each key as owned by its value instead. Each may be a name or a numeric ID.
+	MapUsers  map[string]string
+	MapGroups map[string]string
+
+	// Progress, if non-nil, is called with the restore's progress every ProgressInterval (or DefaultProgressInterval if it isn't positive), and once it is done.
+	Progress         func(Progress)
+	ProgressInterval time.Duration
+}
+
+// Backup encrypts and stores each of paths, which must be relative, recursing into directories.
+// If some files cannot be backed up, the rest are still backed up, and a *PartialError is returned.
+func (r *Repository) Backup(ctx context.Context, paths []string, opts BackupOptions) (BackupStats, error) {
+	for _, path := range paths {
+		if filepath.IsAbs(path) {
+			return BackupStats{}, fmt.Errorf("backup: path must be relative, got %q", path)
+		}
+	}
+	var totalFiles, totalBytes int64
+	if opts.Progress != nil {
+		var err error
+		if totalFiles, totalBytes, err = countPaths(ctx, paths, opts); err != nil {
+			return BackupStats{}, err
+		}
+	}
+	progress := startProgress(opts.Progress, opts.ProgressInterval, totalFiles, totalBytes)
+	defer progress.finish()
+
+	return r.backup(ctx, opts, progress, func(chunkStore chunkstore.ChunkStore, db *meta.DB, skip func(string, error)) error {
+		for _, path := range paths {
+			if err := r.backupPath(ctx, chunkStore, db, path, opts, skip, progress); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// BackupStream encrypts and stores src, which may be of unknown length, as if it were a file at the relative path name owned by the current user.
+func (r *Repository) BackupStream(ctx context.Context, name string, src io.Reader, opts BackupOptions) (BackupStats, error) {
+	if name == "" || filepath.IsAbs(name) {
+		return BackupStats{}, fmt.Errorf("backup: stream name must be a relative path, got %q", name)
+	}
+	name = filepath.Clean(name)
+	progress := startProgress(opts.Progress, opts.ProgressInterval, 0, 0)
+	defer progress.finish()
+
+	return r.backup(ctx, opts, progress, func(chunkStore chunkstore.ChunkStore, db *meta.DB, skip func(string, error)) error {
+		if err := encryptStreamAndStoreMetadata(ctx, r.aesKey, r.hmacKey, chunkStore, opts.ChunkBytes, db, r.fsCache, name, src, opts.Reupload, chunkPadding(opts), progress); err != nil {
+			skip(name, err)
+		}
+		progress.fileDone()
+		return nil
+	})
+}
+
+func (r *Repository) backup(ctx context.Context, opts BackupOptions, progress *progressTracker, fn func(chunkStore chunkstore.ChunkStore, db *meta.DB, skip func(string, error)) error) (BackupStats, error) {
+	if opts.ChunkBytes <= 0 || opts.ChunkBytes%aes.BlockSize != 0 {
+		return BackupStats{}, fmt.Errorf("backup: need ChunkBytes greater than zero, and a multiple of %v, got %v", aes.BlockSize, opts.ChunkBytes)
+	}
+
+	tempDir, err := ioutil.TempDir("", "cloudbackuptmp")
+	if err != nil {
+		return BackupStats{}, fmt.Errorf("unable to make temporary directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	db, metaFile, stored, err := r.openDB(ctx, tempDir)
+	if err != nil {
+		return BackupStats{}, err
+	}
+
+	store := r.chunkStore
+	var obfuscator *obfuscatingChunkStore
+	if opts.Obfuscate != nil {
+		if obfuscator, err = newObfuscatingChunkStore(store, *opts.Obfuscate, db.PutDecoy); err != nil {
+			db.Close()
+			return BackupStats{}, err
+		}
+		store = obfuscator
+	}
+	chunkStore, err := newDedupingChunkStore(ctx, store, opts.SkipExisting)
+	if err != nil {
+		db.Close()
+		return BackupStats{}, err
+	}
+
+	var skipped []SkippedFile
+	err = fn(chunkStore, db, func(path string, err error) {
+		skipped = append(skipped, SkippedFile{path, err})
+	})
+	if err == nil && obfuscator != nil {
+		// Decoys are recorded in db, so must all be made before it is closed and uploaded.
+		err = obfuscator.flush(ctx)
+		obfuscator.stopDecoys()
+	}
+	changed := db.Changed()
+	db.Close()
+	if err != nil {
+		return chunkStore.Stats(), err
+	}
+
+	// The summary is taken before the metadata is stored, so that it can be stored with it.
+	summary := backupSummary(progress, chunkStore.Stats(), metaFile)
+	if r.metaFile == "" {
+		if err := r.storeMetadata(ctx, chunkStore, tempDir, metaFile, changed, stored, opts.ChunkBytes, opts.PadMetadata, &summary); err != nil {
+			return chunkStore.Stats(), err
+		}
+	}
+	stats := chunkStore.Stats()
+	stats.Summary = summary
+	stats.Summary.Duration = time.Since(summary.Start)
+
+	if len(skipped) > 0 {
+		return stats, &PartialError{skipped}
+	}
+	return stats, nil
+}
+
+// storeMetadata uploads the metadata database at metaFile. If another backup has stored metadata since stored was fetched,
+// the entries at changed paths are merged into the latest metadata, and that is uploaded instead. summary, if non-nil, is stored with it.
+func (r *Repository) storeMetadata(ctx context.Context, chunkStore chunkstore.ChunkStore, tempDir, metaFile string, changed []string, stored *storedMetadata, chunkBytes int, pad bool, summary *Summary) error {
+	chunkStore, err := r.metadataStore(chunkStore)
+	if err != nil {
+		return err
+	}
+	for conflicts := 0; ; conflicts++ {
+		err := uploadMetadataFile(ctx, r.aesKey, r.hmacKey, chunkStore, metaFile, chunkBytes, pad, stored, summary)
+		if err != chunkstore.ErrVersionMismatch {
+			return err
+		}
+		if conflicts >= maxMetadataConflicts {
+			return fmt.Errorf("giving up storing metadata after it was concurrently changed %d times", conflicts+1)
+		}
+		if metaFile, stored, err = mergeLatestMetadata(ctx, r.aesKey, r.hmacKey, chunkStore, tempDir, metaFile, changed, stored); err != nil {
+			return fmt.Errorf("error merging concurrently stored metadata: %v", err)
+		}
+	}
+}
+
+// chunkPadding returns the padTo function for encryptFile described by opts.
+func chunkPadding(opts BackupOptions) func(int) int {
+	if !opts.PadChunks {
+		return nil
+	}
+	return func(n int) int { return paddedChunkCount(n, opts.PadChunkQuantum) }
+}
+
+func (r *Repository) backupPath(ctx context.Context, chunkStore chunkstore.ChunkStore, db *meta.DB, root string, opts BackupOptions, skip func(string, error), progress *progressTracker) error {
+	seen := make(map[string]bool)
+	err := walkPath(ctx, root, opts, skip, func(file string, fi os.FileInfo) {
+		if fi.IsDir() {
+			// The working directory itself isn't restored, so has no entry.
+			if file != "." {
+				if err := storeDirMetadata(db, r.fsCache, file, fi); err != nil {
+					skip(file, err)
+				}
+			}
+			return
+		}
+		if err := encryptFileAndStoreMetadata(ctx, r.aesKey, r.hmacKey, chunkStore, opts.ChunkBytes, db, r.fsCache, file, fi, opts.Reupload, chunkPadding(opts), progress); err != nil {
+			skip(file, err)
+		}
+		seen[filepath.Clean(file)] = true
+		progress.fileDone()
+	})
+	if err != nil {
+		return err
+	}
+	progress.filesDeleted(countDeleted(db, root, seen))
+	return nil
+}
+
+// walkPath calls visit with root, and, if it is a directory, everything under it, skipping anything excluded by opts.
+func walkPath(ctx context.Context, root string, opts BackupOptions, skip func(string, error), visit func(file string, fi os.FileInfo)) error {
+	rootFI, err := os.Stat(root)
+	if err != nil {
+		skip(root, fmt.Errorf("error stating file for encryption: %v", err))
+		return nil
+	}
+	ex := newExcluder(opts, device(rootFI))
+
+	fn := func(file string, fi os.FileInfo, err error) error {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if err != nil {
+			skip(file, err)
+			return nil
+		}
+		exclude, err := ex.exclude(file, fi)
+		if err != nil {
+			skip(file, err)
+			return nil
+		}
+		if exclude {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			} else {
+				return nil
+			}
+		}
+		visit(file, fi)
+		return nil
+	}
+	if rootFI.IsDir() {
+		return filepath.Walk(root, fn)
+	}
+	return fn(root, rootFI, nil)
+}
+
+// countPaths counts the files which backing up paths would back up, and their total size.
+func countPaths(ctx context.Context, paths []string, opts BackupOptions) (files, bytes int64, err error) {
+	for _, path := range paths {
+		if err := walkPath(ctx, path, opts, func(string, error) {}, func(file string, fi os.FileInfo) {
+			if !fi.IsDir() {
+				files++
+				bytes += fi.Size()
+			}
+		}); err != nil {
+			return 0, 0, err
+		}
+	}
+	return files, bytes, nil
+}
+
+// Restore decrypts each of paths, which may be files or directories, into the current working directory.
+// Files are created (or overwritten) atomically.
+func (r *Repository) Restore(ctx context.Context, paths []string, opts RestoreOptions) (Summary, error) {
+	tempDir, err := ioutil.TempDir(opts.TempDir, "cloudbackuptmp")
+	if err != nil {
+		return Summary{}, fmt.Errorf("unable to make temporary directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	owners, err := newOwnership(r.fsCache, opts)
+	if err != nil {
+		return Summary{}, err
+	}
+
+	db, _, _, err := r.openDB(ctx, tempDir)
+	if err != nil {
+		return Summary{}, err
+	}
+	defer db.Close()
+
+	var totalFiles, totalBytes int64
+	if opts.Progress != nil {
+		for _, path := range paths {
+			if err := db.Walk(path, func(path string, e meta.Entry) error {
+				if !e.Mode.IsDir() {
+					totalFiles++
+					totalBytes += e.Bytes
+				}
+				return nil
+			}); err != nil {
+				return Summary{}, err
+			}
+		}
+	}
+	progress := startProgress(opts.Progress, opts.ProgressInterval, totalFiles, totalBytes)
+	defer progress.finish()
+
+	// Directories may have been removed since the last restore.
+	r.fsCache.Forget(".")
+	for _, path := range paths {
+		// Walk visits directories before the files in them, so directories are made first. They are made (or, if they already exist, e.g. from
+		// an earlier restore, changed to be) writable by their owner, so that their contents can be written, and their own permissions are
+		// applied afterwards, deepest first, so read-only directories restore correctly.
+		var dirs []restoredDir
+		if err := db.Walk(path, func(path string, e meta.Entry) error {
+			if !e.Mode.IsDir() {
+				if err := decryptFile(ctx, r.aesKey, r.hmacKey, r.chunkStore, &e, owners, tempDir, path, progress); err != nil {
+					return err
+				}
+				progress.fileDone()
+				return nil
+			}
+			if r.fsCache.Exists(path) {
+				if err := makeOwnerWritable(path); err != nil {
+					return err
+				}
+			} else {
+				if err := os.Mkdir(path, 0700); err != nil {
+					return fmt.Errorf("unable to mkdir %q: %v", path, err)
+				}
+				r.fsCache.MarkExists(path)
+			}
+			dirs = append(dirs, restoredDir{path, e})
+			return nil
+		}); err != nil {
+			return Summary{}, err
+		}
+		for i := len(dirs) - 1; i >= 0; i-- {
+			if err := restoreDirMetadata(dirs[i].path, &dirs[i].entry, owners); err != nil {
+				return Summary{}, err
+			}
+		}
+	}
+	return restoreSummary(progress), nil
+}
+
+// List returns the entries for path and, if it is a directory, everything under it. A path of "." lists the whole repository.
+func (r *Repository) List(ctx context.Context, path string) (map[string]meta.Entry, error) {
+	tempDir, err := ioutil.TempDir("", "cloudbackuptmp")
+	if err != nil {
+		return nil, fmt.Errorf("unable to make temporary directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	db, _, _, err := r.openDB(ctx, tempDir)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	return db.Get(path)
+}
+
+// Walk calls fn with the entries for path and, if it is a directory, everything under it, as meta.DB.Walk does. A path of "." walks the whole repository.
+// Unlike List, it doesn't hold every entry in memory at once.
+func (r *Repository) Walk(ctx context.Context, path string, fn func(path string, e meta.Entry) error) error {
+	tempDir, err := ioutil.TempDir("", "cloudbackuptmp")
+	if err != nil {
+		return fmt.Errorf("unable to make temporary directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	db, _, _, err := r.openDB(ctx, tempDir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Walk(path, fn)
+}
+
+// Cat writes at most length bytes of the file at path, starting at offset, to dst. A negative length means until the end of the file.
+// Only the chunks needed for the requested range are fetched.
+func (r *Repository) Cat(ctx context.Context, path string, dst io.Writer, offset, length int64) error {
+	if offset < 0 {
+		return fmt.Errorf("backup: need offset to be non-negative, got %v", offset)
+	}
+	path = filepath.Clean(path)
+	var e *meta.Entry
+	if err := r.Walk(ctx, path, func(p string, entry meta.Entry) error {
+		if p == path && !entry.Mode.IsDir() {
+			e = &entry
+			return nil
+		}
+		// Anything other than the entries of the directories containing path means path is a directory.
+		if !strings.HasPrefix(path, p+"/") {
+			return ErrNotFile
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	if e == nil {
+		return ErrNotFile
+	}
+	if offset == 0 && length < 0 {
+		return decryptChunks(ctx, r.aesKey, r.hmacKey, dst, r.chunkStore, e)
+	}
+	return decryptChunkRange(ctx, r.aesKey, r.hmacKey, dst, r.chunkStore, e, offset, length)
+}
+
+// History returns the times at which the stored metadata was updated, newest first.
+// Metadata stored before it was sharded has no history.
+func (r *Repository) History(ctx context.Context) ([]time.Time, error) {
+	var times []time.Time
+	err := r.walkRoots(ctx, func(root *root) {
+		times = append(times, root.Time)
+	})
+	return times, err
+}
+
+// RepositorySize describes the files recorded in the repository's current metadata.
+type RepositorySize struct {
+	Files int64
+	// Bytes is the total size of the files, and Chunks the number of distinct chunks they are stored in.
+	Bytes  int64
+	Chunks int64
+}
+
+// Size totals the files recorded in the repository's current metadata. Chunks which are only referred to by older versions of the metadata,
+// and decoys, aren't counted.
+func (r *Repository) Size(ctx context.Context) (RepositorySize, error) {
+	var size RepositorySize
+	chunks := make(map[string]bool)
+	err := r.Walk(ctx, ".", func(path string, e meta.Entry) error {
+		if e.Mode.IsDir() {
+			return nil
+		}
+		size.Files++
+		size.Bytes += e.Bytes
+		for _, c := range e.Chunks {
+			chunks[string(c.CiphertextMAC)] = true
+		}
+		return nil
+	})
+	size.Chunks = int64(len(chunks))
+	return size, err
+}
+
+// walkRoots calls fn with each stored root, newest first.
+func (r *Repository) walkRoots(ctx context.Context, fn func(*root)) error {
+	pointer, _, err := readMetaPointer(ctx, r.aesKey, r.chunkStore)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for pointer.Mode.IsDir() {
+		root, _, err := fetchRoot(ctx, r.aesKey, r.hmacKey, r.chunkStore, pointer)
+		if err != nil {
+			return err
+		}
+		fn(root)
+		if root.Previous == nil {
+			break
+		}
+		var previous blobRef
+		if err := gob.NewDecoder(bytes.NewReader(root.Previous)).Decode(&previous); err != nil {
+			return fmt.Errorf("error decoding metadata reference: %v", err)
+		}
+		pointer = &previous.Entry
+	}
+	return nil
+}
+
+// MetadataOptions are as in BackupOptions, and are used when storing metadata other than by backing up.
+type MetadataOptions struct {
+	ChunkBytes  int
+	PadMetadata bool
+}
+
+// Upgrade upgrades the repository's metadata to meta.SchemaVersion, storing it again if it was older, and returns the schema version it had before.
+// Metadata is upgraded whenever it is opened anyway, but until it is stored again, every run has to repeat the upgrade.
+func (r *Repository) Upgrade(ctx context.Context, opts MetadataOptions) (int, error) {
+	if opts.ChunkBytes <= 0 || opts.ChunkBytes%aes.BlockSize != 0 {
+		return 0, fmt.Errorf("backup: need ChunkBytes greater than zero, and a multiple of %v, got %v", aes.BlockSize, opts.ChunkBytes)
+	}
+	if r.metaFile != "" {
+		from, err := meta.SchemaVersionOf(r.metaFile)
+		if err != nil {
+			return 0, fmt.Errorf("error reading schema version of %v: %v", r.metaFile, err)
+		}
+		db, err := meta.NewDB(r.metaFile)
+		if err != nil {
+			return from, fmt.Errorf("error opening database at %v: %v", r.metaFile, err)
+		}
+		db.Close()
+		return from, nil
+	}
+
+	tempDir, err := ioutil.TempDir("", "cloudbackuptmp")
+	if err != nil {
+		return 0, fmt.Errorf("unable to make temporary directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	db, metaFile, stored, err := r.openDB(ctx, tempDir)
+	if err != nil {
+		return 0, err
+	}
+	db.Close()
+	if stored.version == 0 {
+		// Nothing has been stored, so there's nothing to upgrade.
+		return meta.SchemaVersion, nil
+	}
+	if stored.schemaVersion < meta.SchemaVersion {
+		if err := r.storeMetadata(ctx, r.chunkStore, tempDir, metaFile, nil, stored, opts.ChunkBytes, opts.PadMetadata, nil); err != nil {
+			return stored.schemaVersion, err
+		}
+	}
+	return stored.schemaVersion, nil
+}
+
+// ExportMetadata writes the repository's metadata to w in format.
+func (r *Repository) ExportMetadata(ctx context.Context, w io.Writer, format meta.Format) error {
+	tempDir, err := ioutil.TempDir("", "cloudbackuptmp")
+	if err != nil {
+		return fmt.Errorf("unable to make temporary directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	db, _, _, err := r.openDB(ctx, tempDir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := db.Export(w, format); err != nil {
+		return fmt.Errorf("error exporting metadata: %v", err)
+	}
+	return nil
+}
+
+// ImportMetadata replaces the repository's metadata with metadata read from src in format, as written by ExportMetadata, and stores it.
+// If another run stores metadata concurrently, the imported entries are merged into that instead.
+func (r *Repository) ImportMetadata(ctx context.Context, src io.Reader, format meta.Format, opts MetadataOptions) error {
+	if opts.ChunkBytes <= 0 || opts.ChunkBytes%aes.BlockSize != 0 {
+		return fmt.Errorf("backup: need ChunkBytes greater than zero, and a multiple of %v, got %v", aes.BlockSize, opts.ChunkBytes)
+	}
+	tempDir, err := ioutil.TempDir("", "cloudbackuptmp")
+	if err != nil {
+		return fmt.Errorf("unable to make temporary directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	db, metaFile, stored, err := r.openDB(ctx, tempDir)
+	if err != nil {
+		return err
+	}
+	err = db.Import(src, format)
+	changed := db.Changed()
+	db.Close()
+	if err != nil {
+		return fmt.Errorf("error importing metadata: %v", err)
+	}
+
+	if r.metaFile == "" {
+		return r.storeMetadata(ctx, r.chunkStore, tempDir, metaFile, changed, stored, opts.ChunkBytes, opts.PadMetadata, nil)
+	}
+	return nil
+}
+
+// openDB opens the metadata database, fetching it into tempDir unless r uses a local metadata file.
+// It also returns what is known about the stored metadata, which is nil when using a local metadata file.
+func (r *Repository) openDB(ctx context.Context, tempDir string) (*meta.DB, string, *storedMetadata, error) {
+	metaFile := r.metaFile
+	var stored *storedMetadata
+	if metaFile == "" {
+		chunkStore, err := r.metadataStore(r.chunkStore)
+		if err != nil {
+			return nil, "", nil, err
+		}
+		if metaFile, stored, err = fetchMetadataFile(ctx, r.aesKey, r.hmacKey, chunkStore, tempDir); err != nil {
+			return nil, "", nil, err
+		}
+		// Everything which is cached and still current has just been read.
+		if cache, ok := chunkStore.(*metadataCache); ok {
+			if err := cache.prune(); err != nil {
+				return nil, "", nil, err
+			}
+		}
+	}
+	db, err := meta.NewDB(metaFile)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("error opening database at %v: %v", metaFile, err)
+	}
+	return db, metaFile, stored, nil
+}
@@ -0,0 +1,1289 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/boltdb/bolt"
+
+	"github.com/illicitonion/cloudbackup/chunkstore"
+	"github.com/illicitonion/cloudbackup/crypto"
+	"github.com/illicitonion/cloudbackup/fscache"
+	"github.com/illicitonion/cloudbackup/memory"
+	"github.com/illicitonion/cloudbackup/meta"
+)
+
+func TestEncryptUploads(t *testing.T) {
+	chunkStore := &recordingChunkStore{}
+	db := makeDB(t)
+	do(t, db, chunkStore, "01234567890123456", true, 0x01)
+	want := map[string][]byte{
+		"500002b7d895d882170ea0823388708be81ca5f5f64f2c358e6cb7ee7ca16e37": []byte{
+			0x09, 0xB3, 0x76, 0x13, 0x6D, 0x0B, 0xF6, 0x2E,
+			0xD6, 0xD0, 0x1C, 0x73, 0xE7, 0xF3, 0xD3, 0x99,
+		},
+		"bfda79581f572a70cd481efb63ef6f07e52f3e45afb21ca35a452a3e49e77e4b": []byte{
+			0x87, 0x6B, 0x7D, 0xE4, 0xE8, 0xFF, 0xD0, 0x59,
+			0xF0, 0x79, 0x30, 0x9E, 0xC1, 0xE9, 0x8C, 0xC0,
+		},
+	}
+	if !reflect.DeepEqual(want, chunkStore.saves) {
+		t.Errorf("saves: want %v got %v", want, chunkStore.saves)
+	}
+}
+
+func TestEncryptNoChangeUpload(t *testing.T) {
+	chunkStore := &recordingChunkStore{}
+	db := makeDB(t)
+	do(t, db, chunkStore, "01234567890123456", true, 0x01)
+	chunkStore.Reset()
+	do(t, db, chunkStore, "11234567890123456", true, 0x02)
+	want := map[string][]byte{
+		"cd6ebe78f3a66a4db47e8c8a704970b341192f8d9f4035ee9c63455f9915c644": []byte{
+			0xA2, 0xF8, 0x17, 0x63, 0x1C, 0x54, 0x34, 0xAC,
+			0xDB, 0x20, 0x87, 0x4E, 0xC2, 0xAD, 0x18, 0x21,
+		},
+		"bfda79581f572a70cd481efb63ef6f07e52f3e45afb21ca35a452a3e49e77e4b": []byte{
+			0x87, 0x6B, 0x7D, 0xE4, 0xE8, 0xFF, 0xD0, 0x59,
+			0xF0, 0x79, 0x30, 0x9E, 0xC1, 0xE9, 0x8C, 0xC0,
+		},
+	}
+	if !reflect.DeepEqual(want, chunkStore.saves) {
+		t.Errorf("saves: want %v got % X", want, chunkStore.saves)
+	}
+}
+
+// Known chunks are looked up by the file's path, not its name, so that files with the same name in different directories aren't confused.
+func TestGetKnownChunksByPath(t *testing.T) {
+	db := makeDB(t)
+	top := []meta.Chunk{{IV: []byte("top"), CiphertextMAC: []byte("top mac")}}
+	nested := []meta.Chunk{{IV: []byte("nested"), CiphertextMAC: []byte("nested mac")}}
+	if _, err := db.Put("file", &meta.Entry{Mode: 0600, Chunks: top}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Put("dir/file", &meta.Entry{Mode: 0600, Chunks: nested}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := getKnownChunks("dir/file", db); !reflect.DeepEqual(got, nested) {
+		t.Errorf("dir/file: want %v got %v", nested, got)
+	}
+	if got := getKnownChunks("file", db); !reflect.DeepEqual(got, top) {
+		t.Errorf("file: want %v got %v", top, got)
+	}
+	if got := getKnownChunks("dir/missing", db); got != nil {
+		t.Errorf("dir/missing: want nil got %v", got)
+	}
+}
+
+func TestEncryptNoChangeNoUpload(t *testing.T) {
+	chunkStore := &recordingChunkStore{}
+	db := makeDB(t)
+	do(t, db, chunkStore, "01234567890123456", false, 0x01)
+	chunkStore.Reset()
+	do(t, db, chunkStore, "01234567890123456", false, 0x02)
+	want := map[string][]byte{}
+	if !reflect.DeepEqual(want, chunkStore.saves) {
+		t.Errorf("saves: want %v got %v", want, chunkStore.saves)
+	}
+}
+
+func TestDecryptChunkRange(t *testing.T) {
+	chunkStore := &recordingChunkStore{}
+	db := makeDB(t)
+	v := "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJ"
+	do(t, db, chunkStore, v, true, 0x01)
+	entries, err := db.Get("filename")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := entries["filename"]
+
+	for _, tc := range []struct {
+		offset, length int64
+		want           string
+	}{
+		{0, -1, v},
+		{0, 3, "012"},
+		{14, 4, "efgh"},
+		{16, 16, "ghijklmnopqrstuv"},
+		{20, -1, v[20:]},
+		{40, 100, v[40:]},
+		{46, 1, ""},
+		{100, -1, ""},
+	} {
+		buf := bytes.NewBuffer(nil)
+		if err := decryptChunkRange(context.Background(), bytes.Repeat([]byte{0x02}, 32), bytes.Repeat([]byte{0x03}, 32), buf, chunkStore, &e, tc.offset, tc.length); err != nil {
+			t.Fatal(err)
+		}
+		if got := buf.String(); got != tc.want {
+			t.Errorf("offset %v length %v: want %q got %q", tc.offset, tc.length, tc.want, got)
+		}
+	}
+
+	for _, bad := range []meta.Entry{
+		{Bytes: e.Bytes},
+		{Bytes: e.Bytes, Chunks: e.Chunks[:1]},
+	} {
+		if err := decryptChunkRange(context.Background(), bytes.Repeat([]byte{0x02}, 32), bytes.Repeat([]byte{0x03}, 32), ioutil.Discard, chunkStore, &bad, 0, -1); err == nil {
+			t.Errorf("%d bytes in %d chunks: want error", bad.Bytes, len(bad.Chunks))
+		}
+	}
+	if err := chunkStore.Save(context.Background(), hex.EncodeToString(e.Chunks[0].CiphertextMAC), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := decryptChunkRange(context.Background(), bytes.Repeat([]byte{0x02}, 32), bytes.Repeat([]byte{0x03}, 32), ioutil.Discard, chunkStore, &e, 0, -1); err == nil {
+		t.Error("empty chunk: want error")
+	}
+}
+
+func TestEncryptStream(t *testing.T) {
+	chunkStore := &recordingChunkStore{}
+	db := makeDB(t)
+	aesKey, hmacKey := bytes.Repeat([]byte{0x02}, 32), bytes.Repeat([]byte{0x03}, 32)
+	v := "0123456789abcdefghijklmnopqrstuvwxyz"
+	if err := encryptStreamAndStoreMetadata(context.Background(), aesKey, hmacKey, chunkStore, 16, db, fscache.New(fscache.System{}), "db/dump.sql", bytes.NewBufferString(v), false, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := db.Get("db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(entries); got != 2 {
+		t.Fatalf("entries: want 2 got %v", entries)
+	}
+	if dir := entries["db/"]; !dir.Mode.IsDir() {
+		t.Errorf("db/: want dir got mode %v", dir.Mode)
+	}
+	e := entries["db/dump.sql"]
+	if want := int64(len(v)); e.Bytes != want {
+		t.Errorf("bytes: want %v got %v", want, e.Bytes)
+	}
+	if want := 3; len(e.Chunks) != want {
+		t.Errorf("chunks: want %v got %v", want, len(e.Chunks))
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := decryptChunks(context.Background(), aesKey, hmacKey, buf, chunkStore, &e); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); got != v {
+		t.Errorf("decrypted: want %q got %q", v, got)
+	}
+}
+
+func TestMetadataFileRoundTrip(t *testing.T) {
+	for _, pad := range []bool{false, true} {
+		chunkStore := &recordingChunkStore{}
+		aesKey, hmacKey := bytes.Repeat([]byte{0x02}, 32), bytes.Repeat([]byte{0x03}, 32)
+		path := makeMetaFile(t)
+		defer os.Remove(path)
+		want := meta.Entry{Bytes: 3, Mode: 0600, User: "foo", Group: "bar"}
+		putEntries(t, path, map[string]meta.Entry{"dir/file": want})
+
+		if err := uploadMetadataFile(context.Background(), aesKey, hmacKey, chunkStore, path, 1024, pad, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		pointer, _, err := readMetaPointer(context.Background(), aesKey, chunkStore)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if chunks := len(pointer.Chunks); pad && chunks != paddedChunkCount(chunks, 0) {
+			t.Errorf("padded: want a power of two chunks got %v", chunks)
+		}
+
+		if got := fetchEntries(t, chunkStore, "dir/file"); !reflect.DeepEqual(want, got["dir/file"]) {
+			t.Errorf("pad %v: want %v got %v", pad, want, got["dir/file"])
+		}
+	}
+}
+
+func TestMetadataUploadsOnlyChangedShards(t *testing.T) {
+	chunkStore := &recordingChunkStore{}
+	aesKey, hmacKey := bytes.Repeat([]byte{0x02}, 32), bytes.Repeat([]byte{0x03}, 32)
+	path := makeMetaFile(t)
+	defer os.Remove(path)
+	// Enough entries that each directory is stored as its own shard, rather than inline in the root shard.
+	entries := make(map[string]meta.Entry)
+	for _, dir := range []string{"a", "b"} {
+		for i := 0; i < 20; i++ {
+			entries[fmt.Sprintf("%s/%d", dir, i)] = meta.Entry{Bytes: int64(i), Chunks: []meta.Chunk{{IV: bytes.Repeat([]byte{byte(i)}, 16), CiphertextMAC: bytes.Repeat([]byte{byte(i)}, 32)}}, Mode: 0600}
+		}
+	}
+	putEntries(t, path, entries)
+	if err := uploadMetadataFile(context.Background(), aesKey, hmacKey, chunkStore, path, 1024, false, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tempDir := makeTempDir(t)
+	defer os.RemoveAll(tempDir)
+	fetchedPath, stored, err := fetchMetadataFile(context.Background(), aesKey, hmacKey, chunkStore, tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putEntries(t, fetchedPath, map[string]meta.Entry{"a/0": meta.Entry{Bytes: 100, Mode: 0600}})
+	chunkStore.Reset()
+	if err := uploadMetadataFile(context.Background(), aesKey, hmacKey, chunkStore, fetchedPath, 1024, false, stored, nil); err != nil {
+		t.Fatal(err)
+	}
+	// The shard for a, the root, and the "meta" pointer.
+	if want := 3; len(chunkStore.saves) != want {
+		t.Errorf("saves: want %v got %v", want, len(chunkStore.saves))
+	}
+
+	got := fetchEntries(t, chunkStore, ".")
+	if want := int64(100); got["a/0"].Bytes != want {
+		t.Errorf("a/0: want %v bytes got %v", want, got["a/0"].Bytes)
+	}
+	if want := entries["b/3"]; !reflect.DeepEqual(want, got["b/3"]) {
+		t.Errorf("b/3: want %v got %v", want, got["b/3"])
+	}
+}
+
+func TestMetadataCacheFetchesOnlyChangedShards(t *testing.T) {
+	chunkStore := &readRecordingChunkStore{}
+	aesKey, hmacKey := bytes.Repeat([]byte{0x02}, 32), bytes.Repeat([]byte{0x03}, 32)
+	cacheDir := makeTempDir(t)
+	defer os.RemoveAll(cacheDir)
+	newCache := func() *metadataCache {
+		cache, err := newMetadataCache(chunkStore, cacheDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cache
+	}
+	fetch := func(cache *metadataCache) (string, *storedMetadata) {
+		tempDir := makeTempDir(t)
+		fetchedPath, stored, err := fetchMetadataFile(context.Background(), aesKey, hmacKey, cache, tempDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cache.prune(); err != nil {
+			t.Fatal(err)
+		}
+		return fetchedPath, stored
+	}
+
+	path := makeMetaFile(t)
+	defer os.Remove(path)
+	entries := make(map[string]meta.Entry)
+	for _, dir := range []string{"a", "b"} {
+		for i := 0; i < 20; i++ {
+			entries[fmt.Sprintf("%s/%d", dir, i)] = meta.Entry{Bytes: int64(i), Mode: 0600}
+		}
+	}
+	putEntries(t, path, entries)
+	if err := uploadMetadataFile(context.Background(), aesKey, hmacKey, newCache(), path, 1024, false, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Everything was cached as it was stored.
+	fetchedPath, stored := fetch(newCache())
+	defer os.RemoveAll(filepath.Dir(fetchedPath))
+	if len(chunkStore.reads) != 0 {
+		t.Errorf("unchanged: want no reads got %v", chunkStore.reads)
+	}
+
+	// Metadata stored by someone else is fetched, but only the parts which changed.
+	putEntries(t, fetchedPath, map[string]meta.Entry{"a/0": meta.Entry{Bytes: 100, Mode: 0600}})
+	chunkStore.Reset()
+	if err := uploadMetadataFile(context.Background(), aesKey, hmacKey, chunkStore, fetchedPath, 1024, false, stored, nil); err != nil {
+		t.Fatal(err)
+	}
+	want := make(map[string]bool)
+	for name := range chunkStore.saves {
+		if name != "meta" {
+			want[name] = true
+		}
+	}
+	chunkStore.reads = nil
+	cache := newCache()
+	fetchedPath, _ = fetch(cache)
+	defer os.RemoveAll(filepath.Dir(fetchedPath))
+	got := make(map[string]bool)
+	for _, name := range chunkStore.reads {
+		got[name] = true
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("changed: want reads of %v got %v", want, got)
+	}
+	db, err := meta.NewDB(fetchedPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetched, err := db.Get(".")
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(100); fetched["a/0"].Bytes != want {
+		t.Errorf("a/0: want %v bytes got %v", want, fetched["a/0"].Bytes)
+	}
+
+	// Chunks of the replaced metadata were pruned.
+	infos, err := ioutil.ReadDir(cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != len(cache.used) {
+		t.Errorf("pruned: want %v cached chunks got %v", len(cache.used), len(infos))
+	}
+}
+
+func TestFetchLegacyMetadataFile(t *testing.T) {
+	chunkStore := &recordingChunkStore{}
+	want := meta.Entry{Bytes: 3, Mode: 0600, User: "foo", Group: "bar"}
+	storeLegacyMetadataFile(t, chunkStore, map[string]meta.Entry{"dir/file": want})
+
+	if got := fetchEntries(t, chunkStore, "dir/file"); !reflect.DeepEqual(want, got["dir/file"]) {
+		t.Errorf("want %v got %v", want, got["dir/file"])
+	}
+}
+
+func TestRepositoryUpgrade(t *testing.T) {
+	repo := makeRepository(t)
+	want := meta.Entry{Bytes: 3, Mode: 0600, User: "foo", Group: "bar"}
+	storeLegacyMetadataFile(t, repo.chunkStore, map[string]meta.Entry{"dir/file": want})
+
+	opts := MetadataOptions{ChunkBytes: 1024}
+	from, err := repo.Upgrade(context.Background(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from != 0 {
+		t.Errorf("first upgrade: want from version 0 got %v", from)
+	}
+	pointer, _, err := readMetaPointer(context.Background(), repo.aesKey, repo.chunkStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pointer.Mode.IsDir() {
+		t.Errorf("want upgraded metadata to be stored as a root got mode %v", pointer.Mode)
+	}
+	if from, err = repo.Upgrade(context.Background(), opts); err != nil {
+		t.Fatal(err)
+	}
+	if from != meta.SchemaVersion {
+		t.Errorf("second upgrade: want from version %v got %v", meta.SchemaVersion, from)
+	}
+	if got := fetchEntries(t, repo.chunkStore, "dir/file"); !reflect.DeepEqual(want, got["dir/file"]) {
+		t.Errorf("want %v got %v", want, got["dir/file"])
+	}
+}
+
+func TestRepositoryExportImportMetadata(t *testing.T) {
+	repo := makeRepository(t)
+	src := makeTempDir(t)
+	defer os.RemoveAll(src)
+	if err := os.Mkdir(filepath.Join(src, "dir"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	writeTempFile(t, src, "dir/file", "foo")
+	defer chdir(t, src)()
+	if _, err := repo.Backup(context.Background(), []string{"."}, BackupOptions{ChunkBytes: 4096}); err != nil {
+		t.Fatal(err)
+	}
+	want, err := repo.List(context.Background(), ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, format := range []meta.Format{meta.JSON, meta.JSONLines} {
+		dump := bytes.NewBuffer(nil)
+		if err := repo.ExportMetadata(context.Background(), dump, format); err != nil {
+			t.Fatal(err)
+		}
+		// Restoring metadata into an empty repository, e.g. after losing the "meta" pointer, makes the chunks readable again.
+		recovered, err := NewRepository(repo.aesKey, repo.hmacKey, &recordingChunkStore{}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := recovered.ImportMetadata(context.Background(), dump, format, MetadataOptions{ChunkBytes: 4096}); err != nil {
+			t.Fatal(err)
+		}
+		got, err := recovered.List(context.Background(), ".")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(want, got) {
+			t.Errorf("format %v: want %v got %v", format, want, got)
+		}
+	}
+}
+
+// storeLegacyMetadataFile stores entries as they were before metadata was sharded or versioned: the whole boltdb file, gzip'd and stored as a single file.
+func storeLegacyMetadataFile(t *testing.T, chunkStore chunkstore.ChunkStore, entries map[string]meta.Entry) {
+	aesKey, hmacKey := bytes.Repeat([]byte{0x02}, 32), bytes.Repeat([]byte{0x03}, 32)
+	path := makeMetaFile(t)
+	defer os.Remove(path)
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		for name, e := range entries {
+			bucket, err := tx.CreateBucketIfNotExists([]byte("."))
+			if err != nil {
+				return err
+			}
+			parts := strings.Split(name, "/")
+			for _, part := range parts[:len(parts)-1] {
+				if bucket, err = bucket.CreateBucketIfNotExists([]byte(part)); err != nil {
+					return err
+				}
+			}
+			encoded, err := meta.EncodeEntry(&e)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(parts[len(parts)-1]), encoded); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := storeBlob(context.Background(), aesKey, hmacKey, chunkStore, 1024, contents, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := meta.EncodeEntry(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, _, err := crypto.Encrypt(aesKey, hmacKey, metaIV, encoded, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := chunkStore.Save(context.Background(), "meta", ciphertext); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRepositoryHistory(t *testing.T) {
+	repo := makeRepository(t)
+	src := makeTempDir(t)
+	defer os.RemoveAll(src)
+	writeTempFile(t, src, "file", "foo")
+
+	defer chdir(t, src)()
+	for i := 0; i < 2; i++ {
+		if _, err := repo.Backup(context.Background(), []string{"."}, BackupOptions{ChunkBytes: 4096}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	history, err := repo.History(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 || history[0].Before(history[1]) {
+		t.Errorf("want two times, newest first, got %v", history)
+	}
+}
+
+func TestRepositorySize(t *testing.T) {
+	repo := makeRepository(t)
+	src := makeTempDir(t)
+	defer os.RemoveAll(src)
+	if err := os.Mkdir(filepath.Join(src, "dir"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	writeTempFile(t, src, "file", "foo")
+	writeTempFile(t, src, "dir/file", "0123456789")
+
+	defer chdir(t, src)()
+	if _, err := repo.Backup(context.Background(), []string{"."}, BackupOptions{ChunkBytes: 4096}); err != nil {
+		t.Fatal(err)
+	}
+	size, err := repo.Size(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (RepositorySize{Files: 2, Bytes: 13, Chunks: 2}); size != want {
+		t.Errorf("want %+v got %+v", want, size)
+	}
+}
+
+func makeMetaFile(t *testing.T) string {
+	f, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	return f.Name()
+}
+
+func putEntries(t *testing.T, path string, entries map[string]meta.Entry) {
+	db, err := meta.NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for name, e := range entries {
+		e := e
+		if _, err := db.Put(name, &e); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// fetchEntries fetches the metadata stored in chunkStore, and returns the entries for path.
+func fetchEntries(t *testing.T, chunkStore chunkstore.ChunkStore, path string) map[string]meta.Entry {
+	tempDir := makeTempDir(t)
+	defer os.RemoveAll(tempDir)
+	fetchedPath, _, err := fetchMetadataFile(context.Background(), bytes.Repeat([]byte{0x02}, 32), bytes.Repeat([]byte{0x03}, 32), chunkStore, tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := meta.NewDB(fetchedPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	entries, err := db.Get(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func TestEncryptPadsChunks(t *testing.T) {
+	chunkStore := &recordingChunkStore{}
+	db := makeDB(t)
+	aesKey, hmacKey := bytes.Repeat([]byte{0x02}, 32), bytes.Repeat([]byte{0x03}, 32)
+	v := "0123456789abcdefghijklmnopqrstuvwxyz"
+	padTo := func(n int) int { return paddedChunkCount(n, 0) }
+	chunks, err := encryptFile(context.Background(), aesKey, hmacKey, makeIV, db, chunkStore, 16, "filename", bytes.NewBufferString(v), int64(len(v)), false, padTo, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := 4; len(chunks) != want || len(chunkStore.saves) != want {
+		t.Fatalf("want %v chunks saved got %v chunks, %v saves", want, len(chunks), len(chunkStore.saves))
+	}
+	e := meta.Entry{Bytes: int64(len(v)), Chunks: chunks, Mode: 0600}
+	if _, err := db.Put("filename", &e); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if err := decryptChunks(context.Background(), aesKey, hmacKey, buf, chunkStore, &e); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); got != v {
+		t.Errorf("decrypted: want %q got %q", v, got)
+	}
+
+	// The dummy chunk shouldn't be needed to decrypt the file.
+	if err := chunkStore.Delete(context.Background(), hex.EncodeToString(chunks[3].CiphertextMAC)); err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if err := decryptChunks(context.Background(), aesKey, hmacKey, buf, chunkStore, &e); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unchanged files reuse their dummy chunks.
+	chunkStore.Reset()
+	again, err := encryptFile(context.Background(), aesKey, hmacKey, makeIV, db, chunkStore, 16, "filename", bytes.NewBufferString(v), int64(len(v)), false, padTo, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(chunks, again) || len(chunkStore.saves) != 0 {
+		t.Errorf("want chunks reused with no saves, got %v saves", len(chunkStore.saves))
+	}
+
+	empty, err := encryptFile(context.Background(), aesKey, hmacKey, makeIV, nil, chunkStore, 16, "empty", bytes.NewBufferString(""), 0, false, padTo, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(empty) != 0 {
+		t.Errorf("empty file: want no chunks got %v", len(empty))
+	}
+}
+
+func TestPaddedChunkCount(t *testing.T) {
+	for _, tc := range []struct {
+		n, quantum, want int
+	}{
+		{1, 0, 1},
+		{2, 0, 2},
+		{3, 0, 4},
+		{5, 0, 8},
+		{1024, 0, 1024},
+		{1, 10, 10},
+		{10, 10, 10},
+		{11, 10, 20},
+	} {
+		if got := paddedChunkCount(tc.n, tc.quantum); got != tc.want {
+			t.Errorf("%v chunks with quantum %v: want %v got %v", tc.n, tc.quantum, tc.want, got)
+		}
+	}
+}
+
+func TestEncryptVanishedFileReturnsError(t *testing.T) {
+	dir := makeTempDir(t)
+	defer os.RemoveAll(dir)
+	path := writeTempFile(t, dir, "vanished", "foo")
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+
+	db := makeDB(t)
+	err = encryptFileAndStoreMetadata(context.Background(), bytes.Repeat([]byte{0x02}, 32), bytes.Repeat([]byte{0x03}, 32), &recordingChunkStore{}, 16, db, fscache.New(fscache.System{}), path, fi, false, nil, nil)
+	if err == nil {
+		t.Errorf("err: want non-nil got nil")
+	}
+}
+
+func makeDB(t *testing.T) *meta.DB {
+	f, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbPath := f.Name()
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err := meta.NewDB(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func do(t *testing.T, db *meta.DB, chunkStore chunkstore.ChunkStore, v string, uploadIfUnchanged bool, ivByte byte) {
+	makeIV := func() ([]byte, error) {
+		return bytes.Repeat([]byte{ivByte}, aes.BlockSize), nil
+	}
+
+	path := "filename"
+	chunks, err := encryptFile(context.Background(), bytes.Repeat([]byte{0x02}, 32), bytes.Repeat([]byte{0x03}, 32), makeIV, db, chunkStore, 16, path, bytes.NewBufferString(v), int64(len(v)), uploadIfUnchanged, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Put(path, &meta.Entry{
+		Bytes:  int64(len(v)),
+		Chunks: chunks,
+		Mode:   0777,
+		User:   "",
+		Group:  "",
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// recordingChunkStore records the chunks saved since it was last reset.
+type recordingChunkStore struct {
+	memory.ChunkStore
+	saves map[string][]byte
+}
+
+func (s *recordingChunkStore) Save(ctx context.Context, hmac string, contents []byte) error {
+	if s.saves == nil {
+		s.Reset()
+	}
+	s.saves[hmac] = contents
+	return s.ChunkStore.Save(ctx, hmac, contents)
+}
+
+func (s *recordingChunkStore) SaveIfVersion(ctx context.Context, name string, contents []byte, version int64) error {
+	if s.saves == nil {
+		s.Reset()
+	}
+	s.saves[name] = contents
+	return s.ChunkStore.SaveIfVersion(ctx, name, contents, version)
+}
+
+func (s *recordingChunkStore) Reset() {
+	s.saves = make(map[string][]byte)
+}
+
+// readRecordingChunkStore also records the names of the chunks read from it, other than the "meta" pointer.
+type readRecordingChunkStore struct {
+	recordingChunkStore
+	reads []string
+}
+
+func (s *readRecordingChunkStore) Read(ctx context.Context, name string) ([]byte, error) {
+	if name != "meta" {
+		s.reads = append(s.reads, name)
+	}
+	return s.recordingChunkStore.Read(ctx, name)
+}
+
+func TestRepositoryBackupAndRestore(t *testing.T) {
+	repo := makeRepository(t)
+	src := makeTempDir(t)
+	defer os.RemoveAll(src)
+	if err := os.Mkdir(filepath.Join(src, "dir"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	writeTempFile(t, src, "dir/file", "0123456789abcdefghijklmnopqrstuvwxyz")
+	writeTempFile(t, src, "other", "foo")
+
+	defer chdir(t, src)()
+	if _, err := repo.Backup(context.Background(), []string{"."}, BackupOptions{ChunkBytes: 4096}); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := repo.List(context.Background(), ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"dir/", "dir/file", "other"} {
+		if _, ok := entries[path]; !ok {
+			t.Errorf("want %v in listing, got %v", path, entries)
+		}
+	}
+	if e := entries["other"]; !e.HasIDs || e.UID != uint32(os.Getuid()) || e.GID != uint32(os.Getgid()) {
+		t.Errorf("other: want owner %v:%v got %v:%v (recorded: %v)", os.Getuid(), os.Getgid(), e.UID, e.GID, e.HasIDs)
+	}
+	var walked []string
+	if err := repo.Walk(context.Background(), ".", func(path string, e meta.Entry) error {
+		walked = append(walked, path)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"dir", "dir/file", "other"}; !reflect.DeepEqual(want, walked) {
+		t.Errorf("walk: want %v got %v", want, walked)
+	}
+
+	dst := makeTempDir(t)
+	defer os.RemoveAll(dst)
+	defer chdir(t, dst)()
+	if _, err := repo.Restore(context.Background(), []string{"."}, RestoreOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]string{"dir/file": "0123456789abcdefghijklmnopqrstuvwxyz", "other": "foo"} {
+		got, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%v: want %q got %q", path, want, got)
+		}
+	}
+	fi, err := os.Stat("dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := os.ModeDir | 0750; fi.Mode() != want {
+		t.Errorf("dir mode: want %v got %v", want, fi.Mode())
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if err := repo.Cat(context.Background(), "dir/file", buf, 10, 3); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "abc"; got != want {
+		t.Errorf("cat: want %q got %q", want, got)
+	}
+	if err := repo.Cat(context.Background(), "dir", buf, 0, -1); err != ErrNotFile {
+		t.Errorf("cat dir: want ErrNotFile got %v", err)
+	}
+	if err := repo.Cat(context.Background(), ".", buf, 0, -1); err != ErrNotFile {
+		t.Errorf("cat .: want ErrNotFile got %v", err)
+	}
+}
+
+func TestRepositoryBackupAndRestoreDirectories(t *testing.T) {
+	repo := makeRepository(t)
+	src := makeTempDir(t)
+	defer os.RemoveAll(src)
+	for _, dir := range []string{"empty", "readonly"} {
+		if err := os.Mkdir(filepath.Join(src, dir), 0750); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeTempFile(t, src, "readonly/file", "foo")
+
+	defer chdir(t, src)()
+	if _, err := repo.Backup(context.Background(), []string{"."}, BackupOptions{ChunkBytes: 4096}); err != nil {
+		t.Fatal(err)
+	}
+	// Directories' entries are updated by later backups.
+	if err := os.Chmod("readonly", 0500); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(filepath.Join(src, "readonly"), 0700)
+	if _, err := repo.Backup(context.Background(), []string{"."}, BackupOptions{ChunkBytes: 4096}); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := repo.List(context.Background(), ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]os.FileMode{"empty/": os.ModeDir | 0750, "readonly/": os.ModeDir | 0500} {
+		if e, ok := entries[path]; !ok || e.Mode != want {
+			t.Errorf("%v: want mode %v got %v (present: %v)", path, want, e.Mode, ok)
+		}
+	}
+
+	dst := makeTempDir(t)
+	defer os.RemoveAll(dst)
+	defer os.Chmod(filepath.Join(dst, "readonly"), 0700)
+	defer chdir(t, dst)()
+	if _, err := repo.Restore(context.Background(), []string{"."}, RestoreOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]os.FileMode{"empty": os.ModeDir | 0750, "readonly": os.ModeDir | 0500} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode() != want {
+			t.Errorf("%v: want mode %v got %v", path, want, fi.Mode())
+		}
+	}
+	if got, err := ioutil.ReadFile("readonly/file"); err != nil || string(got) != "foo" {
+		t.Errorf("readonly/file: want %q got %q, %v", "foo", got, err)
+	}
+}
+
+func TestRepositoryRestoreOverReadOnlyDirectories(t *testing.T) {
+	// Root can write to read-only directories anyway.
+	if os.Geteuid() == 0 {
+		t.Skip("can't test permissions as root")
+	}
+	repo := makeRepository(t)
+	src := makeTempDir(t)
+	defer os.RemoveAll(src)
+	if err := os.MkdirAll(filepath.Join(src, "readonly", "sub"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	writeTempFile(t, src, "readonly/file", "foo")
+	writeTempFile(t, src, "readonly/sub/file", "bar")
+	for _, dir := range []string{"readonly/sub", "readonly"} {
+		if err := os.Chmod(filepath.Join(src, dir), 0555); err != nil {
+			t.Fatal(err)
+		}
+		defer os.Chmod(filepath.Join(src, dir), 0700)
+	}
+
+	defer chdir(t, src)()
+	if _, err := repo.Backup(context.Background(), []string{"."}, BackupOptions{ChunkBytes: 4096}); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := makeTempDir(t)
+	defer os.RemoveAll(dst)
+	defer os.Chmod(filepath.Join(dst, "readonly", "sub"), 0700)
+	defer os.Chmod(filepath.Join(dst, "readonly"), 0700)
+	defer chdir(t, dst)()
+	for i := 0; i < 2; i++ {
+		if _, err := repo.Restore(context.Background(), []string{"."}, RestoreOptions{}); err != nil {
+			t.Fatalf("restore %d: %v", i+1, err)
+		}
+		for _, dir := range []string{"readonly", "readonly/sub"} {
+			fi, err := os.Stat(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Mode() != os.ModeDir|0555 {
+				t.Errorf("restore %d: %v: want mode %v got %v", i+1, dir, os.ModeDir|0555, fi.Mode())
+			}
+		}
+		for path, want := range map[string]string{"readonly/file": "foo", "readonly/sub/file": "bar"} {
+			if got, err := ioutil.ReadFile(path); err != nil || string(got) != want {
+				t.Errorf("restore %d: %v: want %q got %q, %v", i+1, path, want, got, err)
+			}
+		}
+	}
+}
+
+func TestRepositorySetLookup(t *testing.T) {
+	repo := makeRepository(t)
+	repo.SetLookup(&fscache.Database{
+		Users:  map[string]uint32{"fakeuser": uint32(os.Getuid())},
+		Groups: map[string]uint32{"fakegroup": uint32(os.Getgid())},
+	})
+	src := makeTempDir(t)
+	defer os.RemoveAll(src)
+	writeTempFile(t, src, "file", "foo")
+
+	defer chdir(t, src)()
+	if _, err := repo.Backup(context.Background(), []string{"file"}, BackupOptions{ChunkBytes: 4096}); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := repo.List(context.Background(), "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := entries["file"]; e.User != "fakeuser" || e.Group != "fakegroup" {
+		t.Errorf("want owner fakeuser:fakegroup got %v:%v", e.User, e.Group)
+	}
+}
+
+func TestRepositoryBackupPartial(t *testing.T) {
+	repo := makeRepository(t)
+	src := makeTempDir(t)
+	defer os.RemoveAll(src)
+	writeTempFile(t, src, "file", "foo")
+	if err := os.Symlink("nonexistent", filepath.Join(src, "dangling")); err != nil {
+		t.Fatal(err)
+	}
+
+	defer chdir(t, src)()
+	_, err := repo.Backup(context.Background(), []string{"."}, BackupOptions{ChunkBytes: 4096})
+	partial, ok := err.(*PartialError)
+	if !ok {
+		t.Fatalf("want *PartialError got %v", err)
+	}
+	if len(partial.Skipped) != 1 || partial.Skipped[0].Path != "dangling" {
+		t.Errorf("skipped: want [dangling] got %v", partial.Skipped)
+	}
+
+	entries, err := repo.List(context.Background(), "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := entries["file"]; !ok {
+		t.Errorf("want file to have been stored despite skipped files, got %v", entries)
+	}
+}
+
+func TestRepositoryBackupCancelled(t *testing.T) {
+	repo := makeRepository(t)
+	src := makeTempDir(t)
+	defer os.RemoveAll(src)
+	writeTempFile(t, src, "file", "foo")
+
+	defer chdir(t, src)()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := repo.Backup(ctx, []string{"."}, BackupOptions{ChunkBytes: 4096})
+	if err == nil {
+		t.Errorf("want error got nil")
+	}
+	if _, ok := err.(*PartialError); ok {
+		t.Errorf("want cancellation error got %v", err)
+	}
+}
+
+func TestRepositoryBackupSkipsExisting(t *testing.T) {
+	repo := makeRepository(t)
+	src := makeTempDir(t)
+	defer os.RemoveAll(src)
+	writeTempFile(t, src, "file", "foo")
+	writeTempFile(t, src, "other", "bar")
+
+	defer chdir(t, src)()
+	opts := BackupOptions{ChunkBytes: 4096, Reupload: true, SkipExisting: true}
+	if _, err := repo.Backup(context.Background(), []string{"."}, opts); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := repo.Backup(context.Background(), []string{"."}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (BackupStats{ChunksAlreadyStored: 2, BytesAlreadyStored: 2 * 4096}); stats.ChunksAlreadyStored != want.ChunksAlreadyStored || stats.BytesAlreadyStored != want.BytesAlreadyStored {
+		t.Errorf("stats: want %+v already stored got %+v", want, stats)
+	}
+
+	opts.SkipExisting = false
+	if stats, err = repo.Backup(context.Background(), []string{"."}, opts); err != nil {
+		t.Fatal(err)
+	}
+	if stats.ChunksAlreadyStored != 0 {
+		t.Errorf("stats: want nothing skipped without SkipExisting got %+v", stats)
+	}
+}
+
+// racingChunkStore calls beforeMeta, once, just before the "meta" pointer is first conditionally saved, to simulate a concurrent backup.
+type racingChunkStore struct {
+	chunkstore.ChunkStore
+	beforeMeta func()
+}
+
+func (s *racingChunkStore) SaveIfVersion(ctx context.Context, name string, contents []byte, version int64) error {
+	if name == "meta" && s.beforeMeta != nil {
+		beforeMeta := s.beforeMeta
+		s.beforeMeta = nil
+		beforeMeta()
+	}
+	return s.ChunkStore.SaveIfVersion(ctx, name, contents, version)
+}
+
+func TestRepositoryConcurrentBackupsMerge(t *testing.T) {
+	aesKey, hmacKey := bytes.Repeat([]byte{0x02}, 32), bytes.Repeat([]byte{0x03}, 32)
+	underlying := &memory.ChunkStore{}
+	racing := &racingChunkStore{ChunkStore: underlying}
+	repo, err := NewRepository(aesKey, hmacKey, racing, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewRepository(aesKey, hmacKey, underlying, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src := makeTempDir(t)
+	defer os.RemoveAll(src)
+	writeTempFile(t, src, "mine", "foo")
+	writeTempFile(t, src, "theirs", "bar")
+	defer chdir(t, src)()
+
+	opts := BackupOptions{ChunkBytes: 4096}
+	racing.beforeMeta = func() {
+		if _, err := other.Backup(context.Background(), []string{"theirs"}, opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := repo.Backup(context.Background(), []string{"mine"}, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := repo.List(context.Background(), ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"mine", "theirs"} {
+		if _, ok := entries[name]; !ok {
+			t.Errorf("want entry for %v got %v", name, entries)
+		}
+	}
+	history, err := repo.History(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 {
+		t.Errorf("history: want 2 roots got %v", history)
+	}
+}
+
+func TestDedupingChunkStore(t *testing.T) {
+	underlying := &recordingChunkStore{}
+	existing := "500002b7d895d882170ea0823388708be81ca5f5f64f2c358e6cb7ee7ca16e37"
+	missing := "bfda79581f572a70cd481efb63ef6f07e52f3e45afb21ca35a452a3e49e77e4b"
+	ctx := context.Background()
+	if err := underlying.Save(ctx, existing, []byte("existing")); err != nil {
+		t.Fatal(err)
+	}
+	if err := underlying.Save(ctx, "meta", []byte("old meta")); err != nil {
+		t.Fatal(err)
+	}
+	underlying.Reset()
+
+	d, err := newDedupingChunkStore(ctx, underlying, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{existing, missing, missing, "meta"} {
+		if err := d.Save(ctx, name, []byte("new")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := map[string][]byte{
+		missing: []byte("new"),
+		"meta":  []byte("new"),
+	}
+	if !reflect.DeepEqual(want, underlying.saves) {
+		t.Errorf("saves: want %q got %q", want, underlying.saves)
+	}
+	if want := (BackupStats{ChunksUploaded: 1, BytesUploaded: 3, ChunksAlreadyStored: 2, BytesAlreadyStored: 6}); d.Stats() != want {
+		t.Errorf("stats: want %+v got %+v", want, d.Stats())
+	}
+}
+
+func TestRepositoryBackupObfuscated(t *testing.T) {
+	repo := makeRepository(t)
+	src := makeTempDir(t)
+	defer os.RemoveAll(src)
+	writeTempFile(t, src, "file", "foo")
+	writeTempFile(t, src, "other", "bar")
+
+	defer chdir(t, src)()
+	opts := BackupOptions{ChunkBytes: 4096, Obfuscate: &ObfuscateOptions{BatchChunks: 2, DecoyRate: 1}}
+	if _, err := repo.Backup(context.Background(), []string{"."}, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	tempDir := makeTempDir(t)
+	defer os.RemoveAll(tempDir)
+	db, _, _, err := repo.openDB(context.Background(), tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoys, err := db.Decoys()
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// One decoy for each of the chunks of the two files.
+	if want := 2; len(decoys) != want {
+		t.Errorf("decoys: want %v got %v", want, decoys)
+	}
+	for _, decoy := range decoys {
+		info, err := repo.chunkStore.Stat(context.Background(), decoy)
+		if err != nil {
+			t.Errorf("decoy %v: %v", decoy, err)
+		} else if info.Size != 4096 {
+			t.Errorf("decoy %v: want size 4096 got %v", decoy, info.Size)
+		}
+	}
+
+	dst := makeTempDir(t)
+	defer os.RemoveAll(dst)
+	defer chdir(t, dst)()
+	if _, err := repo.Restore(context.Background(), []string{"."}, RestoreOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "foo"; string(got) != want {
+		t.Errorf("file: want %q got %q", want, got)
+	}
+}
+
+func TestObfuscatingChunkStore(t *testing.T) {
+	underlying := &recordingChunkStore{}
+	underlying.Reset()
+	var decoys []string
+	o, err := newObfuscatingChunkStore(underlying, ObfuscateOptions{BatchChunks: 3, DecoyRate: 1}, func(name string) error {
+		decoys = append(decoys, name)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	names := []string{
+		"500002b7d895d882170ea0823388708be81ca5f5f64f2c358e6cb7ee7ca16e37",
+		"50ffc1e2bf0dbdd8d27b4a8d33d0bd0b0e08b43e7c43ad12b3bcd2c2e1bb6b0e",
+		"bfda79581f572a70cd481efb63ef6f07e52f3e45afb21ca35a452a3e49e77e4b",
+		"cd6ebe78f3a66a4db47e8c8a704970b341192f8d9f4035ee9c63455f9915c644",
+	}
+	for i, name := range names[:2] {
+		if err := o.Save(ctx, name, []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(underlying.saves) != 0 {
+		t.Errorf("want nothing saved before a batch is full, got %v", underlying.saves)
+	}
+	if err := o.Save(ctx, names[2], []byte{2}); err != nil {
+		t.Fatal(err)
+	}
+	if want := 6; len(underlying.saves) != want || len(decoys) != 3 {
+		t.Errorf("want %v saves including 3 decoys, got saves %v decoys %v", want, underlying.saves, decoys)
+	}
+
+	o.stopDecoys()
+	if err := o.Save(ctx, names[3], []byte{3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Save(ctx, "meta", []byte("meta")); err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range append(names, "meta") {
+		if _, ok := underlying.saves[name]; !ok {
+			t.Errorf("want chunk %v saved", i)
+		}
+	}
+	if want := 8; len(underlying.saves) != want {
+		t.Errorf("want %v saves with no more decoys, got %v", want, underlying.saves)
+	}
+	for _, decoy := range decoys {
+		if got := len(underlying.saves[decoy]); got != 1 {
+			t.Errorf("decoy %v: want the size of a real chunk got %v", decoy, got)
+		}
+	}
+}
+
+func TestObfuscatingChunkStoreFailureIsSticky(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	o, err := newObfuscatingChunkStore(&recordingChunkStore{}, ObfuscateOptions{BatchChunks: 1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if err := o.Save(ctx, "500002b7d895d882170ea0823388708be81ca5f5f64f2c358e6cb7ee7ca16e37", []byte{0}); err == nil {
+		t.Fatal("want error got nil")
+	}
+	if err := o.flush(context.Background()); err == nil {
+		t.Error("flush: want earlier error got nil")
+	}
+	if err := o.Save(context.Background(), "meta", nil); err == nil {
+		t.Error("save: want earlier error got nil")
+	}
+}
+
+func TestNewRepositoryBadKeys(t *testing.T) {
+	if _, err := NewRepository([]byte{0x00}, bytes.Repeat([]byte{0x03}, 32), &recordingChunkStore{}, ""); err != ErrBadKeys {
+		t.Errorf("want ErrBadKeys got %v", err)
+	}
+}
+
+func TestRepositorySetMetadataCache(t *testing.T) {
+	chunkStore := &readRecordingChunkStore{}
+	repo, err := NewRepository(bytes.Repeat([]byte{0x02}, 32), bytes.Repeat([]byte{0x03}, 32), chunkStore, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacheDir := makeTempDir(t)
+	defer os.RemoveAll(cacheDir)
+	repo.SetMetadataCache(filepath.Join(cacheDir, "meta"))
+	src := makeTempDir(t)
+	defer os.RemoveAll(src)
+	writeTempFile(t, src, "file", "foo")
+
+	defer chdir(t, src)()
+	if _, err := repo.Backup(context.Background(), []string{"."}, BackupOptions{ChunkBytes: 4096}); err != nil {
+		t.Fatal(err)
+	}
+	chunkStore.reads = nil
+	entries, err := repo.List(context.Background(), ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := entries["file"]; !ok {
+		t.Errorf("want file got %v", entries)
+	}
+	if len(chunkStore.reads) != 0 {
+		t.Errorf("want metadata to be read from the cache got reads of %v", chunkStore.reads)
+	}
+}
+
+func makeRepository(t *testing.T) *Repository {
+	repo, err := NewRepository(bytes.Repeat([]byte{0x02}, 32), bytes.Repeat([]byte{0x03}, 32), &recordingChunkStore{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return repo
+}
+
+// chdir changes the working directory, as Backup and Restore operate relative to it. The returned function changes it back.
+func chdir(t *testing.T, dir string) func() {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	return func() { os.Chdir(wd) }
+}
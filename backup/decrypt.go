@@ -0,0 +1,155 @@
+package backup
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/illicitonion/cloudbackup/chunkstore"
+	"github.com/illicitonion/cloudbackup/crypto"
+	"github.com/illicitonion/cloudbackup/meta"
+)
+
+func decryptFile(ctx context.Context, aesKey, hmacKey []byte, chunkStore chunkstore.ChunkStore, e *meta.Entry, owners *ownership, tempDir, file string, progress *progressTracker) error {
+	outFile, err := ioutil.TempFile(tempDir, filepath.Base(file))
+	if err != nil {
+		return fmt.Errorf("error making temporary file for writing: %v", err)
+	}
+	defer outFile.Close()
+
+	if err := decryptChunks(ctx, aesKey, hmacKey, &progressWriter{outFile, progress}, chunkStore, e); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(outFile.Name(), e.Mode); err != nil {
+		return fmt.Errorf("error chmoding file %v to %v: %v", outFile.Name(), strconv.FormatUint(uint64(e.Mode), 8), err)
+	}
+	owners.chown(file, outFile.Name(), e)
+	if err := os.Rename(outFile.Name(), file); err != nil {
+		return fmt.Errorf("error renaming temporary file %v to output file %v: %v", outFile.Name(), file, err)
+	}
+	return nil
+}
+
+type restoredDir struct {
+	path  string
+	entry meta.Entry
+}
+
+// makeOwnerWritable gives the owner of the existing directory at path read, write and search permission, if it lacks any of them,
+// so that its contents can be restored.
+func makeOwnerWritable(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("error stating dir %v: %v", path, err)
+	}
+	mode := fi.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	if mode&0700 == 0700 {
+		return nil
+	}
+	if err := os.Chmod(path, mode|0700); err != nil {
+		return fmt.Errorf("error making dir %v writable: %v", path, err)
+	}
+	return nil
+}
+
+// restoreDirMetadata applies e's permissions and owner to the directory at path.
+func restoreDirMetadata(path string, e *meta.Entry, owners *ownership) error {
+	if err := os.Chmod(path, e.Mode); err != nil {
+		return fmt.Errorf("error chmoding dir %v to %v: %v", path, strconv.FormatUint(uint64(e.Mode.Perm()), 8), err)
+	}
+	owners.chown(path, path, e)
+	return nil
+}
+
+func decryptChunks(ctx context.Context, aesKey, hmacKey []byte, dst io.Writer, chunkStore chunkstore.ChunkStore, e *meta.Entry) error {
+	var accumulatedLength int64
+
+	for _, chunk := range e.Chunks {
+		// Any chunks after the end of the file are padding, so needn't be fetched.
+		if accumulatedLength >= e.Bytes {
+			break
+		}
+		plaintextChunk, err := decryptChunk(ctx, aesKey, hmacKey, chunkStore, chunk)
+		if err != nil {
+			return err
+		}
+		if accumulatedLength+int64(len(plaintextChunk)) > e.Bytes {
+			plaintextChunk = plaintextChunk[:int(e.Bytes-accumulatedLength)]
+		}
+		accumulatedLength += int64(len(plaintextChunk))
+		if _, err := dst.Write(plaintextChunk); err != nil {
+			return fmt.Errorf("error writing decrypted file: %v", err)
+		}
+	}
+	return nil
+}
+
+// decryptChunkRange writes at most length bytes of e, starting at offset, to dst. A negative length means until the end of the file.
+// Only the chunks covering the range are fetched.
+func decryptChunkRange(ctx context.Context, aesKey, hmacKey []byte, dst io.Writer, chunkStore chunkstore.ChunkStore, e *meta.Entry, offset, length int64) error {
+	end := e.Bytes
+	if length >= 0 && offset+length < end {
+		end = offset + length
+	}
+	if offset >= end {
+		return nil
+	}
+	if len(e.Chunks) == 0 {
+		return fmt.Errorf("entry of %d bytes has no chunks", e.Bytes)
+	}
+
+	// Every chunk of a file is padded to the same size, and ciphertexts are the same size as their plaintexts.
+	info, err := chunkStore.Stat(ctx, hex.EncodeToString(e.Chunks[0].CiphertextMAC))
+	if err != nil {
+		return fmt.Errorf("error statting encrypted chunk: %v", err)
+	}
+	chunkSize := info.Size
+	if chunkSize <= 0 {
+		return fmt.Errorf("encrypted chunk %x is empty", e.Chunks[0].CiphertextMAC)
+	}
+
+	for i := offset / chunkSize; i*chunkSize < end; i++ {
+		if i >= int64(len(e.Chunks)) {
+			return fmt.Errorf("entry of %d bytes has only %d chunks of %d bytes", e.Bytes, len(e.Chunks), chunkSize)
+		}
+		plaintextChunk, err := decryptChunk(ctx, aesKey, hmacKey, chunkStore, e.Chunks[i])
+		if err != nil {
+			return err
+		}
+		chunkStart := i * chunkSize
+		from := int64(0)
+		if offset > chunkStart {
+			from = offset - chunkStart
+		}
+		to := chunkSize
+		if end < chunkStart+chunkSize {
+			to = end - chunkStart
+		}
+		if to > int64(len(plaintextChunk)) {
+			return fmt.Errorf("chunk %d is %d bytes, but the first chunk is %d", i, len(plaintextChunk), chunkSize)
+		}
+		if _, err := dst.Write(plaintextChunk[from:to]); err != nil {
+			return fmt.Errorf("error writing decrypted file: %v", err)
+		}
+	}
+	return nil
+}
+
+func decryptChunk(ctx context.Context, aesKey, hmacKey []byte, chunkStore chunkstore.ChunkStore, chunk meta.Chunk) ([]byte, error) {
+	ciphertext, err := chunkStore.Read(ctx, hex.EncodeToString(chunk.CiphertextMAC))
+	if err != nil {
+		return nil, fmt.Errorf("error reading encrypted chunk: %v", err)
+	}
+
+	plaintextChunk, err := crypto.Decrypt(aesKey, hmacKey, chunk.IV, ciphertext, chunk.CiphertextMAC)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting chunk %s (length: %v) with IV %s got error %v", chunk.CiphertextMAC, len(ciphertext), chunk.IV, err)
+	}
+	return plaintextChunk, nil
+}
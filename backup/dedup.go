@@ -0,0 +1,89 @@
+package backup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+
+	"github.com/illicitonion/cloudbackup/chunkstore"
+)
+
+// dedupingChunkStore counts the chunks saved to it and, if skipExisting is true, skips saving chunks which already exist,
+// according to a listing of the underlying store taken when it was made.
+// Only chunks named by an HMAC are skipped; other names, such as "meta", are always saved.
+type dedupingChunkStore struct {
+	chunkstore.ChunkStore
+	skipExisting bool
+
+	mu       sync.Mutex
+	existing map[[sha256.Size]byte]bool
+	stats    BackupStats
+}
+
+func newDedupingChunkStore(ctx context.Context, s chunkstore.ChunkStore, skipExisting bool) (*dedupingChunkStore, error) {
+	d := &dedupingChunkStore{
+		ChunkStore:   s,
+		skipExisting: skipExisting,
+		existing:     make(map[[sha256.Size]byte]bool),
+	}
+	if !skipExisting {
+		return d, nil
+	}
+	if err := s.List(ctx, "", func(name string) error {
+		if key, ok := chunkKey(name); ok {
+			d.existing[key] = true
+		}
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("error listing chunk store: %v", err)
+	}
+	return d, nil
+}
+
+func (d *dedupingChunkStore) Save(ctx context.Context, name string, contents []byte) error {
+	key, isChunk := chunkKey(name)
+	if isChunk && d.skipExisting {
+		d.mu.Lock()
+		exists := d.existing[key]
+		if exists {
+			d.stats.ChunksAlreadyStored++
+			d.stats.BytesAlreadyStored += int64(len(contents))
+		}
+		d.mu.Unlock()
+		if exists {
+			return nil
+		}
+	}
+
+	if err := d.ChunkStore.Save(ctx, name, contents); err != nil {
+		return err
+	}
+
+	if isChunk {
+		d.mu.Lock()
+		d.existing[key] = true
+		d.stats.ChunksUploaded++
+		d.stats.BytesUploaded += int64(len(contents))
+		d.mu.Unlock()
+	}
+	return nil
+}
+
+func (d *dedupingChunkStore) Stats() BackupStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.stats
+}
+
+// chunkKey returns the binary HMAC which name is the hex encoding of, if it is one.
+func chunkKey(name string) (key [sha256.Size]byte, ok bool) {
+	if hex.DecodedLen(len(name)) != len(key) {
+		return key, false
+	}
+	if _, err := hex.Decode(key[:], []byte(name)); err != nil {
+		return key, false
+	}
+	return key, true
+}
@@ -0,0 +1,279 @@
+package backup
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+
+	"github.com/illicitonion/cloudbackup/chunkstore"
+	"github.com/illicitonion/cloudbackup/crypto"
+	"github.com/illicitonion/cloudbackup/files"
+	"github.com/illicitonion/cloudbackup/fscache"
+	"github.com/illicitonion/cloudbackup/meta"
+)
+
+func encryptFileAndStoreMetadata(ctx context.Context, aesKey, hmacKey []byte, chunkStore chunkstore.ChunkStore, chunkBytes int, db *meta.DB, cache *fscache.Cache, file string, fi os.FileInfo, uploadIfUnchanged bool, padTo func(int) int, progress *progressTracker) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("error opening file for encryption: %v", err)
+	}
+	defer f.Close()
+
+	old := getKnownEntry(file, db)
+	chunks, err := encryptFile(ctx, aesKey, hmacKey, makeIV, db, chunkStore, chunkBytes, file, f, fi.Size(), uploadIfUnchanged, padTo, progress)
+	if err != nil {
+		return err
+	}
+
+	entry, err := makeEntry(cache, fi, chunks)
+	if err != nil {
+		return fmt.Errorf("error making entry for %q: %v", file, err)
+	}
+	newBuckets, err := db.Put(file, entry)
+	if err != nil {
+		return fmt.Errorf("error putting %q in database: %v", file, err)
+	}
+	progress.fileStored(old, entry)
+	return storeNewDirsMetadata(db, cache, newBuckets, "")
+}
+
+// storeDirMetadata records the current metadata of the directory dir, replacing any already recorded.
+func storeDirMetadata(db *meta.DB, cache *fscache.Cache, dir string, fi os.FileInfo) error {
+	entry, err := makeEntry(cache, fi, nil)
+	if err != nil {
+		return fmt.Errorf("error making entry for dir %q: %v", dir, err)
+	}
+	newBuckets, err := db.Put(dir+"/.", entry)
+	if err != nil {
+		return fmt.Errorf("error putting dir %q in database: %v", dir, err)
+	}
+	return storeNewDirsMetadata(db, cache, newBuckets, dir)
+}
+
+// storeNewDirsMetadata records the metadata of each of the directories newBuckets, which Put just created, other than except.
+// These are the directories containing a path being backed up, which the walk doesn't visit.
+func storeNewDirsMetadata(db *meta.DB, cache *fscache.Cache, newBuckets []string, except string) error {
+	for _, newBucket := range newBuckets {
+		if newBucket == except {
+			continue
+		}
+		dirFI, err := os.Stat(newBucket)
+		if err != nil {
+			return fmt.Errorf("error stating dir %q: %v", newBucket, err)
+		}
+		if err := storeDirMetadata(db, cache, newBucket, dirFI); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encryptStreamAndStoreMetadata encrypts r, which may be of unknown length, storing it as if it were a file named name owned by the current user.
+func encryptStreamAndStoreMetadata(ctx context.Context, aesKey, hmacKey []byte, chunkStore chunkstore.ChunkStore, chunkBytes int, db *meta.DB, cache *fscache.Cache, name string, r io.Reader, uploadIfUnchanged bool, padTo func(int) int, progress *progressTracker) error {
+	counter := &countingReader{r: r}
+	old := getKnownEntry(name, db)
+	chunks, err := encryptFile(ctx, aesKey, hmacKey, makeIV, db, chunkStore, chunkBytes, name, counter, -1, uploadIfUnchanged, padTo, progress)
+	if err != nil {
+		return err
+	}
+
+	entry := ownedEntry(cache, uint32(os.Getuid()), uint32(os.Getgid()))
+	entry.Bytes = counter.n
+	entry.Chunks = chunks
+	entry.Mode = 0600
+	newBuckets, err := db.Put(name, entry)
+	if err != nil {
+		return fmt.Errorf("error putting %q in database: %v", name, err)
+	}
+	progress.fileStored(old, entry)
+	for _, newBucket := range newBuckets {
+		dirEntry := ownedEntry(cache, uint32(os.Getuid()), uint32(os.Getgid()))
+		dirEntry.Mode = os.ModeDir | 0700
+		if _, err := db.Put(newBucket+"/.", dirEntry); err != nil {
+			return fmt.Errorf("error putting dir %q in database: %v", newBucket, err)
+		}
+	}
+	return nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func makeEntry(cache *fscache.Cache, fi os.FileInfo, chunks []meta.Chunk) (*meta.Entry, error) {
+	st := fi.Sys().(*syscall.Stat_t)
+	entry := ownedEntry(cache, st.Uid, st.Gid)
+	if !fi.IsDir() {
+		entry.Bytes = fi.Size()
+	}
+	entry.Chunks = chunks
+	entry.Mode = fi.Mode()
+	return entry, nil
+}
+
+// ownedEntry returns an Entry owned by uid and gid. IDs without names (e.g. in containers without passwd entries) are recorded by ID alone.
+func ownedEntry(cache *fscache.Cache, uid, gid uint32) *meta.Entry {
+	owningUser, _ := cache.LookupUID(uid)
+	owningGroup, _ := cache.LookupGID(gid)
+	return &meta.Entry{
+		User:   owningUser,
+		Group:  owningGroup,
+		UID:    uid,
+		GID:    gid,
+		HasIDs: true,
+	}
+}
+
+type ivFunc func() ([]byte, error)
+
+func makeIV() (iv []byte, err error) {
+	iv = make([]byte, aes.BlockSize)
+	if _, err = rand.Read(iv); err != nil {
+		return nil, err
+	}
+	return iv, nil
+}
+
+// encryptFile encrypts and saves f in chunks. If db already knows about chunks for name which haven't changed, they are reused rather than being saved again,
+// unless uploadIfUnchanged is true, in which case they are saved again under the same name. db may be nil.
+//
+// The bytes read, and chunks uploaded and reused, are counted in progress, which may be nil.
+//
+// If padTo is non-nil, and f is not empty, dummy chunks are added until there are padTo(number of chunks) of them.
+// As they come after the end of the file, they are ignored on decryption.
+func encryptFile(ctx context.Context, aesKey, hmacKey []byte, makeIV ivFunc, db *meta.DB, chunkStore chunkstore.ChunkStore, chunkBytes int, name string, f io.Reader, fileSize int64, uploadIfUnchanged bool, padTo func(int) int, progress *progressTracker) ([]meta.Chunk, error) {
+	nextChunk := files.ReadChunks(name, f, chunkBytes, fileSize)
+
+	var chunks []meta.Chunk
+
+	oldChunks := getKnownChunks(name, db)
+
+	for i := 0; true; i++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		plaintext, _, err := nextChunk()
+		if err != nil {
+			return nil, fmt.Errorf("reading file for encryption: %v", err)
+		}
+		if plaintext == nil {
+			break
+		}
+		progress.addBytes(len(plaintext))
+
+		if i < len(oldChunks) {
+			iv := oldChunks[i].IV
+			ciphertext, ciphertextMAC, err := crypto.Encrypt(aesKey, hmacKey, iv, plaintext, chunkBytes)
+			if err == nil && hmac.Equal(ciphertextMAC, oldChunks[i].CiphertextMAC) {
+				if uploadIfUnchanged {
+					if err := chunkStore.Save(ctx, hex.EncodeToString(ciphertextMAC), ciphertext); err != nil {
+						return nil, fmt.Errorf("saving encrypted file: %v", err)
+					}
+				}
+				chunks = append(chunks, oldChunks[i])
+				progress.chunkReused()
+				continue
+			}
+		}
+
+		iv, err := makeIV()
+		if err != nil {
+			return nil, fmt.Errorf("making IV: %v", err)
+		}
+
+		ciphertext, ciphertextMAC, err := crypto.Encrypt(aesKey, hmacKey, iv, plaintext, chunkBytes)
+		if err != nil {
+			return nil, fmt.Errorf("encrypting file: %v", err)
+		}
+		ciphertextMACString := hex.EncodeToString(ciphertextMAC)
+
+		if err := chunkStore.Save(ctx, ciphertextMACString, ciphertext); err != nil {
+			return nil, fmt.Errorf("saving encrypted file: %v", err)
+		}
+
+		chunks = append(chunks, meta.Chunk{IV: iv, CiphertextMAC: ciphertextMAC})
+		progress.chunkUploaded()
+	}
+
+	if padTo != nil && len(chunks) > 0 {
+		want := padTo(len(chunks))
+		for i := len(chunks); i < want; i++ {
+			// Any chunk which is already stored will do as a dummy, so reuse old ones rather than uploading new ones every time.
+			if i < len(oldChunks) {
+				chunks = append(chunks, oldChunks[i])
+				continue
+			}
+			chunk, err := saveDummyChunk(ctx, aesKey, hmacKey, makeIV, chunkStore, chunkBytes)
+			if err != nil {
+				return nil, err
+			}
+			chunks = append(chunks, chunk)
+		}
+	}
+	return chunks, nil
+}
+
+// saveDummyChunk encrypts and saves a chunk of zeros. As its IV is random, it is indistinguishable from any other chunk.
+func saveDummyChunk(ctx context.Context, aesKey, hmacKey []byte, makeIV ivFunc, chunkStore chunkstore.ChunkStore, chunkBytes int) (meta.Chunk, error) {
+	iv, err := makeIV()
+	if err != nil {
+		return meta.Chunk{}, fmt.Errorf("making IV: %v", err)
+	}
+	ciphertext, ciphertextMAC, err := crypto.Encrypt(aesKey, hmacKey, iv, nil, chunkBytes)
+	if err != nil {
+		return meta.Chunk{}, fmt.Errorf("encrypting dummy chunk: %v", err)
+	}
+	if err := chunkStore.Save(ctx, hex.EncodeToString(ciphertextMAC), ciphertext); err != nil {
+		return meta.Chunk{}, fmt.Errorf("saving dummy chunk: %v", err)
+	}
+	return meta.Chunk{IV: iv, CiphertextMAC: ciphertextMAC}, nil
+}
+
+// paddedChunkCount returns the next multiple of quantum which is at least n, or, if quantum is not positive, the next power of two.
+func paddedChunkCount(n, quantum int) int {
+	if quantum > 0 {
+		return (n + quantum - 1) / quantum * quantum
+	}
+	padded := 1
+	for padded < n {
+		padded *= 2
+	}
+	return padded
+}
+
+// getKnownChunks returns the chunks already recorded for the file at the path name (not just its base name), or nil if there are none.
+func getKnownChunks(name string, db *meta.DB) []meta.Chunk {
+	if entry := getKnownEntry(name, db); entry != nil {
+		return entry.Chunks
+	}
+	return nil
+}
+
+// getKnownEntry returns the entry already recorded for the file name, or nil if there isn't one.
+func getKnownEntry(name string, db *meta.DB) *meta.Entry {
+	if db == nil {
+		return nil
+	}
+	entries, err := db.Get(name)
+	if err != nil {
+		return nil
+	}
+	entry, ok := entries[name]
+	if !ok || entry.Mode.IsDir() {
+		return nil
+	}
+	return &entry
+}
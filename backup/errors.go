@@ -0,0 +1,39 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrBadKeys is returned by NewRepository if the Encryption or Authentication key is not 256 bits.
+	ErrBadKeys = errors.New("backup: bad keys: want each to be 256 bits")
+
+	// ErrNotFile is returned by Cat if the requested path is a directory.
+	ErrNotFile = errors.New("backup: not a file")
+)
+
+// PartialError is returned by Backup and BackupStream when some files could not be backed up.
+// Everything else was backed up, and its metadata stored, as normal.
+type PartialError struct {
+	Skipped []SkippedFile
+}
+
+func (e *PartialError) Error() string {
+	return fmt.Sprintf("backup: skipped %d files which could not be encrypted", len(e.Skipped))
+}
+
+// ConflictError is returned by Merge when using MergeFail if entries differ between the databases being merged.
+// Nothing is merged.
+type ConflictError struct {
+	Paths []string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("backup: %d entries conflict, e.g. %v", len(e.Paths), e.Paths[0])
+}
+
+type SkippedFile struct {
+	Path string
+	Err  error
+}
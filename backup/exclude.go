@@ -0,0 +1,87 @@
+package backup
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// cacheDirTagSignature is the header a CACHEDIR.TAG file must start with, as per http://www.brynosaurus.com/cachedir/
+var cacheDirTagSignature = []byte("Signature: 8a477f597d28d172789f06886806bc55")
+
+type excluder struct {
+	names         map[string]bool
+	maxFileSize   int64
+	newerThan     time.Time
+	olderThan     time.Time
+	excludeCaches bool
+
+	oneFileSystem bool
+	rootDev       uint64
+}
+
+func newExcluder(opts BackupOptions, rootDev uint64) *excluder {
+	e := &excluder{
+		names:         make(map[string]bool),
+		maxFileSize:   opts.MaxFileSize,
+		newerThan:     opts.NewerThan,
+		olderThan:     opts.OlderThan,
+		excludeCaches: opts.ExcludeCaches,
+		oneFileSystem: opts.OneFileSystem,
+		rootDev:       rootDev,
+	}
+	for _, n := range opts.ExcludeNames {
+		e.names[n] = true
+	}
+	return e
+}
+
+// exclude returns whether file should be skipped when walking. If file is a directory and is excluded, none of its contents should be walked.
+func (e *excluder) exclude(file string, fi os.FileInfo) (bool, error) {
+	if e.names[fi.Name()] {
+		return true, nil
+	}
+	if e.oneFileSystem && device(fi) != e.rootDev {
+		return true, nil
+	}
+	if fi.IsDir() {
+		if e.excludeCaches {
+			return hasCacheDirTag(file)
+		}
+		return false, nil
+	}
+	if e.maxFileSize > 0 && fi.Size() > e.maxFileSize {
+		return true, nil
+	}
+	if !e.newerThan.IsZero() && !fi.ModTime().After(e.newerThan) {
+		return true, nil
+	}
+	if !e.olderThan.IsZero() && !fi.ModTime().Before(e.olderThan) {
+		return true, nil
+	}
+	return false, nil
+}
+
+func device(fi os.FileInfo) uint64 {
+	return uint64(fi.Sys().(*syscall.Stat_t).Dev)
+}
+
+func hasCacheDirTag(dir string) (bool, error) {
+	f, err := os.Open(filepath.Join(dir, "CACHEDIR.TAG"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("error opening CACHEDIR.TAG in %v: %v", dir, err)
+	}
+	defer f.Close()
+	header := make([]byte, len(cacheDirTagSignature))
+	if _, err := io.ReadFull(f, header); err != nil {
+		return false, nil
+	}
+	return bytes.Equal(header, cacheDirTagSignature), nil
+}
@@ -0,0 +1,111 @@
+package backup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExcludeNames(t *testing.T) {
+	dir := makeTempDir(t)
+	defer os.RemoveAll(dir)
+	writeTempFile(t, dir, "skipme", "foo")
+
+	e := &excluder{names: map[string]bool{"skipme": true}}
+	checkExclude(t, e, filepath.Join(dir, "skipme"), true)
+}
+
+func TestExcludeMaxFileSize(t *testing.T) {
+	dir := makeTempDir(t)
+	defer os.RemoveAll(dir)
+	writeTempFile(t, dir, "small", "foo")
+	writeTempFile(t, dir, "big", "foobar")
+
+	e := &excluder{maxFileSize: 3}
+	checkExclude(t, e, filepath.Join(dir, "small"), false)
+	checkExclude(t, e, filepath.Join(dir, "big"), true)
+	checkExclude(t, e, dir, false)
+}
+
+func TestExcludeByAge(t *testing.T) {
+	dir := makeTempDir(t)
+	defer os.RemoveAll(dir)
+	old := writeTempFile(t, dir, "old", "foo")
+	writeTempFile(t, dir, "new", "foo")
+	twoDaysAgo := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(old, twoDaysAgo, twoDaysAgo); err != nil {
+		t.Fatal(err)
+	}
+	dayAgo := time.Now().Add(-24 * time.Hour)
+
+	newer := &excluder{newerThan: dayAgo}
+	checkExclude(t, newer, old, true)
+	checkExclude(t, newer, filepath.Join(dir, "new"), false)
+
+	older := &excluder{olderThan: dayAgo}
+	checkExclude(t, older, old, false)
+	checkExclude(t, older, filepath.Join(dir, "new"), true)
+}
+
+func TestExcludeOtherFileSystem(t *testing.T) {
+	dir := makeTempDir(t)
+	defer os.RemoveAll(dir)
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkExclude(t, &excluder{oneFileSystem: true, rootDev: device(fi)}, dir, false)
+	checkExclude(t, &excluder{oneFileSystem: true, rootDev: device(fi) + 1}, dir, true)
+	checkExclude(t, &excluder{oneFileSystem: false, rootDev: device(fi) + 1}, dir, false)
+}
+
+func TestExcludeCaches(t *testing.T) {
+	dir := makeTempDir(t)
+	defer os.RemoveAll(dir)
+	for _, sub := range []string{"cache", "notcache", "badsignature"} {
+		if err := os.Mkdir(filepath.Join(dir, sub), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeTempFile(t, filepath.Join(dir, "cache"), "CACHEDIR.TAG", string(cacheDirTagSignature)+"\n# This file is a cache directory tag.\n")
+	writeTempFile(t, filepath.Join(dir, "badsignature"), "CACHEDIR.TAG", "Signature: nope")
+
+	e := &excluder{excludeCaches: true}
+	checkExclude(t, e, filepath.Join(dir, "cache"), true)
+	checkExclude(t, e, filepath.Join(dir, "notcache"), false)
+	checkExclude(t, e, filepath.Join(dir, "badsignature"), false)
+	checkExclude(t, &excluder{}, filepath.Join(dir, "cache"), false)
+}
+
+func checkExclude(t *testing.T, e *excluder, path string, want bool) {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := e.exclude(path, fi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("%v: want exclude %v got %v", path, want, got)
+	}
+}
+
+func makeTempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func writeTempFile(t *testing.T, dir, name, contents string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
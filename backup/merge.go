@@ -0,0 +1,238 @@
+package backup
+
+import (
+	"context"
+	"crypto/aes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
+
+	"github.com/illicitonion/cloudbackup/meta"
+)
+
+// MergePolicy decides what Merge does with an entry which differs between the repository's metadata and the database being merged into it.
+type MergePolicy int
+
+const (
+	// MergeFail merges nothing if any entries conflict, and returns a *ConflictError.
+	MergeFail MergePolicy = iota
+	// MergeNewest keeps the entry from whichever database was written most recently.
+	MergeNewest
+	// MergeKeepBoth keeps the repository's entry, and adds the merged entry alongside it, at a path suffixed with ".merged-" and the time its database was written.
+	// Directories can't have two versions, so conflicting directory entries are resolved as with MergeNewest.
+	MergeKeepBoth
+)
+
+// ParseMergePolicy parses "fail", "newest" or "keep-both".
+func ParseMergePolicy(value string) (MergePolicy, error) {
+	switch value {
+	case "fail":
+		return MergeFail, nil
+	case "newest":
+		return MergeNewest, nil
+	case "keep-both":
+		return MergeKeepBoth, nil
+	}
+	return 0, fmt.Errorf("merge policy must be one of fail, newest or keep-both, got %q", value)
+}
+
+type MergeOptions struct {
+	Policy MergePolicy
+	// ChunkBytes and PadMetadata are as in BackupOptions, and are used when storing the merged metadata.
+	ChunkBytes  int
+	PadMetadata bool
+}
+
+// MergeStats counts the entries in the database which was merged.
+type MergeStats struct {
+	// Added counts entries for paths which the repository didn't have.
+	Added int
+	// Identical counts entries which the repository already had.
+	Identical int
+	// Conflicts counts entries which differed from the repository's, and were resolved according to the MergePolicy.
+	Conflicts int
+}
+
+// Merge adds every entry, and every decoy, in the metadata database at from into the repository's metadata, and stores the result.
+//
+// Entries don't record when they were written, so MergeNewest compares when the databases as a whole were last written:
+// for the repository, when its metadata was last stored (or its local metadata file's modification time), and for from, its modification time.
+func (r *Repository) Merge(ctx context.Context, from string, opts MergeOptions) (MergeStats, error) {
+	if opts.ChunkBytes <= 0 || opts.ChunkBytes%aes.BlockSize != 0 {
+		return MergeStats{}, fmt.Errorf("backup: need ChunkBytes greater than zero, and a multiple of %v, got %v", aes.BlockSize, opts.ChunkBytes)
+	}
+	fromFI, err := os.Stat(from)
+	if err != nil {
+		return MergeStats{}, fmt.Errorf("error stating metadata file to merge: %v", err)
+	}
+	fromTime := fromFI.ModTime().UTC()
+
+	tempDir, err := ioutil.TempDir("", "cloudbackuptmp")
+	if err != nil {
+		return MergeStats{}, fmt.Errorf("unable to make temporary directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// Opening a database upgrades it to the current schema, so open a copy, leaving from (and its modification time) untouched.
+	theirsCopy := filepath.Join(tempDir, "fromdb")
+	if err := copyFile(theirsCopy, from); err != nil {
+		return MergeStats{}, fmt.Errorf("error copying database at %v: %v", from, err)
+	}
+	theirs, err := meta.NewDB(theirsCopy)
+	if err != nil {
+		return MergeStats{}, fmt.Errorf("error opening database at %v: %v", from, err)
+	}
+	defer theirs.Close()
+
+	// Stat the local metadata file before it is opened, which may change its modification time.
+	var oursTime time.Time
+	if r.metaFile != "" {
+		if fi, err := os.Stat(r.metaFile); err == nil {
+			oursTime = fi.ModTime().UTC()
+		}
+	}
+	db, metaFile, stored, err := r.openDB(ctx, tempDir)
+	if err != nil {
+		return MergeStats{}, err
+	}
+	if stored != nil {
+		oursTime = stored.time
+	}
+
+	stats, err := mergeDB(db, theirs, opts.Policy, fromTime.After(oursTime), fromTime)
+	changed := db.Changed()
+	db.Close()
+	if err != nil {
+		return stats, err
+	}
+
+	if r.metaFile == "" {
+		if err := r.storeMetadata(ctx, r.chunkStore, tempDir, metaFile, changed, stored, opts.ChunkBytes, opts.PadMetadata, nil); err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+// copyFile copies the file at src to a new file at dst.
+func copyFile(dst, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// mergeDB puts the entries and decoys from theirs into ours. theirsNewer is whether theirs was written more recently than ours,
+// and theirsTime is when it was written.
+func mergeDB(ours, theirs *meta.DB, policy MergePolicy, theirsNewer bool, theirsTime time.Time) (MergeStats, error) {
+	if policy == MergeFail {
+		// Nothing is merged if anything conflicts, so look for conflicts before putting anything.
+		var conflicts []string
+		stats, err := walkMerge(ours, theirs, func(path string, theirEntry meta.Entry, conflict bool) error {
+			if conflict {
+				conflicts = append(conflicts, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return stats, err
+		}
+		if len(conflicts) > 0 {
+			return stats, &ConflictError{conflicts}
+		}
+	}
+
+	exists := func(path string) bool {
+		_, ok := lookupEntry(ours, path)
+		return ok
+	}
+	stats, err := walkMerge(ours, theirs, func(path string, theirEntry meta.Entry, conflict bool) error {
+		switch {
+		case conflict && policy == MergeKeepBoth && !theirEntry.Mode.IsDir():
+			path = versionPath(path, theirsTime, exists)
+		case conflict && !theirsNewer:
+			return nil
+		}
+		if _, err := ours.Put(path, &theirEntry); err != nil {
+			return fmt.Errorf("error merging entry for %v: %v", path, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+
+	decoys, err := theirs.Decoys()
+	if err != nil {
+		return stats, fmt.Errorf("error reading decoys: %v", err)
+	}
+	for _, decoy := range decoys {
+		if err := ours.PutDecoy(decoy); err != nil {
+			return stats, fmt.Errorf("error merging decoy: %v", err)
+		}
+	}
+	return stats, nil
+}
+
+// walkMerge streams the entries of theirs, looking each up in ours, and calls fn with each which ours doesn't have an identical entry for,
+// with the path it was Put at, and whether ours has a different entry there. It returns how many entries were added, identical, or conflicting.
+func walkMerge(ours, theirs *meta.DB, fn func(path string, theirEntry meta.Entry, conflict bool) error) (MergeStats, error) {
+	var stats MergeStats
+	if empty, err := theirs.Empty(); err != nil || empty {
+		return stats, err
+	}
+	err := theirs.Walk(".", func(path string, theirEntry meta.Entry) error {
+		// Walk names the entries of directories by the directory, e.g. "dir" for the entry Put at "dir/.".
+		if theirEntry.Mode.IsDir() {
+			path += "/."
+		}
+		ourEntry, ok := lookupEntry(ours, path)
+		switch {
+		case !ok:
+			stats.Added++
+		case reflect.DeepEqual(ourEntry, theirEntry):
+			stats.Identical++
+			return nil
+		default:
+			stats.Conflicts++
+		}
+		return fn(path, theirEntry, ok)
+	})
+	return stats, err
+}
+
+// lookupEntry returns the entry Put at path in db, and whether there is one.
+func lookupEntry(db *meta.DB, path string) (meta.Entry, bool) {
+	// Get fails if nothing is at path, or if one of its parents isn't a directory.
+	entries, err := db.Get(path)
+	if err != nil {
+		return meta.Entry{}, false
+	}
+	e, ok := entries[path]
+	return e, ok
+}
+
+// versionPath returns the path at which MergeKeepBoth keeps an entry which conflicts with the one at path, which is one for which exists is false.
+func versionPath(path string, t time.Time, exists func(path string) bool) string {
+	version := fmt.Sprintf("%s.merged-%s", path, t.Format("20060102T150405Z"))
+	for i, candidate := 2, version; ; i++ {
+		if !exists(candidate) {
+			return candidate
+		}
+		candidate = fmt.Sprintf("%s-%d", version, i)
+	}
+}
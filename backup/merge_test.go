@@ -0,0 +1,206 @@
+package backup
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/illicitonion/cloudbackup/meta"
+)
+
+var (
+	oursEntry   = meta.Entry{Bytes: 1, Mode: 0600, User: "foo", Group: "bar"}
+	theirsEntry = meta.Entry{Bytes: 2, Mode: 0600, User: "foo", Group: "bar"}
+	otherEntry  = meta.Entry{Bytes: 3, Mode: 0644, User: "foo", Group: "bar"}
+)
+
+func TestMergeDB(t *testing.T) {
+	theirsTime := time.Date(2017, 1, 2, 15, 4, 5, 0, time.UTC)
+	for _, tc := range []struct {
+		name        string
+		policy      MergePolicy
+		theirsNewer bool
+		want        map[string]meta.Entry
+	}{
+		{"newest, ours newer", MergeNewest, false, map[string]meta.Entry{
+			"dir/file":  oursEntry,
+			"dir/other": otherEntry,
+		}},
+		{"newest, theirs newer", MergeNewest, true, map[string]meta.Entry{
+			"dir/file":  theirsEntry,
+			"dir/other": otherEntry,
+		}},
+		{"keep both", MergeKeepBoth, false, map[string]meta.Entry{
+			"dir/file":                         oursEntry,
+			"dir/file.merged-20170102T150405Z": theirsEntry,
+			"dir/other":                        otherEntry,
+		}},
+	} {
+		ours, theirs := makeMergeDBs(t)
+		stats, err := mergeDB(ours, theirs, tc.policy, tc.theirsNewer, theirsTime)
+		if err != nil {
+			t.Fatalf("%v: %v", tc.name, err)
+		}
+		if want := (MergeStats{Added: 1, Identical: 0, Conflicts: 1}); stats != want {
+			t.Errorf("%v: stats: want %+v got %+v", tc.name, want, stats)
+		}
+		got, err := ours.Get("dir")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(tc.want, got) {
+			t.Errorf("%v: want %v got %v", tc.name, tc.want, got)
+		}
+		if decoys, err := ours.Decoys(); err != nil || !reflect.DeepEqual(decoys, []string{"aa"}) {
+			t.Errorf("%v: decoys: want [aa] got %v, %v", tc.name, decoys, err)
+		}
+		ours.Close()
+		theirs.Close()
+	}
+}
+
+func TestMergeDBKeepBothNamesVersionsUniquely(t *testing.T) {
+	theirsTime := time.Date(2017, 1, 2, 15, 4, 5, 0, time.UTC)
+	ours, theirs := makeMergeDBs(t)
+	defer ours.Close()
+	defer theirs.Close()
+	if _, err := ours.Put("dir/file.merged-20170102T150405Z", &otherEntry); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := mergeDB(ours, theirs, MergeKeepBoth, true, theirsTime); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ours.Get("dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]meta.Entry{
+		"dir/file":                           oursEntry,
+		"dir/file.merged-20170102T150405Z":   otherEntry,
+		"dir/file.merged-20170102T150405Z-2": theirsEntry,
+		"dir/other":                          otherEntry,
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("want %v got %v", want, got)
+	}
+}
+
+func TestMergeDBFail(t *testing.T) {
+	ours, theirs := makeMergeDBs(t)
+	defer ours.Close()
+	defer theirs.Close()
+
+	_, err := mergeDB(ours, theirs, MergeFail, true, time.Now())
+	conflict, ok := err.(*ConflictError)
+	if !ok {
+		t.Fatalf("want *ConflictError got %v", err)
+	}
+	if want := []string{"dir/file"}; !reflect.DeepEqual(want, conflict.Paths) {
+		t.Errorf("conflicts: want %v got %v", want, conflict.Paths)
+	}
+	if got, err := ours.Get("dir"); err != nil || len(got) != 1 {
+		t.Errorf("want nothing merged got %v, %v", got, err)
+	}
+}
+
+func TestMergeDBIntoEmpty(t *testing.T) {
+	path := makeMetaFile(t)
+	defer os.Remove(path)
+	ours, err := meta.NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ours.Close()
+	_, theirs := makeMergeDBs(t)
+	defer theirs.Close()
+
+	stats, err := mergeDB(ours, theirs, MergeFail, false, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (MergeStats{Added: 2}); stats != want {
+		t.Errorf("stats: want %+v got %+v", want, stats)
+	}
+}
+
+func TestRepositoryMerge(t *testing.T) {
+	repo := makeRepository(t)
+	src := makeTempDir(t)
+	defer os.RemoveAll(src)
+	writeTempFile(t, src, "file", "foo")
+	defer chdir(t, src)()
+	if _, err := repo.Backup(context.Background(), []string{"."}, BackupOptions{ChunkBytes: 4096}); err != nil {
+		t.Fatal(err)
+	}
+
+	from := makeMetaFile(t)
+	defer os.Remove(from)
+	putEntries(t, from, map[string]meta.Entry{"offline": otherEntry})
+	fromTime := time.Date(2017, 1, 2, 15, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(from, fromTime, fromTime); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := repo.Merge(context.Background(), from, MergeOptions{Policy: MergeFail, ChunkBytes: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (MergeStats{Added: 1}); stats != want {
+		t.Errorf("stats: want %+v got %+v", want, stats)
+	}
+	if fi, err := os.Stat(from); err != nil {
+		t.Fatal(err)
+	} else if !fi.ModTime().Equal(fromTime) {
+		t.Errorf("want %v left unmodified since %v, got modified at %v", from, fromTime, fi.ModTime())
+	}
+
+	entries, err := repo.List(context.Background(), ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := entries["file"]; !ok {
+		t.Errorf("want entry for file got %v", entries)
+	}
+	if got := entries["offline"]; !reflect.DeepEqual(otherEntry, got) {
+		t.Errorf("offline: want %v got %v", otherEntry, got)
+	}
+}
+
+func TestParseMergePolicy(t *testing.T) {
+	for value, want := range map[string]MergePolicy{
+		"fail":      MergeFail,
+		"newest":    MergeNewest,
+		"keep-both": MergeKeepBoth,
+	} {
+		if got, err := ParseMergePolicy(value); err != nil || got != want {
+			t.Errorf("%q: want %v got %v, %v", value, want, got, err)
+		}
+	}
+	if _, err := ParseMergePolicy("oldest"); err == nil {
+		t.Errorf("oldest: want error got nil")
+	}
+}
+
+// makeMergeDBs makes two databases which conflict at dir/file, of which theirs also has dir/other and a decoy.
+func makeMergeDBs(t *testing.T) (ours, theirs *meta.DB) {
+	oursPath, theirsPath := makeMetaFile(t), makeMetaFile(t)
+	putEntries(t, oursPath, map[string]meta.Entry{"dir/file": oursEntry})
+	putEntries(t, theirsPath, map[string]meta.Entry{"dir/file": theirsEntry, "dir/other": otherEntry})
+	ours, err := meta.NewDB(oursPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	theirs, err = meta.NewDB(theirsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := theirs.PutDecoy("aa"); err != nil {
+		t.Fatal(err)
+	}
+	// The files can be removed while the databases are open.
+	os.Remove(oursPath)
+	os.Remove(theirsPath)
+	return ours, theirs
+}
@@ -0,0 +1,106 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/illicitonion/cloudbackup/chunkstore"
+)
+
+// metadataCache is a chunk store which keeps a copy in dir of each chunk read from or saved to the ChunkStore, and reads chunks from dir
+// when it has them, so that metadata which hasn't changed since it was last fetched or stored needn't be downloaded again.
+// Chunks are named by the MAC of their ciphertext, so a cached chunk is always the same as the stored one, and a shard which has changed is
+// stored as new chunks, which are fetched. Only ciphertext is cached. The "meta" pointer is replaced in place, so is never cached.
+type metadataCache struct {
+	chunkstore.ChunkStore
+	dir string
+
+	mu sync.Mutex
+	// used records the names of the chunks which have been read or saved, so that prune can remove the rest.
+	used map[string]bool
+}
+
+func newMetadataCache(chunkStore chunkstore.ChunkStore, dir string) (*metadataCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("error making metadata cache directory: %v", err)
+	}
+	return &metadataCache{
+		ChunkStore: chunkStore,
+		dir:        dir,
+		used:       make(map[string]bool),
+	}, nil
+}
+
+func (c *metadataCache) Read(ctx context.Context, name string) ([]byte, error) {
+	if name == "meta" {
+		return c.ChunkStore.Read(ctx, name)
+	}
+	c.use(name)
+	if contents, err := ioutil.ReadFile(filepath.Join(c.dir, name)); err == nil {
+		return contents, nil
+	}
+	contents, err := c.ChunkStore.Read(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return contents, c.put(name, contents)
+}
+
+func (c *metadataCache) Save(ctx context.Context, name string, contents []byte) error {
+	if err := c.ChunkStore.Save(ctx, name, contents); err != nil || name == "meta" {
+		return err
+	}
+	c.use(name)
+	return c.put(name, contents)
+}
+
+func (c *metadataCache) use(name string) {
+	c.mu.Lock()
+	c.used[name] = true
+	c.mu.Unlock()
+}
+
+// put writes a chunk to the cache, via a temporary file, so that a chunk which was only partly written is never read.
+func (c *metadataCache) put(name string, contents []byte) error {
+	f, err := ioutil.TempFile(c.dir, "."+name+".")
+	if err != nil {
+		return fmt.Errorf("error caching chunk %v: %v", name, err)
+	}
+	if _, err := f.Write(contents); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return fmt.Errorf("error caching chunk %v: %v", name, err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("error caching chunk %v: %v", name, err)
+	}
+	if err := os.Rename(f.Name(), filepath.Join(c.dir, name)); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("error caching chunk %v: %v", name, err)
+	}
+	return nil
+}
+
+// prune removes every cached chunk which hasn't been read or saved through c, i.e. those of metadata which is no longer current.
+func (c *metadataCache) prune() error {
+	infos, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return fmt.Errorf("error listing metadata cache: %v", err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, fi := range infos {
+		if c.used[fi.Name()] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(c.dir, fi.Name())); err != nil {
+			return fmt.Errorf("error pruning metadata cache: %v", err)
+		}
+	}
+	return nil
+}
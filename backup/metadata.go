@@ -0,0 +1,409 @@
+package backup
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/illicitonion/cloudbackup/chunkstore"
+	"github.com/illicitonion/cloudbackup/crypto"
+	"github.com/illicitonion/cloudbackup/meta"
+)
+
+var metaIV = []byte("metametametameta")
+
+// rootPointerMode is the mode of the meta.Entry in the "meta" pointer when it points at a root.
+// Pointers written before metadata was sharded point at a gzip'd boltdb file, and have a regular file mode.
+const rootPointerMode = os.ModeDir | 0600
+
+// root is what the "meta" pointer points at.
+type root struct {
+	Time time.Time
+	// Tree is the encoded root shard of the directory tree; see meta.DB.ExportTree.
+	Tree []byte
+	// Decoys refers to a blob containing the names of every decoy chunk, or is nil if there are none.
+	Decoys []byte
+	// Previous refers to the root which this one replaced, if any, so that old versions of the metadata remain available.
+	Previous []byte
+	// SchemaVersion is the meta.SchemaVersion of the database which Tree was exported from. Roots stored before it was recorded have version 0.
+	SchemaVersion int
+	// Summary summarizes the backup which stored this root, or is nil if it wasn't stored by a backup, or was stored before summaries were recorded.
+	Summary *Summary
+}
+
+// blobRef refers to a gzip'd, encrypted blob in the chunk store. Encoded blobRefs are the opaque references used by meta.DB.ExportTree.
+type blobRef struct {
+	// MAC is the HMAC of the blob's plaintext, which identifies blobs which have already been stored.
+	MAC   []byte
+	Entry meta.Entry
+}
+
+// storedMetadata is what is remembered about the metadata fetched from the chunk store, so that parts which haven't changed needn't be uploaded again.
+type storedMetadata struct {
+	// blobs maps the hex HMAC of the plaintext of each blob which is known to be stored to its encoded blobRef.
+	blobs map[string][]byte
+	// root refers to the root which was fetched, or is nil if there wasn't one.
+	root []byte
+	// time is when the fetched root was stored, or is zero if there wasn't one.
+	time time.Time
+	// schemaVersion is the meta.SchemaVersion of the fetched metadata, before it was upgraded.
+	schemaVersion int
+	// version is the chunk store's version of the "meta" pointer which was fetched, or zero if there wasn't one.
+	// The pointer is only replaced if it still has this version, so that concurrent backups can't silently discard each other's changes.
+	version int64
+}
+
+// fetchMetadataFile downloads and decrypts the metadata database into tempDir, returning its path, and what is needed to upload it again efficiently.
+// If no metadata has been stored yet, the returned path does not exist.
+func fetchMetadataFile(ctx context.Context, aesKey, hmacKey []byte, chunkStore chunkstore.ChunkStore, tempDir string) (string, *storedMetadata, error) {
+	path := filepath.Join(tempDir, "metadb")
+	stored := &storedMetadata{blobs: make(map[string][]byte)}
+
+	pointer, version, err := readMetaPointer(ctx, aesKey, chunkStore)
+	if os.IsNotExist(err) {
+		return path, stored, nil
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	stored.version = version
+	if !pointer.Mode.IsDir() {
+		// Metadata was sharded after the legacy format was last written, but before schema versions were recorded.
+		stored.schemaVersion = 0
+		if err := fetchLegacyMetadataFile(ctx, aesKey, hmacKey, chunkStore, pointer, path); err != nil {
+			return "", nil, err
+		}
+		return path, stored, nil
+	}
+
+	r, ref, err := fetchRoot(ctx, aesKey, hmacKey, chunkStore, pointer)
+	if err != nil {
+		return "", nil, err
+	}
+	stored.root = ref
+	stored.time = r.Time
+	stored.schemaVersion = r.SchemaVersion
+
+	fetch := func(encodedRef []byte) (io.ReadCloser, error) {
+		var ref blobRef
+		if err := gob.NewDecoder(bytes.NewReader(encodedRef)).Decode(&ref); err != nil {
+			return nil, fmt.Errorf("error decoding metadata reference: %v", err)
+		}
+		blob, err := fetchBlob(ctx, aesKey, hmacKey, chunkStore, &ref.Entry)
+		if err != nil {
+			return nil, err
+		}
+		stored.blobs[hex.EncodeToString(ref.MAC)] = encodedRef
+		return blob, nil
+	}
+
+	db, err := meta.NewDB(path)
+	if err != nil {
+		return "", nil, fmt.Errorf("error creating metadb file: %v", err)
+	}
+	defer db.Close()
+	if err := db.ImportTree(r.Tree, r.SchemaVersion, fetch); err != nil {
+		return "", nil, fmt.Errorf("error fetching metadata: %v", err)
+	}
+	if r.Decoys != nil {
+		blob, err := fetch(r.Decoys)
+		if err != nil {
+			return "", nil, err
+		}
+		var decoys []string
+		err = gob.NewDecoder(blob).Decode(&decoys)
+		blob.Close()
+		if err != nil {
+			return "", nil, fmt.Errorf("error decoding decoys: %v", err)
+		}
+		for _, decoy := range decoys {
+			if err := db.PutDecoy(decoy); err != nil {
+				return "", nil, fmt.Errorf("error storing decoy: %v", err)
+			}
+		}
+	}
+	return path, stored, nil
+}
+
+// readMetaPointer reads the "meta" pointer, returning the entry it contains and its version in the chunk store.
+func readMetaPointer(ctx context.Context, aesKey []byte, chunkStore chunkstore.ChunkStore) (*meta.Entry, int64, error) {
+	metaPointerCiphertext, version, err := chunkStore.ReadVersion(ctx, "meta")
+	if os.IsNotExist(err) {
+		return nil, 0, err
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("error reading meta file from chunk storage: %v", err)
+	}
+	metaPointerPlaintext, err := crypto.Decrypt(aesKey, nil, metaIV, metaPointerCiphertext, nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error decrypting meta file: %v", err)
+	}
+	entry, err := meta.DecodeEntry(metaPointerPlaintext)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error decoding meta file: %v", err)
+	}
+	return entry, version, nil
+}
+
+// fetchRoot fetches the root which e points at, returning it along with an encoded blobRef to it.
+func fetchRoot(ctx context.Context, aesKey, hmacKey []byte, chunkStore chunkstore.ChunkStore, e *meta.Entry) (*root, []byte, error) {
+	blob, err := fetchBlob(ctx, aesKey, hmacKey, chunkStore, e)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer blob.Close()
+	mac := hmac.New(sha256.New, hmacKey)
+	var r root
+	if err := gob.NewDecoder(io.TeeReader(blob, mac)).Decode(&r); err != nil {
+		return nil, nil, fmt.Errorf("error decoding metadata root: %v", err)
+	}
+	// The decoder may stop short of the end of the blob, but the reference identifies all of it.
+	if _, err := io.Copy(mac, blob); err != nil {
+		return nil, nil, fmt.Errorf("error reading metadata root: %v", err)
+	}
+	ref, err := encodeBlobRef(mac.Sum(nil), e)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &r, ref, nil
+}
+
+// fetchLegacyMetadataFile fetches the gzip'd boltdb file which e points at, as was stored before metadata was sharded, to path.
+func fetchLegacyMetadataFile(ctx context.Context, aesKey, hmacKey []byte, chunkStore chunkstore.ChunkStore, e *meta.Entry, path string) error {
+	unzipped, err := fetchBlob(ctx, aesKey, hmacKey, chunkStore, e)
+	if err != nil {
+		return err
+	}
+	defer unzipped.Close()
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("error creating metadb file: %v", err)
+	}
+	defer f.Close()
+	if err := f.Chmod(0600); err != nil {
+		return fmt.Errorf("error chmoding metadb file: %v", err)
+	}
+	if _, err := io.Copy(f, unzipped); err != nil {
+		return fmt.Errorf("error writing metadb file: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("error closing metadb file: %v", err)
+	}
+	return nil
+}
+
+// uploadMetadataFile stores the metadata database at metaFile as a new root, and points the "meta" chunk at it.
+// Each directory's shard is stored as a separate gzip'd, encrypted blob, unless it is small enough to be kept in its parent's shard.
+// Blobs which stored knows about are not uploaded again, so only the shards of directories which have changed, and of their parents, are uploaded.
+// If pad is true, the number of chunks of each blob is padded to the next power of two, so that stored sizes only roughly reveal how many files there are.
+//
+// summary, if non-nil, is stored in the root.
+//
+// If the "meta" pointer has been replaced since stored was fetched, chunkstore.ErrVersionMismatch is returned, and the pointer is left unchanged.
+func uploadMetadataFile(ctx context.Context, aesKey, hmacKey []byte, chunkStore chunkstore.ChunkStore, metaFile string, chunkBytes int, pad bool, stored *storedMetadata, summary *Summary) error {
+	if stored == nil {
+		stored = &storedMetadata{blobs: make(map[string][]byte)}
+	}
+	var padTo func(int) int
+	if pad {
+		padTo = func(n int) int { return paddedChunkCount(n, 0) }
+	}
+	store := func(plaintext []byte) ([]byte, error) {
+		mac := hmac.New(sha256.New, hmacKey)
+		mac.Write(plaintext)
+		sum := mac.Sum(nil)
+		key := hex.EncodeToString(sum)
+		if ref, ok := stored.blobs[key]; ok {
+			return ref, nil
+		}
+		e, err := storeBlob(ctx, aesKey, hmacKey, chunkStore, chunkBytes, plaintext, padTo)
+		if err != nil {
+			return nil, err
+		}
+		ref, err := encodeBlobRef(sum, e)
+		if err != nil {
+			return nil, err
+		}
+		stored.blobs[key] = ref
+		return ref, nil
+	}
+
+	db, err := meta.NewDB(metaFile)
+	if err != nil {
+		return fmt.Errorf("error opening database at %v: %v", metaFile, err)
+	}
+	defer db.Close()
+
+	r := root{
+		Time:          time.Now().UTC(),
+		Previous:      stored.root,
+		SchemaVersion: meta.SchemaVersion,
+		Summary:       summary,
+	}
+	// Subtrees which fit in a chunk are kept in their parent's shard, as storing them separately would mostly store padding.
+	if r.Tree, err = db.ExportTree(chunkBytes, store); err != nil {
+		return fmt.Errorf("error storing metadata: %v", err)
+	}
+	decoys, err := db.Decoys()
+	if err != nil {
+		return fmt.Errorf("error reading decoys: %v", err)
+	}
+	if len(decoys) > 0 {
+		buf := bytes.NewBuffer(nil)
+		if err := gob.NewEncoder(buf).Encode(decoys); err != nil {
+			return fmt.Errorf("error encoding decoys: %v", err)
+		}
+		if r.Decoys, err = store(buf.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if err := gob.NewEncoder(buf).Encode(&r); err != nil {
+		return fmt.Errorf("error encoding metadata root: %v", err)
+	}
+	entry, err := storeBlob(ctx, aesKey, hmacKey, chunkStore, chunkBytes, buf.Bytes(), padTo)
+	if err != nil {
+		return err
+	}
+	entry.Mode = rootPointerMode
+	encoded, err := meta.EncodeEntry(entry)
+	if err != nil {
+		return fmt.Errorf("error encoding entry: %v", err)
+	}
+	ciphertext, _, err := crypto.Encrypt(aesKey, hmacKey, metaIV, encoded, chunkBytes)
+	if err != nil {
+		return fmt.Errorf("error encrypting meta file: %v", err)
+	}
+	if err := chunkStore.SaveIfVersion(ctx, "meta", ciphertext, stored.version); err == chunkstore.ErrVersionMismatch {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("error uploading meta file: %v", err)
+	}
+	return nil
+}
+
+// mergeLatestMetadata fetches the latest metadata into a new directory under tempDir, and copies into it the entries at changed paths,
+// and the decoys, from the metadata database at metaFile. It returns the path to the merged database, and what is known about the stored metadata,
+// which includes the blobs from stored, as they are still stored.
+func mergeLatestMetadata(ctx context.Context, aesKey, hmacKey []byte, chunkStore chunkstore.ChunkStore, tempDir, metaFile string, changed []string, stored *storedMetadata) (string, *storedMetadata, error) {
+	dir, err := ioutil.TempDir(tempDir, "merge")
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to make temporary directory: %v", err)
+	}
+	latestFile, latest, err := fetchMetadataFile(ctx, aesKey, hmacKey, chunkStore, dir)
+	if err != nil {
+		return "", nil, err
+	}
+	for key, ref := range stored.blobs {
+		if _, ok := latest.blobs[key]; !ok {
+			latest.blobs[key] = ref
+		}
+	}
+
+	ours, err := meta.NewDB(metaFile)
+	if err != nil {
+		return "", nil, fmt.Errorf("error opening database at %v: %v", metaFile, err)
+	}
+	defer ours.Close()
+	theirs, err := meta.NewDB(latestFile)
+	if err != nil {
+		return "", nil, fmt.Errorf("error opening database at %v: %v", latestFile, err)
+	}
+	defer theirs.Close()
+
+	for _, path := range changed {
+		entries, err := ours.Get(path)
+		if err != nil {
+			return "", nil, fmt.Errorf("error getting entry for %v: %v", path, err)
+		}
+		e, ok := entries[path]
+		if !ok {
+			return "", nil, fmt.Errorf("error getting entry for %v: not found", path)
+		}
+		if _, err := theirs.Put(path, &e); err != nil {
+			return "", nil, fmt.Errorf("error merging entry for %v: %v", path, err)
+		}
+	}
+	decoys, err := ours.Decoys()
+	if err != nil {
+		return "", nil, fmt.Errorf("error reading decoys: %v", err)
+	}
+	for _, decoy := range decoys {
+		if err := theirs.PutDecoy(decoy); err != nil {
+			return "", nil, fmt.Errorf("error merging decoy: %v", err)
+		}
+	}
+	return latestFile, latest, nil
+}
+
+// encodeBlobRef encodes a blobRef to the blob stored at e, whose plaintext has the HMAC mac.
+func encodeBlobRef(mac []byte, e *meta.Entry) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	if err := gob.NewEncoder(buf).Encode(&blobRef{MAC: mac, Entry: *e}); err != nil {
+		return nil, fmt.Errorf("error encoding metadata reference: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// storeBlob gzips, encrypts and stores plaintext, returning an entry describing where it is stored.
+func storeBlob(ctx context.Context, aesKey, hmacKey []byte, chunkStore chunkstore.ChunkStore, chunkBytes int, plaintext []byte, padTo func(int) int) (*meta.Entry, error) {
+	// Gzip through a pipe so that only a chunk at a time of the gzip'd blob needs to be held in memory.
+	pr, pw := io.Pipe()
+	go func() {
+		zipper := gzip.NewWriter(pw)
+		if _, err := zipper.Write(plaintext); err != nil {
+			pw.CloseWithError(fmt.Errorf("error gzipping metadata: %v", err))
+			return
+		}
+		pw.CloseWithError(zipper.Close())
+	}()
+	defer pr.Close()
+	zipped := &countingReader{r: pr}
+	chunks, err := encryptFile(ctx, aesKey, hmacKey, makeIV, nil, chunkStore, chunkBytes, "metadata", zipped, -1, true, padTo, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &meta.Entry{
+		Bytes:  zipped.n,
+		Chunks: chunks,
+		Mode:   0600,
+	}, nil
+}
+
+// fetchBlob returns the plaintext of a blob stored by storeBlob, which is fetched, decrypted and gunzipped as it is read.
+// The returned reader must be closed.
+func fetchBlob(ctx context.Context, aesKey, hmacKey []byte, chunkStore chunkstore.ChunkStore, e *meta.Entry) (io.ReadCloser, error) {
+	// Decrypt through a pipe so that only a chunk at a time needs to be held in memory, however large the blob is.
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(decryptChunks(ctx, aesKey, hmacKey, pw, chunkStore, e))
+	}()
+	unzipped, err := gzip.NewReader(pr)
+	if err != nil {
+		pr.Close()
+		return nil, fmt.Errorf("error making gzip reader: %v", err)
+	}
+	return &blobReader{Reader: unzipped, pipe: pr}, nil
+}
+
+// blobReader reads a blob being fetched by fetchBlob. Closing it stops the fetch.
+type blobReader struct {
+	*gzip.Reader
+	pipe *io.PipeReader
+}
+
+func (b *blobReader) Close() error {
+	b.Reader.Close()
+	return b.pipe.Close()
+}
@@ -0,0 +1,169 @@
+package backup
+
+import (
+	"context"
+	cryptorand "crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/illicitonion/cloudbackup/chunkstore"
+)
+
+const DefaultObfuscateBatchChunks = 64
+
+type ObfuscateOptions struct {
+	// BatchChunks is how many chunks are held in memory and uploaded in a random order, so that the chunks of a file are not uploaded consecutively.
+	// If zero, DefaultObfuscateBatchChunks is used.
+	BatchChunks int
+	// MaxDelay is the longest random delay between uploading chunks.
+	MaxDelay time.Duration
+	// DecoyRate is the number of decoy chunks, containing random bytes, to upload per real chunk, e.g. 0.1 uploads about one decoy for every ten chunks.
+	// Decoys are recorded in the metadata database, so they can be told apart from real chunks which are no longer used.
+	DecoyRate float64
+}
+
+type pendingChunk struct {
+	name     string
+	contents []byte
+}
+
+// obfuscatingChunkStore buffers saved chunks and uploads them in batches, shuffled together with decoy chunks, with random delays between uploads.
+// Names which are not chunks, such as "meta", are saved immediately after uploading everything buffered before them.
+//
+// Buffered chunks can't be read until they have been uploaded. If uploading a batch fails, every subsequent Save and flush returns the same error,
+// as chunks which have already been recorded in the metadata database may not have been stored.
+type obfuscatingChunkStore struct {
+	chunkstore.ChunkStore
+	opts ObfuscateOptions
+
+	mu  sync.Mutex
+	rng *rand.Rand
+	// recordDecoy is called with the name of each decoy before it is uploaded. If it is nil, no decoys are uploaded.
+	recordDecoy func(name string) error
+	pending     []pendingChunk
+	err         error
+}
+
+func newObfuscatingChunkStore(s chunkstore.ChunkStore, opts ObfuscateOptions, recordDecoy func(name string) error) (*obfuscatingChunkStore, error) {
+	if opts.BatchChunks <= 0 {
+		opts.BatchChunks = DefaultObfuscateBatchChunks
+	}
+	// The order of uploads must not be predictable, so don't rely on math/rand's default seed.
+	var seed [8]byte
+	if _, err := cryptorand.Read(seed[:]); err != nil {
+		return nil, fmt.Errorf("error seeding random number generator: %v", err)
+	}
+	return &obfuscatingChunkStore{
+		ChunkStore:  s,
+		opts:        opts,
+		rng:         rand.New(rand.NewSource(int64(binary.LittleEndian.Uint64(seed[:])))),
+		recordDecoy: recordDecoy,
+	}, nil
+}
+
+func (o *obfuscatingChunkStore) Save(ctx context.Context, name string, contents []byte) error {
+	if _, isChunk := chunkKey(name); !isChunk {
+		if err := o.flush(ctx); err != nil {
+			return err
+		}
+		return o.ChunkStore.Save(ctx, name, contents)
+	}
+
+	o.mu.Lock()
+	if o.err != nil {
+		o.mu.Unlock()
+		return o.err
+	}
+	o.pending = append(o.pending, pendingChunk{name, contents})
+	full := len(o.pending) >= o.opts.BatchChunks
+	o.mu.Unlock()
+
+	if full {
+		return o.flush(ctx)
+	}
+	return nil
+}
+
+func (o *obfuscatingChunkStore) SaveIfVersion(ctx context.Context, name string, contents []byte, version int64) error {
+	if err := o.flush(ctx); err != nil {
+		return err
+	}
+	return o.ChunkStore.SaveIfVersion(ctx, name, contents, version)
+}
+
+// stopDecoys stops any more decoys being uploaded, e.g. because the metadata database they would be recorded in has been closed.
+func (o *obfuscatingChunkStore) stopDecoys() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.recordDecoy = nil
+}
+
+// flush uploads everything buffered.
+func (o *obfuscatingChunkStore) flush(ctx context.Context) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.err != nil {
+		return o.err
+	}
+	batch := o.pending
+	o.pending = nil
+	if len(batch) == 0 {
+		return nil
+	}
+
+	if o.recordDecoy != nil {
+		decoys := o.opts.DecoyRate * float64(len(batch))
+		count := int(decoys)
+		if o.rng.Float64() < decoys-float64(count) {
+			count++
+		}
+		for i := 0; i < count; i++ {
+			decoy, err := o.makeDecoy(len(batch[o.rng.Intn(len(batch))].contents))
+			if err != nil {
+				o.err = err
+				return err
+			}
+			batch = append(batch, decoy)
+		}
+	}
+	o.rng.Shuffle(len(batch), func(i, j int) { batch[i], batch[j] = batch[j], batch[i] })
+
+	for i, chunk := range batch {
+		if i > 0 && o.opts.MaxDelay > 0 {
+			timer := time.NewTimer(time.Duration(o.rng.Int63n(int64(o.opts.MaxDelay))))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				o.err = ctx.Err()
+				return o.err
+			case <-timer.C:
+			}
+		}
+		if err := o.ChunkStore.Save(ctx, chunk.name, chunk.contents); err != nil {
+			o.err = fmt.Errorf("error uploading batch of chunks: %v", err)
+			return o.err
+		}
+	}
+	return nil
+}
+
+// makeDecoy makes and records a chunk of random bytes, with a random name of the same form as a real chunk's.
+func (o *obfuscatingChunkStore) makeDecoy(size int) (pendingChunk, error) {
+	contents := make([]byte, size)
+	if _, err := cryptorand.Read(contents); err != nil {
+		return pendingChunk{}, fmt.Errorf("error making decoy chunk: %v", err)
+	}
+	var name [32]byte
+	if _, err := cryptorand.Read(name[:]); err != nil {
+		return pendingChunk{}, fmt.Errorf("error making decoy chunk name: %v", err)
+	}
+	decoy := pendingChunk{hex.EncodeToString(name[:]), contents}
+	if err := o.recordDecoy(decoy.name); err != nil {
+		return pendingChunk{}, fmt.Errorf("error recording decoy chunk: %v", err)
+	}
+	return decoy, nil
+}
@@ -0,0 +1,103 @@
+package backup
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/illicitonion/cloudbackup/fscache"
+	"github.com/illicitonion/cloudbackup/meta"
+)
+
+// ownership resolves the owners recorded in entries to IDs on this system, as configured by RestoreOptions.
+type ownership struct {
+	cache   *fscache.Cache
+	numeric bool
+	// users and groups map recorded names or numeric IDs to the IDs to restore as.
+	users  map[string]uint32
+	groups map[string]uint32
+}
+
+func newOwnership(cache *fscache.Cache, opts RestoreOptions) (*ownership, error) {
+	users, err := resolveMapping(opts.MapUsers, cache.LookupUser)
+	if err != nil {
+		return nil, fmt.Errorf("backup: bad user mapping: %v", err)
+	}
+	groups, err := resolveMapping(opts.MapGroups, cache.LookupGroup)
+	if err != nil {
+		return nil, fmt.Errorf("backup: bad group mapping: %v", err)
+	}
+	return &ownership{
+		cache:   cache,
+		numeric: opts.NumericOwner,
+		users:   users,
+		groups:  groups,
+	}, nil
+}
+
+// resolveMapping looks up the target of each of mapping, which may be a name or a numeric ID.
+func resolveMapping(mapping map[string]string, lookup func(string) (uint32, error)) (map[string]uint32, error) {
+	resolved := make(map[string]uint32, len(mapping))
+	for from, to := range mapping {
+		id, err := parseOwner(to, lookup)
+		if err != nil {
+			return nil, fmt.Errorf("%v:%v: %v", from, to, err)
+		}
+		resolved[from] = id
+	}
+	return resolved, nil
+}
+
+func parseOwner(owner string, lookup func(string) (uint32, error)) (uint32, error) {
+	if id, err := strconv.ParseUint(owner, 10, 32); err == nil {
+		return uint32(id), nil
+	}
+	return lookup(owner)
+}
+
+func (o *ownership) uid(e *meta.Entry) (uint32, error) {
+	return o.resolve(e.User, e.UID, e.HasIDs, o.users, o.cache.LookupUser)
+}
+
+func (o *ownership) gid(e *meta.Entry) (uint32, error) {
+	return o.resolve(e.Group, e.GID, e.HasIDs, o.groups, o.cache.LookupGroup)
+}
+
+// resolve returns the ID to restore an owner recorded as name and (if hasID) id as. Mappings take precedence, then the numeric ID if requested
+// or if there is no name, then the name. If the name doesn't exist on this system, the numeric ID is used, as tar does.
+func (o *ownership) resolve(name string, id uint32, hasID bool, mapping map[string]uint32, lookup func(string) (uint32, error)) (uint32, error) {
+	if to, ok := mapping[name]; ok && name != "" {
+		return to, nil
+	}
+	if hasID {
+		if to, ok := mapping[strconv.FormatUint(uint64(id), 10)]; ok {
+			return to, nil
+		}
+		if o.numeric || name == "" {
+			return id, nil
+		}
+	}
+	resolved, err := lookup(name)
+	if err != nil && hasID {
+		return id, nil
+	}
+	return resolved, err
+}
+
+// chown changes the owner of path to that of e, logging rather than failing if it can't be, as backups can be restored by other users or on other systems.
+func (o *ownership) chown(nameForErrors, path string, e *meta.Entry) {
+	uid, err := o.uid(e)
+	if err != nil {
+		log.Printf("Could not find user %q on this system - skipping chown for %q (%v)", e.User, nameForErrors, err)
+		return
+	}
+	gid, err := o.gid(e)
+	if err != nil {
+		log.Printf("Could not find group %q on this system - skipping chown for %q (%v)", e.Group, nameForErrors, err)
+		return
+	}
+	if err := os.Chown(path, int(uid), int(gid)); err != nil {
+		log.Printf("Error chowning file %v (for %q): %v", path, nameForErrors, err)
+	}
+}
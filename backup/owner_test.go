@@ -0,0 +1,63 @@
+package backup
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestOwnershipResolve(t *testing.T) {
+	lookup := func(name string) (uint32, error) {
+		if id, ok := map[string]uint32{"alice": 1000, "bob": 1001}[name]; ok {
+			return id, nil
+		}
+		return 0, fmt.Errorf("no user %q", name)
+	}
+	mapping := map[string]uint32{"carol": 2000, "500": 2001}
+
+	for _, tc := range []struct {
+		description string
+		numeric     bool
+		name        string
+		id          uint32
+		hasID       bool
+		want        uint32
+	}{
+		{"by name", false, "alice", 5, true, 1000},
+		{"numeric", true, "alice", 5, true, 5},
+		{"numeric without ID", true, "alice", 0, false, 1000},
+		{"missing name falls back to ID", false, "dave", 5, true, 5},
+		{"no name", false, "", 0, true, 0},
+		{"mapped name", true, "carol", 5, true, 2000},
+		{"mapped ID", false, "alice", 500, true, 2001},
+	} {
+		o := &ownership{numeric: tc.numeric}
+		got, err := o.resolve(tc.name, tc.id, tc.hasID, mapping, lookup)
+		if err != nil {
+			t.Errorf("%v: %v", tc.description, err)
+		} else if got != tc.want {
+			t.Errorf("%v: want %v got %v", tc.description, tc.want, got)
+		}
+	}
+
+	o := &ownership{}
+	if _, err := o.resolve("dave", 0, false, mapping, lookup); err == nil {
+		t.Errorf("missing name without ID: want error got nil")
+	}
+}
+
+func TestResolveMapping(t *testing.T) {
+	got, err := resolveMapping(map[string]string{"alice": "1234", "1000": "0"}, func(name string) (uint32, error) {
+		return 0, fmt.Errorf("no user %q", name)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got["alice"] != 1234 || got["1000"] != 0 || len(got) != 2 {
+		t.Errorf("want map[1000:0 alice:1234] got %v", got)
+	}
+	if _, err := resolveMapping(map[string]string{"alice": "nobody-here"}, func(name string) (uint32, error) {
+		return 0, fmt.Errorf("no user %q", name)
+	}); err == nil {
+		t.Errorf("unknown target: want error got nil")
+	}
+}
@@ -0,0 +1,182 @@
+package backup
+
+import (
+	"io"
+	"reflect"
+	"sync/atomic"
+	"time"
+
+	"github.com/illicitonion/cloudbackup/meta"
+)
+
+// DefaultProgressInterval is how often progress is reported if no interval is given.
+const DefaultProgressInterval = time.Second
+
+// Progress describes how far a backup or restore has got.
+type Progress struct {
+	// TotalFiles and TotalBytes are counted before starting, so are zero if unknown (e.g. for BackupStream).
+	// Files may change while being backed up, so Files and Bytes may exceed them.
+	TotalFiles int64
+	TotalBytes int64
+	// Files counts the files finished, and Bytes the bytes of files read (when backing up) or written (when restoring).
+	Files int64
+	Bytes int64
+	// ChunksUploaded counts the chunks of files which were encrypted and uploaded, and ChunksReused those which were unchanged since the
+	// file was last backed up, so were reused rather than uploaded. Both are zero when restoring.
+	ChunksUploaded int64
+	ChunksReused   int64
+	Elapsed        time.Duration
+	// Done is set for the last report, once everything has been processed.
+	Done bool
+}
+
+// BytesPerSecond is the average throughput so far.
+func (p Progress) BytesPerSecond() float64 {
+	if p.Elapsed <= 0 {
+		return 0
+	}
+	return float64(p.Bytes) / p.Elapsed.Seconds()
+}
+
+// ETA estimates how long is left at the average throughput so far. ok is false if this can't be estimated, e.g. because TotalBytes is unknown.
+func (p Progress) ETA() (eta time.Duration, ok bool) {
+	rate := p.BytesPerSecond()
+	if p.TotalBytes == 0 || rate == 0 {
+		return 0, false
+	}
+	remaining := p.TotalBytes - p.Bytes
+	if remaining < 0 {
+		remaining = 0
+	}
+	return time.Duration(float64(remaining) / rate * float64(time.Second)), true
+}
+
+// progressTracker counts a run's progress, and reports it every interval. A nil *progressTracker counts nothing, so needn't be checked for.
+type progressTracker struct {
+	// Accessed atomically, so kept first for alignment.
+	totalFiles, totalBytes, files, bytes, uploaded, reused int64
+	newFiles, changedFiles, unchangedFiles, deletedFiles   int64
+
+	start  time.Time
+	report func(Progress)
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// startProgress starts counting progress and, if report is non-nil, reporting it every interval (or DefaultProgressInterval if it isn't positive).
+// finish must be called to stop it.
+func startProgress(report func(Progress), interval time.Duration, totalFiles, totalBytes int64) *progressTracker {
+	t := &progressTracker{
+		totalFiles: totalFiles,
+		totalBytes: totalBytes,
+		start:      time.Now(),
+		report:     report,
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	if report == nil {
+		close(t.done)
+		return t
+	}
+	if interval <= 0 {
+		interval = DefaultProgressInterval
+	}
+	go func() {
+		defer close(t.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				t.report(t.snapshot())
+			case <-t.stop:
+				return
+			}
+		}
+	}()
+	return t
+}
+
+func (t *progressTracker) snapshot() Progress {
+	return Progress{
+		TotalFiles:     atomic.LoadInt64(&t.totalFiles),
+		TotalBytes:     atomic.LoadInt64(&t.totalBytes),
+		Files:          atomic.LoadInt64(&t.files),
+		Bytes:          atomic.LoadInt64(&t.bytes),
+		ChunksUploaded: atomic.LoadInt64(&t.uploaded),
+		ChunksReused:   atomic.LoadInt64(&t.reused),
+		Elapsed:        time.Since(t.start),
+	}
+}
+
+// finish stops periodic reports, and makes a last one.
+func (t *progressTracker) finish() {
+	if t == nil {
+		return
+	}
+	close(t.stop)
+	<-t.done
+	if t.report == nil {
+		return
+	}
+	p := t.snapshot()
+	p.Done = true
+	t.report(p)
+}
+
+func (t *progressTracker) fileDone() {
+	if t != nil {
+		atomic.AddInt64(&t.files, 1)
+	}
+}
+
+// fileStored counts a file whose entry was old (or nil if it had none) before it was backed up, and is now entry.
+func (t *progressTracker) fileStored(old, entry *meta.Entry) {
+	if t == nil {
+		return
+	}
+	switch {
+	case old == nil:
+		atomic.AddInt64(&t.newFiles, 1)
+	case reflect.DeepEqual(old, entry):
+		atomic.AddInt64(&t.unchangedFiles, 1)
+	default:
+		atomic.AddInt64(&t.changedFiles, 1)
+	}
+}
+
+func (t *progressTracker) filesDeleted(n int64) {
+	if t != nil {
+		atomic.AddInt64(&t.deletedFiles, n)
+	}
+}
+
+func (t *progressTracker) addBytes(n int) {
+	if t != nil {
+		atomic.AddInt64(&t.bytes, int64(n))
+	}
+}
+
+func (t *progressTracker) chunkUploaded() {
+	if t != nil {
+		atomic.AddInt64(&t.uploaded, 1)
+	}
+}
+
+func (t *progressTracker) chunkReused() {
+	if t != nil {
+		atomic.AddInt64(&t.reused, 1)
+	}
+}
+
+// progressWriter counts the bytes written to w as progress.
+type progressWriter struct {
+	w        io.Writer
+	progress *progressTracker
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.progress.addBytes(n)
+	return n, err
+}
@@ -0,0 +1,88 @@
+package backup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// progressRecorder records the last progress reported, and how many reports were Done.
+type progressRecorder struct {
+	mu    sync.Mutex
+	last  Progress
+	dones int
+}
+
+func (r *progressRecorder) report(p Progress) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.last = p
+	if p.Done {
+		r.dones++
+	}
+}
+
+func TestRepositoryProgress(t *testing.T) {
+	repo := makeRepository(t)
+	src := makeTempDir(t)
+	defer os.RemoveAll(src)
+	if err := os.Mkdir(filepath.Join(src, "dir"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	writeTempFile(t, src, "dir/file", "0123456789abcdefghijklmnopqrstuvwxyz")
+	writeTempFile(t, src, "other", "foo")
+	defer chdir(t, src)()
+
+	for _, tc := range []struct {
+		description              string
+		wantUploaded, wantReused int64
+	}{
+		{"first backup", 2, 0},
+		{"unchanged backup", 0, 2},
+	} {
+		recorder := &progressRecorder{}
+		opts := BackupOptions{ChunkBytes: 4096, Progress: recorder.report, ProgressInterval: time.Millisecond}
+		if _, err := repo.Backup(context.Background(), []string{"."}, opts); err != nil {
+			t.Fatal(err)
+		}
+		want := Progress{TotalFiles: 2, TotalBytes: 39, Files: 2, Bytes: 39, ChunksUploaded: tc.wantUploaded, ChunksReused: tc.wantReused, Done: true}
+		got := recorder.last
+		got.Elapsed = 0
+		if got != want || recorder.dones != 1 {
+			t.Errorf("%v: want %+v got %+v (%d done reports)", tc.description, want, got, recorder.dones)
+		}
+	}
+
+	dst := makeTempDir(t)
+	defer os.RemoveAll(dst)
+	defer chdir(t, dst)()
+	recorder := &progressRecorder{}
+	if _, err := repo.Restore(context.Background(), []string{"."}, RestoreOptions{Progress: recorder.report}); err != nil {
+		t.Fatal(err)
+	}
+	want := Progress{TotalFiles: 2, TotalBytes: 39, Files: 2, Bytes: 39, Done: true}
+	got := recorder.last
+	got.Elapsed = 0
+	if got != want || recorder.dones != 1 {
+		t.Errorf("restore: want %+v got %+v (%d done reports)", want, got, recorder.dones)
+	}
+}
+
+func TestProgressETA(t *testing.T) {
+	p := Progress{TotalBytes: 300, Bytes: 100, Elapsed: 2 * time.Second}
+	if got := p.BytesPerSecond(); got != 50 {
+		t.Errorf("bytes per second: want 50 got %v", got)
+	}
+	if eta, ok := p.ETA(); !ok || eta != 4*time.Second {
+		t.Errorf("eta: want 4s got %v, %v", eta, ok)
+	}
+	if _, ok := (Progress{Bytes: 100, Elapsed: time.Second}).ETA(); ok {
+		t.Errorf("eta without total: want not ok")
+	}
+	if eta, ok := (Progress{TotalBytes: 100, Bytes: 150, Elapsed: time.Second}).ETA(); !ok || eta != 0 {
+		t.Errorf("eta past total: want 0 got %v, %v", eta, ok)
+	}
+}
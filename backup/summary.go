@@ -0,0 +1,93 @@
+package backup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/illicitonion/cloudbackup/meta"
+)
+
+// Summary describes a run of Backup, BackupStream or Restore once it has finished.
+// The summary of each backup is stored with the metadata it produced; see Summaries.
+type Summary struct {
+	Start time.Time
+	// Duration is how long the run took. The duration stored with a backup's metadata doesn't include the time taken to store the metadata.
+	Duration time.Duration
+	// FilesScanned counts the files backed up or restored. When backing up, those which were backed up are each counted as new (not
+	// previously backed up at their path), changed, or unchanged (including their metadata).
+	FilesScanned   int64
+	FilesNew       int64
+	FilesChanged   int64
+	FilesUnchanged int64
+	// FilesDeleted counts files which were previously backed up under the paths being backed up, but which no longer exist (or are now excluded).
+	// Their entries are kept, so they can still be restored.
+	FilesDeleted int64
+	// BytesRead counts the bytes of files read when backing up, and BytesWritten those written when restoring.
+	BytesRead    int64
+	BytesWritten int64
+	// ChunksUploaded counts the chunks of files (and any decoys) uploaded, not including those of the metadata. ChunksDeduplicated counts those which weren't,
+	// because they were unchanged since the file was last backed up, or were already in the chunk store.
+	ChunksUploaded     int64
+	ChunksDeduplicated int64
+	// MetadataBytes is the size of the metadata database after the backup.
+	MetadataBytes int64
+}
+
+// backupSummary summarizes a backup whose progress was counted by progress, which stored chunks as described by stats, and whose metadata
+// database is at metaFile.
+func backupSummary(progress *progressTracker, stats BackupStats, metaFile string) Summary {
+	s := Summary{
+		Start:              progress.start,
+		Duration:           time.Since(progress.start),
+		FilesScanned:       atomic.LoadInt64(&progress.files),
+		FilesNew:           atomic.LoadInt64(&progress.newFiles),
+		FilesChanged:       atomic.LoadInt64(&progress.changedFiles),
+		FilesUnchanged:     atomic.LoadInt64(&progress.unchangedFiles),
+		FilesDeleted:       atomic.LoadInt64(&progress.deletedFiles),
+		BytesRead:          atomic.LoadInt64(&progress.bytes),
+		ChunksUploaded:     int64(stats.ChunksUploaded),
+		ChunksDeduplicated: atomic.LoadInt64(&progress.reused) + int64(stats.ChunksAlreadyStored),
+	}
+	if fi, err := os.Stat(metaFile); err == nil {
+		s.MetadataBytes = fi.Size()
+	}
+	return s
+}
+
+// restoreSummary summarizes a restore whose progress was counted by progress.
+func restoreSummary(progress *progressTracker) Summary {
+	return Summary{
+		Start:        progress.start,
+		Duration:     time.Since(progress.start),
+		FilesScanned: atomic.LoadInt64(&progress.files),
+		BytesWritten: atomic.LoadInt64(&progress.bytes),
+	}
+}
+
+// countDeleted counts the files recorded in db under root which weren't seen when it was walked.
+func countDeleted(db *meta.DB, root string, seen map[string]bool) int64 {
+	var deleted int64
+	// Nothing is recorded under a root which has never been backed up, so errors just mean nothing was deleted.
+	db.Walk(filepath.Clean(root), func(path string, e meta.Entry) error {
+		if !e.Mode.IsDir() && !seen[path] {
+			deleted++
+		}
+		return nil
+	})
+	return deleted
+}
+
+// Summaries returns the summaries of the backups which stored each version of the metadata, newest first.
+// Versions stored other than by backing up, or before summaries were recorded, are skipped.
+func (r *Repository) Summaries(ctx context.Context) ([]Summary, error) {
+	var summaries []Summary
+	err := r.walkRoots(ctx, func(root *root) {
+		if root.Summary != nil {
+			summaries = append(summaries, *root.Summary)
+		}
+	})
+	return summaries, err
+}
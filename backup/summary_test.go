@@ -0,0 +1,74 @@
+package backup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRepositorySummary(t *testing.T) {
+	repo := makeRepository(t)
+	src := makeTempDir(t)
+	defer os.RemoveAll(src)
+	if err := os.Mkdir(filepath.Join(src, "dir"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	writeTempFile(t, src, "dir/file", "0123456789")
+	writeTempFile(t, src, "changed", "foo")
+	writeTempFile(t, src, "deleted", "bar")
+	defer chdir(t, src)()
+
+	opts := BackupOptions{ChunkBytes: 4096}
+	stats, err := repo.Backup(context.Background(), []string{"."}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := stats.Summary
+	if want := (Summary{FilesScanned: 3, FilesNew: 3, BytesRead: 16, ChunksUploaded: 3}); !sameCounts(first, want) {
+		t.Errorf("first backup: want %+v got %+v", want, first)
+	}
+	if first.Start.IsZero() || first.Duration <= 0 || first.MetadataBytes <= 0 {
+		t.Errorf("first backup: want start, duration and metadata size, got %+v", first)
+	}
+
+	writeTempFile(t, src, "changed", "foobaz")
+	writeTempFile(t, src, "new", "quux")
+	if err := os.Remove(filepath.Join(src, "deleted")); err != nil {
+		t.Fatal(err)
+	}
+	stats, err = repo.Backup(context.Background(), []string{"."}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := stats.Summary
+	if want := (Summary{FilesScanned: 3, FilesNew: 1, FilesChanged: 1, FilesUnchanged: 1, FilesDeleted: 1, BytesRead: 20, ChunksUploaded: 2, ChunksDeduplicated: 1}); !sameCounts(second, want) {
+		t.Errorf("second backup: want %+v got %+v", want, second)
+	}
+
+	summaries, err := repo.Summaries(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(summaries) != 2 || !sameCounts(summaries[0], second) || !sameCounts(summaries[1], first) || !summaries[1].Start.Equal(first.Start) {
+		t.Errorf("summaries: want second then first backup, got %+v", summaries)
+	}
+
+	dst := makeTempDir(t)
+	defer os.RemoveAll(dst)
+	defer chdir(t, dst)()
+	restored, err := repo.Restore(context.Background(), []string{"."}, RestoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The deleted file's entry is kept, so it is restored too.
+	if want := (Summary{FilesScanned: 4, BytesWritten: 23}); !sameCounts(restored, want) {
+		t.Errorf("restore: want %+v got %+v", want, restored)
+	}
+}
+
+// sameCounts reports whether a and b have the same counts, ignoring when they ran, and the size of the metadata.
+func sameCounts(a, b Summary) bool {
+	a.Start, a.Duration, a.MetadataBytes = b.Start, b.Duration, b.MetadataBytes
+	return a == b
+}
@@ -0,0 +1,35 @@
+// Package chunkstore defines the interface implemented by every backend which encrypted chunks can be stored in.
+package chunkstore
+
+import (
+	"context"
+	"time"
+)
+
+// ChunkStore stores named blobs: encrypted chunks named by the hex-encoded HMAC of their contents, as well as the "meta" pointer.
+//
+// Methods which are given the name of a blob which does not exist return an error for which os.IsNotExist returns true.
+type ChunkStore interface {
+	Read(ctx context.Context, name string) ([]byte, error)
+	// Save stores contents under name, overwriting anything already stored there.
+	Save(ctx context.Context, name string, contents []byte) error
+	Exists(ctx context.Context, name string) (bool, error)
+	// List calls fn with the name of each blob whose name starts with prefix, in no particular order.
+	// If fn returns an error, listing stops and that error is returned.
+	List(ctx context.Context, prefix string, fn func(name string) error) error
+	Delete(ctx context.Context, name string) error
+	Stat(ctx context.Context, name string) (Info, error)
+
+	// ReadVersion is like Read, but also returns the version of the blob which was read, for use with SaveIfVersion.
+	// Versions are opaque, and are never zero.
+	ReadVersion(ctx context.Context, name string) ([]byte, int64, error)
+	// SaveIfVersion is like Save, but only stores contents if the version of the blob currently stored under name is version,
+	// or, if version is zero, if nothing is stored under name. Otherwise, it returns ErrVersionMismatch.
+	SaveIfVersion(ctx context.Context, name string, contents []byte, version int64) error
+}
+
+type Info struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
@@ -0,0 +1,265 @@
+// Package chunkstoretest is a conformance test suite which every chunkstore.ChunkStore implementation should pass.
+package chunkstoretest
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/illicitonion/cloudbackup/chunkstore"
+)
+
+// Run runs the conformance tests against stores made by newStore, which must return an empty ChunkStore each time it is called,
+// along with a function to clean it up afterwards.
+func Run(t *testing.T, newStore func(t *testing.T) (chunkstore.ChunkStore, func())) {
+	for _, tc := range []struct {
+		name string
+		fn   func(*testing.T, chunkstore.ChunkStore)
+	}{
+		{"ReadMissing", testReadMissing},
+		{"SaveThenRead", testSaveThenRead},
+		{"SaveOverwrites", testSaveOverwrites},
+		{"Exists", testExists},
+		{"Stat", testStat},
+		{"StatMissing", testStatMissing},
+		{"List", testList},
+		{"ListStopsOnError", testListStopsOnError},
+		{"Delete", testDelete},
+		{"DeleteMissing", testDeleteMissing},
+		{"CancelledContext", testCancelledContext},
+		{"ReadVersionMissing", testReadVersionMissing},
+		{"SaveIfVersionCreates", testSaveIfVersionCreates},
+		{"SaveIfVersionMatching", testSaveIfVersionMatching},
+		{"SaveIfVersionStale", testSaveIfVersionStale},
+	} {
+		fn := tc.fn
+		t.Run(tc.name, func(t *testing.T) {
+			s, cleanup := newStore(t)
+			defer cleanup()
+			fn(t, s)
+		})
+	}
+}
+
+var (
+	name1 = "500002b7d895d882170ea0823388708be81ca5f5f64f2c358e6cb7ee7ca16e37"
+	name2 = "50ffc1e2bf0dbdd8d27b4a8d33d0bd0b0e08b43e7c43ad12b3bcd2c2e1bb6b0e"
+	name3 = "bfda79581f572a70cd481efb63ef6f07e52f3e45afb21ca35a452a3e49e77e4b"
+
+	contents1 = []byte{0x09, 0xB3, 0x76, 0x13, 0x6D, 0x0B, 0xF6, 0x2E}
+	contents2 = []byte{0x87, 0x6B, 0x7D, 0xE4, 0xE8, 0xFF, 0xD0, 0x59, 0xF0, 0x79, 0x30, 0x9E}
+)
+
+func testReadMissing(t *testing.T, s chunkstore.ChunkStore) {
+	if _, err := s.Read(context.Background(), name1); !os.IsNotExist(err) {
+		t.Errorf("err: want not exist got %v", err)
+	}
+}
+
+func testSaveThenRead(t *testing.T, s chunkstore.ChunkStore) {
+	save(t, s, name1, contents1)
+	got, err := s.Read(context.Background(), name1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, contents1) {
+		t.Errorf("want % X got % X", contents1, got)
+	}
+}
+
+func testSaveOverwrites(t *testing.T, s chunkstore.ChunkStore) {
+	save(t, s, "meta", contents1)
+	save(t, s, "meta", contents2)
+	got, err := s.Read(context.Background(), "meta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, contents2) {
+		t.Errorf("want % X got % X", contents2, got)
+	}
+}
+
+func testExists(t *testing.T, s chunkstore.ChunkStore) {
+	exists, err := s.Exists(context.Background(), name1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Errorf("before save: want false got true")
+	}
+	save(t, s, name1, contents1)
+	exists, err = s.Exists(context.Background(), name1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists {
+		t.Errorf("after save: want true got false")
+	}
+}
+
+func testStat(t *testing.T, s chunkstore.ChunkStore) {
+	save(t, s, name2, contents2)
+	info, err := s.Stat(context.Background(), name2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != name2 {
+		t.Errorf("name: want %v got %v", name2, info.Name)
+	}
+	if want := int64(len(contents2)); info.Size != want {
+		t.Errorf("size: want %v got %v", want, info.Size)
+	}
+	if info.ModTime.IsZero() {
+		t.Errorf("mod time: want non-zero got zero")
+	}
+}
+
+func testStatMissing(t *testing.T, s chunkstore.ChunkStore) {
+	if _, err := s.Stat(context.Background(), name1); !os.IsNotExist(err) {
+		t.Errorf("err: want not exist got %v", err)
+	}
+}
+
+func testList(t *testing.T, s chunkstore.ChunkStore) {
+	save(t, s, name1, contents1)
+	save(t, s, name2, contents1)
+	save(t, s, name3, contents1)
+
+	for prefix, want := range map[string][]string{
+		"":     []string{name1, name2, name3},
+		"50":   []string{name1, name2},
+		"5000": []string{name1},
+		"ff":   nil,
+	} {
+		var got []string
+		if err := s.List(context.Background(), prefix, func(name string) error {
+			got = append(got, name)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(want, got) {
+			t.Errorf("prefix %q: want %v got %v", prefix, want, got)
+		}
+	}
+}
+
+func testListStopsOnError(t *testing.T, s chunkstore.ChunkStore) {
+	save(t, s, name1, contents1)
+	save(t, s, name2, contents1)
+
+	wantErr := os.ErrInvalid
+	calls := 0
+	err := s.List(context.Background(), "", func(name string) error {
+		calls++
+		return wantErr
+	})
+	if err != wantErr {
+		t.Errorf("err: want %v got %v", wantErr, err)
+	}
+	if calls != 1 {
+		t.Errorf("calls: want 1 got %v", calls)
+	}
+}
+
+func testDelete(t *testing.T, s chunkstore.ChunkStore) {
+	save(t, s, name1, contents1)
+	save(t, s, name2, contents2)
+	if err := s.Delete(context.Background(), name1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Read(context.Background(), name1); !os.IsNotExist(err) {
+		t.Errorf("deleted: want not exist got %v", err)
+	}
+	if _, err := s.Read(context.Background(), name2); err != nil {
+		t.Errorf("not deleted: want nil got %v", err)
+	}
+}
+
+func testDeleteMissing(t *testing.T, s chunkstore.ChunkStore) {
+	if err := s.Delete(context.Background(), name1); !os.IsNotExist(err) {
+		t.Errorf("err: want not exist got %v", err)
+	}
+}
+
+func testCancelledContext(t *testing.T, s chunkstore.ChunkStore) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.Save(ctx, name1, contents1); err == nil {
+		t.Errorf("save: want error got nil")
+	}
+	if _, err := s.Read(ctx, name1); err == nil {
+		t.Errorf("read: want error got nil")
+	}
+}
+
+func testReadVersionMissing(t *testing.T, s chunkstore.ChunkStore) {
+	if _, _, err := s.ReadVersion(context.Background(), "meta"); !os.IsNotExist(err) {
+		t.Errorf("err: want not exist got %v", err)
+	}
+}
+
+func testSaveIfVersionCreates(t *testing.T, s chunkstore.ChunkStore) {
+	if err := s.SaveIfVersion(context.Background(), "meta", contents1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveIfVersion(context.Background(), "meta", contents2, 0); err != chunkstore.ErrVersionMismatch {
+		t.Errorf("second create: want %v got %v", chunkstore.ErrVersionMismatch, err)
+	}
+	got, version, err := s.ReadVersion(context.Background(), "meta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, contents1) {
+		t.Errorf("want % X got % X", contents1, got)
+	}
+	if version == 0 {
+		t.Errorf("version: want non-zero got zero")
+	}
+}
+
+func testSaveIfVersionMatching(t *testing.T, s chunkstore.ChunkStore) {
+	save(t, s, "meta", contents1)
+	_, version, err := s.ReadVersion(context.Background(), "meta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveIfVersion(context.Background(), "meta", contents2, version); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.Read(context.Background(), "meta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, contents2) {
+		t.Errorf("want % X got % X", contents2, got)
+	}
+}
+
+func testSaveIfVersionStale(t *testing.T, s chunkstore.ChunkStore) {
+	save(t, s, "meta", contents1)
+	_, version, err := s.ReadVersion(context.Background(), "meta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	save(t, s, "meta", contents2)
+	if err := s.SaveIfVersion(context.Background(), "meta", contents1, version); err != chunkstore.ErrVersionMismatch {
+		t.Errorf("want %v got %v", chunkstore.ErrVersionMismatch, err)
+	}
+	got, err := s.Read(context.Background(), "meta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, contents2) {
+		t.Errorf("want % X got % X", contents2, got)
+	}
+}
+
+func save(t *testing.T, s chunkstore.ChunkStore, name string, contents []byte) {
+	if err := s.Save(context.Background(), name, contents); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,26 @@
+package chunkstore
+
+import "errors"
+
+// ErrVersionMismatch is returned by SaveIfVersion if the blob has been changed since its version was read.
+var ErrVersionMismatch = errors.New("chunkstore: version mismatch")
+
+// TransientError is returned by a ChunkStore for failures which may not recur if the operation is retried, e.g. timeouts or server errors.
+// Any other error should be assumed to be permanent.
+type TransientError struct {
+	Err error
+}
+
+func (e *TransientError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *TransientError) Unwrap() error {
+	return e.Err
+}
+
+// IsTransient returns whether err is, or wraps, a *TransientError.
+func IsTransient(err error) bool {
+	var transient *TransientError
+	return errors.As(err, &transient)
+}
@@ -0,0 +1,25 @@
+package chunkstore
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestIsTransient(t *testing.T) {
+	transient := &TransientError{Err: errors.New("server error")}
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{transient, true},
+		{fmt.Errorf("saving chunk: %w", transient), true},
+		{errors.New("permission denied"), false},
+		{fmt.Errorf("saving chunk: %v", transient), false},
+		{nil, false},
+	} {
+		if got := IsTransient(tc.err); got != tc.want {
+			t.Errorf("%v: want %v got %v", tc.err, tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/illicitonion/cloudbackup/backup"
+	"github.com/illicitonion/cloudbackup/crypto"
+	"github.com/illicitonion/cloudbackup/daemon"
+	"github.com/illicitonion/cloudbackup/metrics"
+	"github.com/illicitonion/cloudbackup/retry"
+)
+
+// runDaemon runs the backups configured in the file at configPath on their schedules, serving metrics about them, until it is interrupted.
+func runDaemon(configPath string) {
+	f, err := os.Open(configPath)
+	if err != nil {
+		log.Fatal("Error opening config: ", err)
+	}
+	config, err := daemon.ParseConfig(f)
+	f.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	keyBytes, err := ioutil.ReadFile(config.KeyFile)
+	if err != nil {
+		log.Fatal("Error reading key file: ", err)
+	}
+	keys := crypto.ReadKeys(keyBytes)
+
+	registry := &metrics.Registry{}
+	m := daemon.NewMetrics(registry)
+
+	chunkStore, err := parseChunkSpec(config.ChunkSpec, keys)
+	if err != nil {
+		log.Fatal("Error parsing chunk spec: ", err)
+	}
+	// Errors are counted beneath retries, so that transient errors which were retried still show up.
+	chunkStore = &metrics.ChunkStore{
+		Store:   chunkStore,
+		Backend: strings.SplitN(config.ChunkSpec, ":", 2)[0],
+		Errors:  m.ChunkStoreErrors,
+	}
+	if chunkStore, err = limitChunkStore(chunkStore, config.LimitUpload, config.LimitDownload, config.LimitSchedule); err != nil {
+		log.Fatal(err)
+	}
+	chunkStore = &retry.ChunkStore{
+		Store:    chunkStore,
+		Attempts: config.Attempts,
+		Backoff:  time.Duration(config.RetryBackoff),
+	}
+
+	repo, err := backup.NewRepository(keys["Encryption"], keys["Authentication"], chunkStore, "")
+	if err == backup.ErrBadKeys {
+		fatal("Bad keys: Want each to be 256 bits", false)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	repo.SetMetadataCache(config.MetadataCache)
+
+	if config.Listen != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", registry)
+		go func() {
+			log.Fatal(http.ListenAndServe(config.Listen, mux))
+		}()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		s := <-signals
+		fmt.Fprintf(os.Stderr, "Got %v, stopping\n", s)
+		cancel()
+	}()
+
+	daemon.New(repo, config.Jobs, m).Run(ctx)
+}
@@ -0,0 +1,148 @@
+package daemon
+
+import (
+	"crypto/aes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"time"
+
+	"github.com/illicitonion/cloudbackup/backup"
+)
+
+// Config configures a daemon. It is read from a JSON object with the fields' json names, e.g.
+//
+//	{
+//	  "key_file": "/etc/cloudbackup/keys.pem",
+//	  "chunkspec": "gcs:/etc/cloudbackup/gcs.json:bucket-name",
+//	  "listen": ":9184",
+//	  "metadata_cache": "/var/cache/cloudbackup",
+//	  "jobs": [
+//	    {"name": "home", "schedule": "30 2 * * *", "dir": "/home", "chunk_bytes": 2097152, "exclude_names": [".cache"]}
+//	  ]
+//	}
+type Config struct {
+	// KeyFile and ChunkSpec are as the --key-file and --chunkspec flags.
+	KeyFile   string `json:"key_file"`
+	ChunkSpec string `json:"chunkspec"`
+	// Listen is the address to serve metrics on, at /metrics. If empty, metrics aren't served.
+	Listen string `json:"listen"`
+	// Attempts, RetryBackoff, LimitUpload, LimitDownload, LimitSchedule and MetadataCache are as the flags of the same names. RetryBackoff is a duration, e.g. "2s".
+	Attempts      int      `json:"attempts"`
+	RetryBackoff  Duration `json:"retry_backoff"`
+	LimitUpload   string   `json:"limit_upload"`
+	LimitDownload string   `json:"limit_download"`
+	LimitSchedule string   `json:"limit_schedule"`
+	MetadataCache string   `json:"metadata_cache"`
+	Jobs          []Job    `json:"jobs"`
+}
+
+// Job is a backup run on a schedule. Its options are as the encrypt subcommand's flags of the same names.
+type Job struct {
+	// Name identifies the job in logs and metrics.
+	Name string `json:"name"`
+	// Schedule is when to run, as accepted by ParseSchedule.
+	Schedule string `json:"schedule"`
+	// Dir is the absolute path of the directory to back up from; paths are stored relative to it, as if encrypt were run in it.
+	Dir string `json:"dir"`
+	// Paths are the relative paths in Dir to back up. If empty, the whole of Dir is backed up.
+	Paths []string `json:"paths"`
+
+	ChunkBytes      int      `json:"chunk_bytes"`
+	Reupload        bool     `json:"reupload"`
+	SkipExisting    bool     `json:"skip_existing"`
+	PadChunks       bool     `json:"pad_chunks"`
+	PadChunkQuantum int      `json:"pad_chunk_quantum"`
+	PadMetadata     bool     `json:"pad_metadata"`
+	ExcludeNames    []string `json:"exclude_names"`
+	MaxFileSize     int64    `json:"max_file_size"`
+	OneFileSystem   bool     `json:"one_file_system"`
+	ExcludeCaches   bool     `json:"exclude_caches"`
+
+	schedule *Schedule
+}
+
+// Duration is a time.Duration which is read from JSON as a string, e.g. "1m30s".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string, e.g. \"1m30s\", got %s", b)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// ParseConfig reads a Config from r, and checks that it is complete and that each job's schedule and paths are valid.
+func ParseConfig(r io.Reader) (*Config, error) {
+	var c Config
+	if err := json.NewDecoder(r).Decode(&c); err != nil {
+		return nil, fmt.Errorf("daemon: error parsing config: %v", err)
+	}
+	if c.KeyFile == "" || c.ChunkSpec == "" {
+		return nil, fmt.Errorf("daemon: config needs key_file and chunkspec")
+	}
+	if len(c.Jobs) == 0 {
+		return nil, fmt.Errorf("daemon: config has no jobs")
+	}
+	names := make(map[string]bool)
+	for i := range c.Jobs {
+		job := &c.Jobs[i]
+		if job.Name == "" || names[job.Name] {
+			return nil, fmt.Errorf("daemon: each job needs a unique name, got %q", job.Name)
+		}
+		names[job.Name] = true
+		if err := job.check(); err != nil {
+			return nil, fmt.Errorf("daemon: job %q: %v", job.Name, err)
+		}
+	}
+	return &c, nil
+}
+
+func (j *Job) check() error {
+	schedule, err := ParseSchedule(j.Schedule)
+	if err != nil {
+		return err
+	}
+	j.schedule = schedule
+	if !filepath.IsAbs(j.Dir) {
+		return fmt.Errorf("dir must be absolute, got %q", j.Dir)
+	}
+	for _, path := range j.Paths {
+		if path == "" || filepath.IsAbs(path) {
+			return fmt.Errorf("paths must be relative, got %q", path)
+		}
+	}
+	if j.ChunkBytes <= 0 || j.ChunkBytes%aes.BlockSize != 0 {
+		return fmt.Errorf("need chunk_bytes greater than zero, and a multiple of %v, got %v", aes.BlockSize, j.ChunkBytes)
+	}
+	return nil
+}
+
+func (j *Job) paths() []string {
+	if len(j.Paths) == 0 {
+		return []string{"."}
+	}
+	return j.Paths
+}
+
+func (j *Job) backupOptions() backup.BackupOptions {
+	return backup.BackupOptions{
+		ChunkBytes:      j.ChunkBytes,
+		Reupload:        j.Reupload,
+		SkipExisting:    j.SkipExisting,
+		PadChunks:       j.PadChunks,
+		PadChunkQuantum: j.PadChunkQuantum,
+		PadMetadata:     j.PadMetadata,
+		ExcludeNames:    j.ExcludeNames,
+		MaxFileSize:     j.MaxFileSize,
+		OneFileSystem:   j.OneFileSystem,
+		ExcludeCaches:   j.ExcludeCaches,
+	}
+}
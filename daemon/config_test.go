@@ -0,0 +1,66 @@
+package daemon
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/illicitonion/cloudbackup/backup"
+)
+
+func TestParseConfig(t *testing.T) {
+	c, err := ParseConfig(strings.NewReader(`{
+		"key_file": "/keys.pem",
+		"chunkspec": "local:/chunks",
+		"listen": ":9184",
+		"retry_backoff": "2s",
+		"metadata_cache": "/var/cache/cloudbackup",
+		"jobs": [
+			{"name": "home", "schedule": "30 2 * * *", "dir": "/home", "chunk_bytes": 4096, "exclude_names": [".cache"]},
+			{"name": "etc", "schedule": "@hourly", "dir": "/", "paths": ["etc"], "chunk_bytes": 4096, "reupload": true, "skip_existing": true}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.KeyFile != "/keys.pem" || c.ChunkSpec != "local:/chunks" || c.Listen != ":9184" || time.Duration(c.RetryBackoff) != 2*time.Second || c.MetadataCache != "/var/cache/cloudbackup" || len(c.Jobs) != 2 {
+		t.Fatalf("got %+v", c)
+	}
+
+	home, etc := &c.Jobs[0], &c.Jobs[1]
+	if want := []string{"."}; !reflect.DeepEqual(home.paths(), want) {
+		t.Errorf("home paths: want %v got %v", want, home.paths())
+	}
+	if want := (backup.BackupOptions{ChunkBytes: 4096, ExcludeNames: []string{".cache"}}); !reflect.DeepEqual(home.backupOptions(), want) {
+		t.Errorf("home options: want %+v got %+v", want, home.backupOptions())
+	}
+	if want := []string{"etc"}; !reflect.DeepEqual(etc.paths(), want) {
+		t.Errorf("etc paths: want %v got %v", want, etc.paths())
+	}
+	if opts := etc.backupOptions(); !opts.Reupload || !opts.SkipExisting {
+		t.Errorf("etc options: want Reupload and SkipExisting, got %+v", opts)
+	}
+	if etc.schedule == nil {
+		t.Error("etc: want schedule to be parsed")
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	for _, config := range []string{
+		`not json`,
+		`{"chunkspec": "local:/chunks", "jobs": [{"name": "a", "schedule": "@daily", "dir": "/", "chunk_bytes": 4096}]}`,
+		`{"key_file": "/keys.pem", "chunkspec": "local:/chunks"}`,
+		`{"key_file": "/keys.pem", "chunkspec": "local:/chunks", "jobs": [{"schedule": "@daily", "dir": "/", "chunk_bytes": 4096}]}`,
+		`{"key_file": "/keys.pem", "chunkspec": "local:/chunks", "jobs": [{"name": "a", "schedule": "@daily", "dir": "/", "chunk_bytes": 4096}, {"name": "a", "schedule": "@daily", "dir": "/", "chunk_bytes": 4096}]}`,
+		`{"key_file": "/keys.pem", "chunkspec": "local:/chunks", "jobs": [{"name": "a", "schedule": "daily", "dir": "/", "chunk_bytes": 4096}]}`,
+		`{"key_file": "/keys.pem", "chunkspec": "local:/chunks", "jobs": [{"name": "a", "schedule": "@daily", "dir": "home", "chunk_bytes": 4096}]}`,
+		`{"key_file": "/keys.pem", "chunkspec": "local:/chunks", "jobs": [{"name": "a", "schedule": "@daily", "dir": "/", "paths": ["/etc"], "chunk_bytes": 4096}]}`,
+		`{"key_file": "/keys.pem", "chunkspec": "local:/chunks", "jobs": [{"name": "a", "schedule": "@daily", "dir": "/", "chunk_bytes": 100}]}`,
+		`{"key_file": "/keys.pem", "chunkspec": "local:/chunks", "retry_backoff": 5, "jobs": [{"name": "a", "schedule": "@daily", "dir": "/", "chunk_bytes": 4096}]}`,
+	} {
+		if _, err := ParseConfig(strings.NewReader(config)); err == nil {
+			t.Errorf("%s: want error", config)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package daemon
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleNext(t *testing.T) {
+	// A Wednesday.
+	from := time.Date(2017, 5, 31, 14, 7, 30, 0, time.UTC)
+	for _, tc := range []struct {
+		spec string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2017, 5, 31, 14, 8, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2017, 5, 31, 14, 15, 0, 0, time.UTC)},
+		{"30 2 * * *", time.Date(2017, 6, 1, 2, 30, 0, 0, time.UTC)},
+		{"0 9-17/4 * * *", time.Date(2017, 5, 31, 17, 0, 0, 0, time.UTC)},
+		{"0 0 * * 0", time.Date(2017, 6, 4, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2017, 6, 4, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1,15 * *", time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// As in cron, restricting both day of month and day of week matches either.
+		{"0 0 15 * 5", time.Date(2017, 6, 2, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2017, 5, 31, 15, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	} {
+		s, err := ParseSchedule(tc.spec)
+		if err != nil {
+			t.Errorf("%q: %v", tc.spec, err)
+			continue
+		}
+		if got := s.Next(from); !got.Equal(tc.want) {
+			t.Errorf("%q: want %v got %v", tc.spec, tc.want, got)
+		}
+	}
+}
+
+func TestParseScheduleErrors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+	} {
+		if _, err := ParseSchedule(spec); err == nil {
+			t.Errorf("%q: want error", spec)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+// Package daemon runs backups on schedules, and records metrics about them.
+package daemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/illicitonion/cloudbackup/backup"
+	"github.com/illicitonion/cloudbackup/metrics"
+)
+
+// ErrBusy is returned by RunJob if another job is already running.
+var ErrBusy = errors.New("daemon: another job is running")
+
+// Metrics are the metrics recorded by a Daemon. Each is labelled by job, except ChunkStoreErrors, which is labelled by backend and op
+// (for use by metrics.ChunkStore), and the repository's size, which is recorded after each successful run.
+type Metrics struct {
+	Runs             *metrics.Family
+	LastSuccess      *metrics.Family
+	LastDuration     *metrics.Family
+	NextRun          *metrics.Family
+	SkippedFiles     *metrics.Family
+	BytesUploaded    *metrics.Family
+	ChunksUploaded   *metrics.Family
+	ChunkStoreErrors *metrics.Family
+	RepositoryFiles  *metrics.Family
+	RepositoryBytes  *metrics.Family
+	RepositoryChunks *metrics.Family
+	MetadataBytes    *metrics.Family
+}
+
+// NewMetrics registers the metrics recorded by a Daemon in r.
+func NewMetrics(r *metrics.Registry) *Metrics {
+	return &Metrics{
+		Runs:             r.Counter("cloudbackup_runs_total", "Scheduled backups run, by result: success, partial (some files were skipped), failure, or busy (not run, as another was running).", "job", "result"),
+		LastSuccess:      r.Gauge("cloudbackup_last_success_timestamp_seconds", "When the last successful (or partially successful) backup finished, in seconds since the Unix epoch.", "job"),
+		LastDuration:     r.Gauge("cloudbackup_last_duration_seconds", "How long the last backup took, whether or not it succeeded.", "job"),
+		NextRun:          r.Gauge("cloudbackup_next_run_timestamp_seconds", "When the next backup is scheduled, in seconds since the Unix epoch.", "job"),
+		SkippedFiles:     r.Gauge("cloudbackup_last_skipped_files", "Files which could not be backed up by the last backup.", "job"),
+		BytesUploaded:    r.Counter("cloudbackup_uploaded_bytes_total", "Bytes of chunks uploaded.", "job"),
+		ChunksUploaded:   r.Counter("cloudbackup_uploaded_chunks_total", "Chunks uploaded.", "job"),
+		ChunkStoreErrors: r.Counter("cloudbackup_chunkstore_errors_total", "Errors returned by the chunk store, including those which were retried.", "backend", "op"),
+		RepositoryFiles:  r.Gauge("cloudbackup_repository_files", "Files recorded in the repository's metadata."),
+		RepositoryBytes:  r.Gauge("cloudbackup_repository_bytes", "Total size of the files recorded in the repository's metadata."),
+		RepositoryChunks: r.Gauge("cloudbackup_repository_chunks", "Distinct chunks storing the files recorded in the repository's metadata."),
+		MetadataBytes:    r.Gauge("cloudbackup_metadata_bytes", "Size of the repository's metadata database."),
+	}
+}
+
+// Daemon runs jobs on their schedules, backing up to repo. Only one job runs at a time: a job which is due while another is running is skipped
+// until its next scheduled time.
+//
+// Jobs change the working directory of the process while they run, so nothing else in it should depend on the working directory.
+type Daemon struct {
+	repo    *backup.Repository
+	jobs    []Job
+	metrics *Metrics
+	// lock holds a value while a job is running.
+	lock chan struct{}
+}
+
+// New returns a Daemon which runs jobs, which must have been read by ParseConfig, recording metrics in m.
+func New(repo *backup.Repository, jobs []Job, m *Metrics) *Daemon {
+	return &Daemon{
+		repo:    repo,
+		jobs:    jobs,
+		metrics: m,
+		lock:    make(chan struct{}, 1),
+	}
+}
+
+// Run runs each job whenever it is scheduled, until ctx is done.
+func (d *Daemon) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := range d.jobs {
+		wg.Add(1)
+		go func(job *Job) {
+			defer wg.Done()
+			d.schedule(ctx, job)
+		}(&d.jobs[i])
+	}
+	wg.Wait()
+}
+
+func (d *Daemon) schedule(ctx context.Context, job *Job) {
+	for {
+		next := job.schedule.Next(time.Now())
+		if next.IsZero() {
+			log.Printf("Job %q: schedule %q never matches, so it will never run", job.Name, job.Schedule)
+			return
+		}
+		d.metrics.NextRun.Set(float64(next.Unix()), job.Name)
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if err := d.RunJob(ctx, job); err != nil {
+			log.Printf("Job %q: %v", job.Name, err)
+		}
+	}
+}
+
+// RunJob runs job now, unless another job is running, in which case ErrBusy is returned. If some files could not be backed up, the rest are,
+// and a *backup.PartialError is returned.
+func (d *Daemon) RunJob(ctx context.Context, job *Job) error {
+	select {
+	case d.lock <- struct{}{}:
+	default:
+		d.metrics.Runs.Add(1, job.Name, "busy")
+		return ErrBusy
+	}
+	defer func() { <-d.lock }()
+
+	start := time.Now()
+	stats, err := d.backup(ctx, job)
+	d.metrics.LastDuration.Set(time.Since(start).Seconds(), job.Name)
+	d.metrics.BytesUploaded.Add(float64(stats.BytesUploaded), job.Name)
+	d.metrics.ChunksUploaded.Add(float64(stats.ChunksUploaded), job.Name)
+
+	partial, isPartial := err.(*backup.PartialError)
+	switch {
+	case err == nil:
+		d.metrics.Runs.Add(1, job.Name, "success")
+		d.metrics.SkippedFiles.Set(0, job.Name)
+	case isPartial:
+		d.metrics.Runs.Add(1, job.Name, "partial")
+		d.metrics.SkippedFiles.Set(float64(len(partial.Skipped)), job.Name)
+	default:
+		d.metrics.Runs.Add(1, job.Name, "failure")
+		return err
+	}
+	d.metrics.LastSuccess.Set(float64(time.Now().Unix()), job.Name)
+	d.metrics.MetadataBytes.Set(float64(stats.Summary.MetadataBytes))
+	s := stats.Summary
+	log.Printf("Job %q: scanned %d files (%d new, %d changed, %d unchanged, %d deleted), uploaded %d chunks, in %v",
+		job.Name, s.FilesScanned, s.FilesNew, s.FilesChanged, s.FilesUnchanged, s.FilesDeleted, s.ChunksUploaded, s.Duration.Round(time.Millisecond))
+
+	size, sizeErr := d.repo.Size(ctx)
+	if sizeErr != nil {
+		log.Printf("Job %q: error measuring repository: %v", job.Name, sizeErr)
+	} else {
+		d.metrics.RepositoryFiles.Set(float64(size.Files))
+		d.metrics.RepositoryBytes.Set(float64(size.Bytes))
+		d.metrics.RepositoryChunks.Set(float64(size.Chunks))
+	}
+	return err
+}
+
+// backup backs up job's paths from its directory, changing the working directory to it for the duration.
+func (d *Daemon) backup(ctx context.Context, job *Job) (backup.BackupStats, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return backup.BackupStats{}, fmt.Errorf("error getting working directory: %v", err)
+	}
+	if err := os.Chdir(job.Dir); err != nil {
+		return backup.BackupStats{}, fmt.Errorf("error changing to %v: %v", job.Dir, err)
+	}
+	defer func() {
+		if err := os.Chdir(wd); err != nil {
+			log.Printf("Error changing back to %v: %v", wd, err)
+		}
+	}()
+	return d.repo.Backup(ctx, job.paths(), job.backupOptions())
+}
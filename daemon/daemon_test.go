@@ -0,0 +1,83 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/illicitonion/cloudbackup/backup"
+	"github.com/illicitonion/cloudbackup/memory"
+	"github.com/illicitonion/cloudbackup/metrics"
+)
+
+func TestRunJob(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudbackuptest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), []byte("foo"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo, err := backup.NewRepository(bytes.Repeat([]byte{0x02}, 32), bytes.Repeat([]byte{0x03}, 32), &memory.ChunkStore{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMetrics(&metrics.Registry{})
+	job := &Job{Name: "test", Schedule: "@daily", Dir: dir, ChunkBytes: 4096}
+	if err := job.check(); err != nil {
+		t.Fatal(err)
+	}
+	d := New(repo, []Job{*job}, m)
+
+	if err := d.RunJob(context.Background(), job); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.Getwd(); got != wd {
+		t.Errorf("want working directory restored to %v, got %v", wd, got)
+	}
+	if got := m.Runs.Value("test", "success"); got != 1 {
+		t.Errorf("successful runs: want 1 got %v", got)
+	}
+	if got := m.LastSuccess.Value("test"); got <= 0 {
+		t.Errorf("want last success time, got %v", got)
+	}
+	if got := m.ChunksUploaded.Value("test"); got < 1 {
+		t.Errorf("want chunks uploaded, got %v", got)
+	}
+	if files, bytes, chunks := m.RepositoryFiles.Value(), m.RepositoryBytes.Value(), m.RepositoryChunks.Value(); files != 1 || bytes != 3 || chunks != 1 {
+		t.Errorf("repository size: want 1 file, 3 bytes, 1 chunk, got %v, %v, %v", files, bytes, chunks)
+	}
+	if got := m.MetadataBytes.Value(); got <= 0 {
+		t.Errorf("want metadata size, got %v", got)
+	}
+
+	// Runs never overlap.
+	d.lock <- struct{}{}
+	if err := d.RunJob(context.Background(), job); err != ErrBusy {
+		t.Errorf("while another job is running: want %v got %v", ErrBusy, err)
+	}
+	<-d.lock
+	if got := m.Runs.Value("test", "busy"); got != 1 {
+		t.Errorf("busy runs: want 1 got %v", got)
+	}
+
+	missing := &Job{Name: "missing", Schedule: "@daily", Dir: filepath.Join(dir, "missing"), ChunkBytes: 4096}
+	if err := d.RunJob(context.Background(), missing); err == nil {
+		t.Error("want error backing up missing directory")
+	}
+	if got := m.Runs.Value("missing", "failure"); got != 1 {
+		t.Errorf("failed runs: want 1 got %v", got)
+	}
+	if got := m.LastSuccess.Value("missing"); got != 0 {
+		t.Errorf("want no last success time, got %v", got)
+	}
+}
@@ -1,11 +1,17 @@
 package files
 
 import (
+	"bufio"
 	"fmt"
 	"io"
 )
 
+// ReadChunks returns a function which reads successive chunks of at most chunkSize bytes from f. If fileSize is negative, f is read until EOF.
 func ReadChunks(name string, f io.Reader, chunkSize int, fileSize int64) func() (read []byte, hasNext bool, err error) {
+	if fileSize < 0 {
+		return readChunksUntilEOF(name, f, chunkSize)
+	}
+
 	var alreadyRead int64
 
 	return func() ([]byte, bool, error) {
@@ -28,3 +34,29 @@ func ReadChunks(name string, f io.Reader, chunkSize int, fileSize int64) func()
 		return read, multipleChunksLeft, nil
 	}
 }
+
+func readChunksUntilEOF(name string, f io.Reader, chunkSize int) func() (read []byte, hasNext bool, err error) {
+	r := bufio.NewReader(f)
+
+	return func() ([]byte, bool, error) {
+		read := make([]byte, chunkSize)
+		n, err := io.ReadFull(r, read)
+		if err == io.EOF {
+			return nil, false, nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			return read[:n], false, nil
+		}
+		if err != nil {
+			return nil, false, fmt.Errorf("ReadChunks: could not read %v bytes from %v, read %v got error %v", chunkSize, name, n, err)
+		}
+
+		if _, err := r.Peek(1); err != nil {
+			if err == io.EOF {
+				return read, false, nil
+			}
+			return nil, false, fmt.Errorf("ReadChunks: could not read from %v: %v", name, err)
+		}
+		return read, true, nil
+	}
+}
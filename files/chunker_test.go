@@ -1,6 +1,7 @@
 package files
 
 import (
+	"bytes"
 	"io/ioutil"
 	"os"
 	"reflect"
@@ -142,6 +143,56 @@ func TestReadThreeChunks(t *testing.T) {
 	}
 }
 
+func TestReadUnknownSize(t *testing.T) {
+	for _, tc := range []struct {
+		chunkBytes int
+		want       [][]byte
+	}{
+		{10, [][]byte{abc}},
+		{3, [][]byte{abc}},
+		{2, [][]byte{abc[:2], abc[2:]}},
+		{1, [][]byte{abc[:1], abc[1:2], abc[2:]}},
+	} {
+		next := ReadChunks("", writeFile(t), tc.chunkBytes, -1)
+		for i, want := range tc.want {
+			read, hasNext, err := next()
+			if err != nil {
+				t.Errorf("chunkBytes %v chunk %v err: want nil, got %v", tc.chunkBytes, i, err)
+			}
+			if !reflect.DeepEqual(read, want) {
+				t.Errorf("chunkBytes %v chunk %v read: want % X got % X", tc.chunkBytes, i, want, read)
+			}
+			if wantHasNext := i < len(tc.want)-1; hasNext != wantHasNext {
+				t.Errorf("chunkBytes %v chunk %v hasNext: want %v got %v", tc.chunkBytes, i, wantHasNext, hasNext)
+			}
+		}
+
+		read, hasNext, err := next()
+		if err != nil {
+			t.Errorf("chunkBytes %v last err: want nil, got %v", tc.chunkBytes, err)
+		}
+		if read != nil {
+			t.Errorf("chunkBytes %v last read: want nil got % X", tc.chunkBytes, read)
+		}
+		if hasNext {
+			t.Errorf("chunkBytes %v last hasNext: want false got true", tc.chunkBytes)
+		}
+	}
+}
+
+func TestReadUnknownSizeEmpty(t *testing.T) {
+	read, hasNext, err := ReadChunks("", bytes.NewReader(nil), 10, -1)()
+	if err != nil {
+		t.Errorf("err: want nil, got %v", err)
+	}
+	if read != nil {
+		t.Errorf("read: want nil got % X", read)
+	}
+	if hasNext {
+		t.Errorf("hasNext: want false got true")
+	}
+}
+
 func readChunks(t *testing.T, chunkBytes int) func() (read []byte, hasNext bool, err error) {
 	return ReadChunks("", writeFile(t), chunkBytes, int64(len(abc)))
 }
@@ -1,18 +1,178 @@
 package files
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
 	"io/ioutil"
+	"os"
 	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/illicitonion/cloudbackup/chunkstore"
 )
 
 type ChunkStore struct {
 	RootDirectory string
 }
 
-func (b *ChunkStore) Read(hmac string) ([]byte, error) {
+func (b *ChunkStore) Read(ctx context.Context, hmac string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	return ioutil.ReadFile(filepath.Join(b.RootDirectory, hmac))
 }
 
-func (b *ChunkStore) Save(hmac string, contents []byte) error {
+func (b *ChunkStore) Save(ctx context.Context, hmac string, contents []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	return ioutil.WriteFile(filepath.Join(b.RootDirectory, hmac), contents, 0600)
 }
+
+// ReadVersion uses a hash of the contents of a blob as its version, so overwriting a blob with the same contents doesn't change its version.
+func (b *ChunkStore) ReadVersion(ctx context.Context, name string) ([]byte, int64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	unlock, err := b.lock(syscall.LOCK_SH)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer unlock()
+	contents, err := ioutil.ReadFile(filepath.Join(b.RootDirectory, name))
+	if err != nil {
+		return nil, 0, err
+	}
+	return contents, contentVersion(contents), nil
+}
+
+func (b *ChunkStore) SaveIfVersion(ctx context.Context, name string, contents []byte, version int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	unlock, err := b.lock(syscall.LOCK_EX)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	path := filepath.Join(b.RootDirectory, name)
+	var current int64
+	existing, err := ioutil.ReadFile(path)
+	if err == nil {
+		current = contentVersion(existing)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if current != version {
+		return chunkstore.ErrVersionMismatch
+	}
+
+	// Write to a temporary file and rename it into place, so that readers which don't take the lock never see a partially written blob.
+	f, err := ioutil.TempFile(b.RootDirectory, "."+name+".")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(contents); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+// lock takes an flock of the given type on the root directory, which is held until unlock is called.
+// Locks are advisory, so only guard against other conditional reads and saves, including those by other processes.
+func (b *ChunkStore) lock(how int) (unlock func(), err error) {
+	dir, err := os.Open(b.RootDirectory)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(dir.Fd()), how); err != nil {
+		dir.Close()
+		return nil, err
+	}
+	return func() {
+		syscall.Flock(int(dir.Fd()), syscall.LOCK_UN)
+		dir.Close()
+	}, nil
+}
+
+// contentVersion returns a non-zero version derived from contents.
+func contentVersion(contents []byte) int64 {
+	sum := sha256.Sum256(contents)
+	version := int64(binary.LittleEndian.Uint64(sum[:8]))
+	if version == 0 {
+		version = 1
+	}
+	return version
+}
+
+func (b *ChunkStore) Exists(ctx context.Context, hmac string) (bool, error) {
+	_, err := b.Stat(ctx, hmac)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (b *ChunkStore) List(ctx context.Context, prefix string, fn func(hmac string) error) error {
+	dir, err := os.Open(b.RootDirectory)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		names, err := dir.Readdirnames(1024)
+		for _, name := range names {
+			// Names starting with "." are temporary files written by SaveIfVersion.
+			if strings.HasPrefix(name, prefix) && !strings.HasPrefix(name, ".") {
+				if err := fn(name); err != nil {
+					return err
+				}
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (b *ChunkStore) Delete(ctx context.Context, hmac string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return os.Remove(filepath.Join(b.RootDirectory, hmac))
+}
+
+func (b *ChunkStore) Stat(ctx context.Context, hmac string) (chunkstore.Info, error) {
+	if err := ctx.Err(); err != nil {
+		return chunkstore.Info{}, err
+	}
+	fi, err := os.Stat(filepath.Join(b.RootDirectory, hmac))
+	if err != nil {
+		return chunkstore.Info{}, err
+	}
+	return chunkstore.Info{
+		Name:    hmac,
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+	}, nil
+}
@@ -0,0 +1,20 @@
+package files
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/illicitonion/cloudbackup/chunkstore"
+	"github.com/illicitonion/cloudbackup/chunkstore/chunkstoretest"
+)
+
+func TestChunkStoreConformance(t *testing.T) {
+	chunkstoretest.Run(t, func(t *testing.T) (chunkstore.ChunkStore, func()) {
+		dir, err := ioutil.TempDir("", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &ChunkStore{dir}, func() { os.RemoveAll(dir) }
+	})
+}
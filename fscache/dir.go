@@ -1,18 +1,71 @@
+// Package fscache caches lookups of users, groups and directories, which are repeated for every file backed up or restored.
 package fscache
 
-import "os"
+import (
+	"os"
+	"strings"
+	"sync"
+)
 
-var dirCache = make(map[string]bool)
+// Cache caches which directories exist, and lookups of users and groups. It is safe for concurrent use.
+// Only successful lookups are cached.
+type Cache struct {
+	lookup Lookup
 
-func Exists(path string) bool {
-	if dirCache[path] {
-		return true
+	mu     sync.Mutex
+	dirs   map[string]bool
+	users  map[string]uint32
+	uids   map[uint32]string
+	groups map[string]uint32
+	gids   map[uint32]string
+}
+
+// New returns an empty Cache which looks up users and groups using lookup.
+func New(lookup Lookup) *Cache {
+	return &Cache{
+		lookup: lookup,
+		dirs:   make(map[string]bool),
+		users:  make(map[string]uint32),
+		uids:   make(map[uint32]string),
+		groups: make(map[string]uint32),
+		gids:   make(map[uint32]string),
 	}
+}
 
-	_, err := os.Stat(path)
-	if err == nil {
-		dirCache[path] = true
+// Exists returns whether path exists. Paths which exist are remembered until they are forgotten with Forget.
+func (c *Cache) Exists(path string) bool {
+	c.mu.Lock()
+	known := c.dirs[path]
+	c.mu.Unlock()
+	if known {
 		return true
 	}
-	return false
+
+	if _, err := os.Stat(path); err != nil {
+		return false
+	}
+	c.MarkExists(path)
+	return true
+}
+
+// MarkExists records that path exists, e.g. because it was just created.
+func (c *Cache) MarkExists(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dirs[path] = true
+}
+
+// Forget forgets whether path, and everything under it, exists, e.g. because it may have been removed. Forget(".") forgets every path.
+func (c *Cache) Forget(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if path == "." {
+		c.dirs = make(map[string]bool)
+		return
+	}
+	for dir := range c.dirs {
+		if dir == path || strings.HasPrefix(dir, path+"/") {
+			delete(c.dirs, dir)
+		}
+	}
 }
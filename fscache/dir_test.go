@@ -0,0 +1,75 @@
+package fscache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestExists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sub := filepath.Join(dir, "sub")
+	subsub := filepath.Join(sub, "sub")
+
+	c := New(System{})
+	if c.Exists(sub) {
+		t.Errorf("before mkdir: want %v to not exist", sub)
+	}
+	if err := os.MkdirAll(subsub, 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{sub, subsub} {
+		if !c.Exists(path) {
+			t.Errorf("after mkdir: want %v to exist", path)
+		}
+	}
+
+	if err := os.RemoveAll(sub); err != nil {
+		t.Fatal(err)
+	}
+	if !c.Exists(subsub) {
+		t.Errorf("before forgetting: want %v to be remembered", subsub)
+	}
+	c.Forget(sub)
+	for _, path := range []string{sub, subsub} {
+		if c.Exists(path) {
+			t.Errorf("after forgetting: want %v to not exist", path)
+		}
+	}
+
+	c.MarkExists(sub)
+	if !c.Exists(sub) {
+		t.Errorf("after marking: want %v to exist", sub)
+	}
+	c.Forget(".")
+	if c.Exists(sub) {
+		t.Errorf("after forgetting everything: want %v to not exist", sub)
+	}
+}
+
+func TestConcurrentUse(t *testing.T) {
+	c := New(&Database{Users: map[string]uint32{"alice": 1000}, Groups: map[string]uint32{"staff": 50}})
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Exists(".")
+			c.MarkExists("dir")
+			c.Forget("dir")
+			if uid, err := c.LookupUser("alice"); err != nil || uid != 1000 {
+				t.Errorf("alice: want 1000 got %v, %v", uid, err)
+			}
+			if name, err := c.LookupGID(50); err != nil || name != "staff" {
+				t.Errorf("50: want staff got %v, %v", name, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
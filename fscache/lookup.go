@@ -0,0 +1,145 @@
+package fscache
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// Lookup looks up users and groups by name and by numeric ID.
+type Lookup interface {
+	LookupUser(username string) (uint32, error)
+	LookupUID(uid uint32) (string, error)
+	LookupGroup(groupname string) (uint32, error)
+	LookupGID(gid uint32) (string, error)
+}
+
+// System looks up users and groups in the system's databases, using os/user. Users are named by their login name.
+type System struct{}
+
+func (System) LookupUser(username string) (uint32, error) {
+	u, err := user.Lookup(username)
+	if err != nil {
+		return 0, err
+	}
+	return parseID(u.Uid)
+}
+
+func (System) LookupUID(uid uint32) (string, error) {
+	u, err := user.LookupId(strconv.FormatUint(uint64(uid), 10))
+	if err != nil {
+		return "", err
+	}
+	return u.Username, nil
+}
+
+func (System) LookupGroup(groupname string) (uint32, error) {
+	g, err := user.LookupGroup(groupname)
+	if err != nil {
+		return 0, err
+	}
+	return parseID(g.Gid)
+}
+
+func (System) LookupGID(gid uint32) (string, error) {
+	g, err := user.LookupGroupId(strconv.FormatUint(uint64(gid), 10))
+	if err != nil {
+		return "", err
+	}
+	return g.Name, nil
+}
+
+func parseID(id string) (uint32, error) {
+	id64, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	return uint32(id64), nil
+}
+
+// Database looks up users and groups in fixed tables, e.g. read from a container's passwd and group files, or made up by tests.
+type Database struct {
+	Users  map[string]uint32
+	Groups map[string]uint32
+}
+
+// ParseDatabase reads users from passwd and groups from group, which are in the formats of /etc/passwd and /etc/group.
+// Either may be nil, to have no users or groups.
+func ParseDatabase(passwd, group io.Reader) (*Database, error) {
+	users, err := parseIDFile(passwd)
+	if err != nil {
+		return nil, fmt.Errorf("fscache: error reading passwd: %v", err)
+	}
+	groups, err := parseIDFile(group)
+	if err != nil {
+		return nil, fmt.Errorf("fscache: error reading group: %v", err)
+	}
+	return &Database{Users: users, Groups: groups}, nil
+}
+
+// parseIDFile reads the name and numeric ID, the first and third fields, of each line of r.
+func parseIDFile(r io.Reader) (map[string]uint32, error) {
+	ids := make(map[string]uint32)
+	if r == nil {
+		return ids, nil
+	}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) < 3 || fields[0] == "" {
+			return nil, fmt.Errorf("line %d: want name:password:id:..., got %q", n, line)
+		}
+		id, err := parseID(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: bad id: %v", n, err)
+		}
+		ids[fields[0]] = id
+	}
+	return ids, scanner.Err()
+}
+
+func (d *Database) LookupUser(username string) (uint32, error) {
+	if uid, ok := d.Users[username]; ok {
+		return uid, nil
+	}
+	return 0, user.UnknownUserError(username)
+}
+
+func (d *Database) LookupUID(uid uint32) (string, error) {
+	if name, ok := lookupID(d.Users, uid); ok {
+		return name, nil
+	}
+	return "", user.UnknownUserIdError(int(uid))
+}
+
+func (d *Database) LookupGroup(groupname string) (uint32, error) {
+	if gid, ok := d.Groups[groupname]; ok {
+		return gid, nil
+	}
+	return 0, user.UnknownGroupError(groupname)
+}
+
+func (d *Database) LookupGID(gid uint32) (string, error) {
+	if name, ok := lookupID(d.Groups, gid); ok {
+		return name, nil
+	}
+	return "", user.UnknownGroupIdError(strconv.FormatUint(uint64(gid), 10))
+}
+
+// lookupID returns the name with id. If several names have the same id, the lexically first is returned, so the result is stable.
+func lookupID(ids map[string]uint32, id uint32) (string, bool) {
+	found, ok := "", false
+	for name, nameID := range ids {
+		if nameID == id && (!ok || name < found) {
+			found, ok = name, true
+		}
+	}
+	return found, ok
+}
@@ -0,0 +1,62 @@
+package fscache
+
+import (
+	"strings"
+	"testing"
+)
+
+const (
+	passwd = `root:x:0:0:root:/root:/bin/bash
+# a comment
+
+alice:x:1000:1000:Alice Liddell:/home/alice:/bin/sh
+`
+	group = `root:x:0:
+staff:x:50:alice
+`
+)
+
+func TestParseDatabase(t *testing.T) {
+	db, err := ParseDatabase(strings.NewReader(passwd), strings.NewReader(group))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := New(db)
+	if uid, err := c.LookupUser("alice"); err != nil || uid != 1000 {
+		t.Errorf("alice: want 1000 got %v, %v", uid, err)
+	}
+	// The login name is used, rather than the display name.
+	if name, err := c.LookupUID(1000); err != nil || name != "alice" {
+		t.Errorf("1000: want alice got %q, %v", name, err)
+	}
+	if gid, err := c.LookupGroup("staff"); err != nil || gid != 50 {
+		t.Errorf("staff: want 50 got %v, %v", gid, err)
+	}
+	if name, err := c.LookupGID(0); err != nil || name != "root" {
+		t.Errorf("0: want root got %q, %v", name, err)
+	}
+	if _, err := c.LookupUser("bob"); err == nil {
+		t.Errorf("bob: want error got nil")
+	}
+	if _, err := c.LookupGID(1000); err == nil {
+		t.Errorf("gid 1000: want error got nil")
+	}
+}
+
+func TestParseDatabaseNil(t *testing.T) {
+	db, err := ParseDatabase(strings.NewReader(passwd), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.LookupGroup("root"); err == nil {
+		t.Errorf("root: want error got nil")
+	}
+}
+
+func TestParseDatabaseMalformed(t *testing.T) {
+	for _, contents := range []string{"alice", "alice:x", "alice:x:notanumber:0"} {
+		if _, err := ParseDatabase(strings.NewReader(contents), nil); err == nil {
+			t.Errorf("%q: want error got nil", contents)
+		}
+	}
+}
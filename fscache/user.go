@@ -1,76 +1,75 @@
 package fscache
 
-import (
-	"os/user"
-	"strconv"
-)
-
-var (
-	userCache = make(map[string]uint32)
-	uidCache  = make(map[uint32]string)
-
-	groupCache = make(map[string]uint32)
-	gidCache   = make(map[uint32]string)
-)
-
-func LookupUser(username string) (uint32, error) {
-	if uid, ok := userCache[username]; ok {
+func (c *Cache) LookupUser(username string) (uint32, error) {
+	c.mu.Lock()
+	uid, ok := c.users[username]
+	c.mu.Unlock()
+	if ok {
 		return uid, nil
 	}
-	u, err := user.Lookup(username)
+	uid, err := c.lookup.LookupUser(username)
 	if err != nil {
 		return 0, err
 	}
-	uid64, err := strconv.ParseUint(u.Uid, 10, 32)
-	if err != nil {
-		return 0, err
-	}
-	uid := uint32(uid64)
-	userCache[username] = uid
-	uidCache[uid] = username
+	c.putUser(username, uid)
 	return uid, nil
 }
 
-func LookupUID(uid uint32) (string, error) {
-	if username, ok := uidCache[uid]; ok {
+func (c *Cache) LookupUID(uid uint32) (string, error) {
+	c.mu.Lock()
+	username, ok := c.uids[uid]
+	c.mu.Unlock()
+	if ok {
 		return username, nil
 	}
-	u, err := user.LookupId(strconv.FormatUint(uint64(uid), 10))
+	username, err := c.lookup.LookupUID(uid)
 	if err != nil {
 		return "", err
 	}
-	userCache[u.Name] = uid
-	uidCache[uid] = u.Name
-	return u.Name, nil
+	c.putUser(username, uid)
+	return username, nil
 }
 
-func LookupGroup(groupname string) (uint32, error) {
-	if gid, ok := groupCache[groupname]; ok {
+func (c *Cache) putUser(username string, uid uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.users[username] = uid
+	c.uids[uid] = username
+}
+
+func (c *Cache) LookupGroup(groupname string) (uint32, error) {
+	c.mu.Lock()
+	gid, ok := c.groups[groupname]
+	c.mu.Unlock()
+	if ok {
 		return gid, nil
 	}
-	g, err := user.LookupGroup(groupname)
-	if err != nil {
-		return 0, err
-	}
-	gid64, err := strconv.ParseUint(g.Gid, 10, 32)
+	gid, err := c.lookup.LookupGroup(groupname)
 	if err != nil {
 		return 0, err
 	}
-	gid := uint32(gid64)
-	groupCache[groupname] = gid
-	gidCache[gid] = groupname
+	c.putGroup(groupname, gid)
 	return gid, nil
 }
 
-func LookupGID(gid uint32) (string, error) {
-	if groupname, ok := gidCache[gid]; ok {
+func (c *Cache) LookupGID(gid uint32) (string, error) {
+	c.mu.Lock()
+	groupname, ok := c.gids[gid]
+	c.mu.Unlock()
+	if ok {
 		return groupname, nil
 	}
-	g, err := user.LookupGroupId(strconv.FormatUint(uint64(gid), 10))
+	groupname, err := c.lookup.LookupGID(gid)
 	if err != nil {
 		return "", err
 	}
-	groupCache[g.Name] = gid
-	gidCache[gid] = g.Name
-	return g.Name, nil
+	c.putGroup(groupname, gid)
+	return groupname, nil
+}
+
+func (c *Cache) putGroup(groupname string, gid uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.groups[groupname] = gid
+	c.gids[gid] = groupname
 }
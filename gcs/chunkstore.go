@@ -1,40 +1,160 @@
 package gcs
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"io"
+	"net"
+	"net/http"
 	"os"
 
 	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/illicitonion/cloudbackup/chunkstore"
 )
 
+// maxPreallocateBytes caps how much memory is allocated based on the size GCS reports for an object before any of it has been read.
+// Chunks are normally much smaller than this, but an unexpectedly large object shouldn't cause a huge allocation up front.
+const maxPreallocateBytes = 16 << 20
+
 type ChunkStore struct {
 	Bucket *storage.BucketHandle
 }
 
-func (b *ChunkStore) Read(hmac string) ([]byte, error) {
+func (b *ChunkStore) Read(ctx context.Context, hmac string) ([]byte, error) {
+	contents, _, err := b.ReadVersion(ctx, hmac)
+	return contents, err
+}
+
+func (b *ChunkStore) Save(ctx context.Context, hmac string, contents []byte) error {
 	object := b.Bucket.Object(hmac)
-	reader, err := object.NewReader(context.Background())
+	writer := object.NewWriter(ctx)
+	_, err := writer.Write(contents)
 	if err != nil {
-		if err == storage.ErrObjectNotExist {
-			return nil, os.ErrNotExist
-		}
-		return nil, err
+		writer.Close()
+		return convertError(err)
+	}
+	return convertError(writer.Close())
+}
+
+// ReadVersion uses the object's generation as its version.
+// It reads the whole object into memory, as Read does, rather than returning a reader: the only versioned object is the "meta" pointer, which holds
+// the IVs and MACs of the chunks of the metadata's root, so is tens of kilobytes at most, and other objects are single chunks, which are all read
+// whole to be decrypted. The object's size is known before it is read, so it is usually read into a buffer of exactly the right size.
+func (b *ChunkStore) ReadVersion(ctx context.Context, name string) ([]byte, int64, error) {
+	reader, err := b.Bucket.Object(name).NewReader(ctx)
+	if err != nil {
+		return nil, 0, convertError(err)
 	}
 	defer reader.Close()
 
-	contents := make([]byte, reader.Size())
-	_, err = io.ReadFull(reader, contents)
-	return contents, err
+	size := reader.Size()
+	if size > maxPreallocateBytes {
+		size = maxPreallocateBytes
+	}
+	contents := bytes.NewBuffer(make([]byte, 0, size))
+	if _, err := io.Copy(contents, reader); err != nil {
+		return nil, 0, convertError(err)
+	}
+	return contents.Bytes(), reader.Attrs.Generation, nil
 }
 
-func (b *ChunkStore) Save(hmac string, contents []byte) error {
-	object := b.Bucket.Object(hmac)
-	writer := object.NewWriter(context.Background())
-	_, err := writer.Write(contents)
-	if err != nil {
+// SaveIfVersion uses a generation precondition, so the check and the write are atomic.
+func (b *ChunkStore) SaveIfVersion(ctx context.Context, name string, contents []byte, version int64) error {
+	conditions := storage.Conditions{GenerationMatch: version}
+	if version == 0 {
+		conditions = storage.Conditions{DoesNotExist: true}
+	}
+	writer := b.Bucket.Object(name).If(conditions).NewWriter(ctx)
+	if _, err := writer.Write(contents); err != nil {
 		writer.Close()
-		return err
+		return convertPreconditionError(err)
+	}
+	return convertPreconditionError(writer.Close())
+}
+
+func (b *ChunkStore) Exists(ctx context.Context, hmac string) (bool, error) {
+	_, err := b.Bucket.Object(hmac).Attrs(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return false, nil
+	}
+	return err == nil, convertError(err)
+}
+
+func (b *ChunkStore) List(ctx context.Context, prefix string, fn func(hmac string) error) error {
+	it := b.Bucket.Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return convertError(err)
+		}
+		if err := fn(attrs.Name); err != nil {
+			return err
+		}
+	}
+}
+
+func (b *ChunkStore) Delete(ctx context.Context, hmac string) error {
+	return convertError(b.Bucket.Object(hmac).Delete(ctx))
+}
+
+func (b *ChunkStore) Stat(ctx context.Context, hmac string) (chunkstore.Info, error) {
+	attrs, err := b.Bucket.Object(hmac).Attrs(ctx)
+	if err != nil {
+		return chunkstore.Info{}, convertError(err)
+	}
+	return chunkstore.Info{
+		Name:    attrs.Name,
+		Size:    attrs.Size,
+		ModTime: attrs.Updated,
+	}, nil
+}
+
+// convertError converts errors for missing objects into os.ErrNotExist, as required by chunkstore.ChunkStore,
+// and marks errors which are worth retrying (rate limiting, server errors and network timeouts) as transient.
+func convertError(err error) error {
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return os.ErrNotExist
+	}
+	if isTransient(err) {
+		return &chunkstore.TransientError{Err: err}
+	}
+	return err
+}
+
+// convertPreconditionError is like convertError, but also converts failed preconditions into chunkstore.ErrVersionMismatch.
+func convertPreconditionError(err error) error {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed {
+		return chunkstore.ErrVersionMismatch
+	}
+	// The gRPC API reports failed preconditions as a status rather than a googleapi.Error.
+	if status.Code(err) == codes.FailedPrecondition {
+		return chunkstore.ErrVersionMismatch
+	}
+	return convertError(err)
+}
+
+func isTransient(err error) bool {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		switch apiErr.Code {
+		case http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return netErr.Timeout()
 	}
-	return writer.Close()
+	return errors.Is(err, io.ErrUnexpectedEOF)
 }
@@ -0,0 +1,113 @@
+package gcs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/illicitonion/cloudbackup/chunkstore"
+	"github.com/illicitonion/cloudbackup/chunkstore/chunkstoretest"
+)
+
+// TestChunkStoreConformance runs against a real bucket, specified as json-keyfile:bucket-name in $CLOUDBACKUP_TEST_GCS.
+// The bucket must be dedicated to this test, as everything in it will be deleted.
+func TestChunkStoreConformance(t *testing.T) {
+	spec := os.Getenv("CLOUDBACKUP_TEST_GCS")
+	if spec == "" {
+		t.Skip("CLOUDBACKUP_TEST_GCS not set")
+	}
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 {
+		t.Fatalf("CLOUDBACKUP_TEST_GCS must be of form json-keyfile:bucket, got %q", spec)
+	}
+	client, err := storage.NewClient(context.Background(), option.WithServiceAccountFile(parts[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	chunkstoretest.Run(t, func(t *testing.T) (chunkstore.ChunkStore, func()) {
+		s := &ChunkStore{Bucket: client.Bucket(parts[1])}
+		empty(t, s)
+		return s, func() { empty(t, s) }
+	})
+}
+
+func empty(t *testing.T, s *ChunkStore) {
+	var names []string
+	if err := s.List(context.Background(), "", func(name string) error {
+		names = append(names, name)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		if err := s.Delete(context.Background(), name); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestConvertError(t *testing.T) {
+	if err := convertError(storage.ErrObjectNotExist); !os.IsNotExist(err) {
+		t.Errorf("ErrObjectNotExist: want not exist error got %v", err)
+	}
+	if err := convertError(fmt.Errorf("reading: %w", storage.ErrObjectNotExist)); !os.IsNotExist(err) {
+		t.Errorf("wrapped ErrObjectNotExist: want not exist error got %v", err)
+	}
+	for _, tc := range []struct {
+		err       error
+		transient bool
+	}{
+		{&googleapi.Error{Code: 503}, true},
+		{&googleapi.Error{Code: 500}, true},
+		{&googleapi.Error{Code: 429}, true},
+		{&googleapi.Error{Code: 408}, true},
+		{&googleapi.Error{Code: 403}, false},
+		{&googleapi.Error{Code: 501}, false},
+		{fmt.Errorf("reading: %w", &googleapi.Error{Code: 502}), true},
+		{&net.OpError{Op: "read", Err: timeoutError{}}, true},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, false},
+		{io.ErrUnexpectedEOF, true},
+		{fmt.Errorf("reading: %w", io.ErrUnexpectedEOF), true},
+		{errors.New("something else"), false},
+		{context.Canceled, false},
+	} {
+		if got := chunkstore.IsTransient(convertError(tc.err)); got != tc.transient {
+			t.Errorf("%v: want transient %v got %v", tc.err, tc.transient, got)
+		}
+	}
+}
+
+func TestConvertPreconditionError(t *testing.T) {
+	if err := convertPreconditionError(&googleapi.Error{Code: 412}); err != chunkstore.ErrVersionMismatch {
+		t.Errorf("412: want %v got %v", chunkstore.ErrVersionMismatch, err)
+	}
+	if err := convertPreconditionError(fmt.Errorf("closing writer: %w", &googleapi.Error{Code: 412})); err != chunkstore.ErrVersionMismatch {
+		t.Errorf("wrapped 412: want %v got %v", chunkstore.ErrVersionMismatch, err)
+	}
+	if err := convertPreconditionError(fmt.Errorf("closing writer: %w", status.Error(codes.FailedPrecondition, "generation mismatch"))); err != chunkstore.ErrVersionMismatch {
+		t.Errorf("wrapped FailedPrecondition: want %v got %v", chunkstore.ErrVersionMismatch, err)
+	}
+	if err := convertPreconditionError(&googleapi.Error{Code: 503}); !chunkstore.IsTransient(err) {
+		t.Errorf("503: want transient error got %v", err)
+	}
+}
+
+// timeoutError is a net.Error which timed out.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
@@ -1,17 +1,13 @@
 package main
 
 import (
-	"bytes"
-	"compress/gzip"
+	"bufio"
 	"context"
-	"crypto/aes"
-	"crypto/hmac"
 	"crypto/rand"
-	"encoding/hex"
+	"encoding/json"
 	"encoding/pem"
 	"flag"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
 	"os"
@@ -19,52 +15,151 @@ import (
 	"sort"
 	"strconv"
 	"strings"
-	"syscall"
+	"time"
 
 	"google.golang.org/api/option"
 
 	"cloud.google.com/go/storage"
+	"github.com/illicitonion/cloudbackup/backup"
+	"github.com/illicitonion/cloudbackup/chunkstore"
 	"github.com/illicitonion/cloudbackup/crypto"
 	"github.com/illicitonion/cloudbackup/files"
-	"github.com/illicitonion/cloudbackup/fscache"
 	"github.com/illicitonion/cloudbackup/gcs"
 	"github.com/illicitonion/cloudbackup/meta"
+	"github.com/illicitonion/cloudbackup/ratelimit"
+	"github.com/illicitonion/cloudbackup/retry"
+	"github.com/illicitonion/cloudbackup/sqlite"
 )
 
 const keySize = 32
 
-var metaIV = []byte("metametametameta")
+// exitPartialSuccess is the exit status used when some, but not necessarily all, files could not be encrypted.
+const exitPartialSuccess = 3
 
 func main() {
 	keyFile := flag.String("key-file", "", "PEM-encoded file containing Encryption, Authentication, and IV keys")
 
 	var command string
 	if len(os.Args) < 2 || os.Args[1][0] == '-' {
-		log.Fatalf("Need to specify subcommand. Usage: %s [encrypt|decrypt|keygen]", os.Args[0])
+		log.Fatalf("Need to specify subcommand. Usage: %s [encrypt|decrypt|list|cat|merge|meta|daemon|keygen]", os.Args[0])
 	}
 	command = os.Args[1]
-	if command != "encrypt" && command != "decrypt" && command != "keygen" {
-		log.Fatal("Subcommand must be one of encrypt, decrypt, or keygen, got ", command)
+	if command != "encrypt" && command != "decrypt" && command != "list" && command != "cat" && command != "merge" && command != "meta" && command != "daemon" && command != "keygen" {
+		log.Fatal("Subcommand must be one of encrypt, decrypt, list, cat, merge, meta, daemon, or keygen, got ", command)
 	}
-	os.Args = append([]string{os.Args[0] + " " + os.Args[1]}, os.Args[2:]...)
-
-	var metaFileFlag, chunkSpec, file, excludeNamesFlag *string
-	var reupload *bool
-	var chunkBytes *int
-	if command != "keygen" {
+	var metaCommand string
+	if command == "meta" {
+		if len(os.Args) < 3 || os.Args[2][0] == '-' {
+			log.Fatalf("Need to specify meta subcommand. Usage: %s meta [upgrade|export|import|convert|history]", os.Args[0])
+		}
+		metaCommand = os.Args[2]
+		if metaCommand != "upgrade" && metaCommand != "export" && metaCommand != "import" && metaCommand != "convert" && metaCommand != "history" {
+			log.Fatal("meta subcommand must be one of upgrade, export, import, convert, or history, got ", metaCommand)
+		}
+		os.Args = append([]string{os.Args[0] + " meta " + metaCommand}, os.Args[3:]...)
+	} else {
+		os.Args = append([]string{os.Args[0] + " " + os.Args[1]}, os.Args[2:]...)
+	}
+
+	var limitUpload, limitDownload, limitSchedule *string
+	var metaFileFlag, chunkSpec, file, excludeNamesFlag, newerThanFlag, olderThanFlag, stdinName, mergeFrom, mergeConflict, formatFlag, dumpFile *string
+	var convertFrom, convertTo, convertFromBackend, convertToBackend, metadataCache, progressFlag, summaryFile, configFile *string
+	var reupload, skipExisting, oneFileSystem, excludeCaches, stdin, obfuscate, padChunks, padMetadata, numericOwner *bool
+	mapUsers, mapGroups := make(mappingFlag), make(mappingFlag)
+	var chunkBytes, attempts, obfuscateBatch, padChunkQuantum *int
+	var retryBackoff, obfuscateMaxDelay *time.Duration
+	var decoyRate *float64
+	var maxFileSize, offset, length *int64
+	if command == "daemon" {
+		configFile = flag.String("config", "", "JSON file configuring the key file, chunk spec, metrics address, and backups to run on schedules. See the README for its format.")
+	} else if metaCommand == "convert" {
+		convertFrom = flag.String("from", "", "Metadata database to convert.")
+		convertTo = flag.String("to", "", "Path of the converted metadata database, which must not already exist.")
+		convertFromBackend = flag.String("from-backend", "bolt", "Format of --from: bolt (as used by --meta-file), or sqlite.")
+		convertToBackend = flag.String("to-backend", "sqlite", "Format of --to: bolt (as used by --meta-file), or sqlite.")
+	} else if command != "keygen" {
 		chunkSpec = flag.String("chunkspec", "", "Spec of where to save chunks. Valid values: local:/path/to/local/directory, gcs:path-to-json-keyfile:bucket-name")
-		file = flag.String("file", "", "Relative path of the file or directory to encrypt or decrypt. If decrypting, this file will be created (or overwritten) atomically. --file=. will encrypt the whole current working directory (recursively), or decrypt all known files.")
-		metaFileFlag = flag.String("meta-file", "", "(Optional). This should not normally be used - by default, this file will be encrypted and stored alongside chunks. Specifying this manually will prevent automatic upload of the metadata file, and lead to you needing to manually merge things. A boltdb file containing a bucket named files, where metadata required for decryption is stored (e.g. file-chunk mappings). This file will be created if it does not already exist.")
-
-		if command == "encrypt" {
+		if command != "list" && command != "cat" && command != "merge" && command != "meta" {
+			file = flag.String("file", "", "Relative path of the file or directory to encrypt or decrypt. If decrypting, this file will be created (or overwritten) atomically. --file=. will encrypt the whole current working directory (recursively), or decrypt all known files.")
+		}
+		attempts = flag.Int("attempts", retry.DefaultAttempts, "The maximum number of times to try each chunk store operation which fails with a transient error (e.g. a server error or timeout).")
+		retryBackoff = flag.Duration("retry-backoff", retry.DefaultBackoff, "How long to wait before retrying a failed chunk store operation. The delay doubles (with random jitter) for each subsequent retry, up to a minute.")
+		limitUpload = flag.String("limit-upload", "", "(Optional) Maximum upload rate in bytes per second, optionally suffixed with K, M or G, e.g. 512K.")
+		limitDownload = flag.String("limit-download", "", "(Optional) Maximum download rate in bytes per second, optionally suffixed with K, M or G, e.g. 2M.")
+		limitSchedule = flag.String("limit-schedule", "", "(Optional) File setting upload and download rates by time of day, with lines of the form: HH:MM upload-rate download-rate. May not be combined with --limit-upload or --limit-download.")
+		metaFileFlag = flag.String("meta-file", "", "(Optional). This should not normally be used - by default, this file will be encrypted and stored alongside chunks. Specifying this manually will prevent automatic upload of the metadata file, and lead to you needing to manually merge things (see the merge subcommand). A boltdb file containing a bucket named files, where metadata required for decryption is stored (e.g. file-chunk mappings). This file will be created if it does not already exist.")
+		metadataCache = flag.String("metadata-cache", "", "(Optional) Directory in which to cache the encrypted chunks of the stored metadata, so that only the parts which have changed since it was last fetched or stored are downloaded. It should only be used for one repository.")
+
+		if command == "encrypt" || command == "merge" || metaCommand == "upgrade" || metaCommand == "import" {
 			chunkBytes = flag.Int("chunk-bytes", -1, "The number of bytes to store in each encrypted chunk. Smaller files (or trailing chunks) will be padded such that all chunks are an identical size. This padding will be stripped on decryption. This must be at least as large as a single meta.Entry (which is about 256 bytes).")
+			padMetadata = flag.Bool("pad-metadata", false, "Pad the number of chunks of the stored metadata file up to the next power of two, to hide how many files there are.")
+		}
+		if command == "encrypt" {
 			excludeNamesFlag = flag.String("exclude-names", "", "File or directory names to ignore; semicolon-delimited.")
-			reupload = flag.Bool("reupload", false, "Whether to re-upload chunks which have not changed in already uploaded files.")
+			reupload = flag.Bool("reupload", false, "Whether to re-upload chunks which have not changed in already uploaded files. Unchanged chunks are saved again under their existing names, so with --skip-existing only chunks missing from the chunk store are uploaded.")
+			skipExisting = flag.Bool("skip-existing", false, "Whether to skip uploading chunks which already exist in the chunk store. The chunk store is listed once at the start of the run, which costs an operation per thousand or so chunks stored, so this is only worthwhile with --reupload: new chunks have random IVs, so never already exist.")
+			maxFileSize = flag.Int64("max-file-size", 0, "(Optional) Files larger than this many bytes will be skipped.")
+			newerThanFlag = flag.String("newer-than", "", "(Optional) Only encrypt files modified after this time. Either a duration relative to now (e.g. 72h), or an RFC 3339 timestamp.")
+			olderThanFlag = flag.String("older-than", "", "(Optional) Only encrypt files modified before this time. Either a duration relative to now (e.g. 72h), or an RFC 3339 timestamp.")
+			oneFileSystem = flag.Bool("one-file-system", false, "Don't descend into directories which are on a different filesystem to --file.")
+			excludeCaches = flag.Bool("exclude-caches", false, "Skip directories containing a CACHEDIR.TAG file (see http://www.brynosaurus.com/cachedir/).")
+			stdin = flag.Bool("stdin", false, "Encrypt data read from stdin, rather than --file. Requires --stdin-name.")
+			stdinName = flag.String("stdin-name", "", "Relative path under which to store data read from stdin when using --stdin.")
+			padChunks = flag.Bool("pad-chunks", false, "Pad the number of chunks of each non-empty file up to the next power of two (or multiple of --pad-chunk-quantum) with dummy chunks, to hide file sizes.")
+			padChunkQuantum = flag.Int("pad-chunk-quantum", 0, "(Optional) With --pad-chunks, pad to a multiple of this many chunks rather than to a power of two.")
+			obfuscate = flag.Bool("obfuscate", false, "Make it harder for someone watching uploads to work out which chunks belong to the same file, by uploading chunks in a random order, with random delays, mixed with random decoy chunks.")
+			obfuscateBatch = flag.Int("obfuscate-batch", backup.DefaultObfuscateBatchChunks, "With --obfuscate, the number of chunks to hold in memory and upload in a random order.")
+			obfuscateMaxDelay = flag.Duration("obfuscate-max-delay", time.Second, "With --obfuscate, the longest random delay between uploading chunks.")
+			decoyRate = flag.Float64("decoy-rate", 0.05, "With --obfuscate, the number of random decoy chunks to upload per real chunk.")
+		}
+		if command == "encrypt" || command == "decrypt" {
+			progressFlag = flag.String("progress", "auto", "How to report progress on stderr: auto (a status line if stderr is a terminal), tty (a status line), json (a JSON object per line, every second), or none.")
+			summaryFile = flag.String("summary-file", "", "(Optional) File to write a summary of the run to, as a JSON object. The summary is always printed to stdout.")
+		}
+		if command == "decrypt" {
+			numericOwner = flag.Bool("numeric-owner", false, "Restore owners by the numeric user and group IDs recorded when they were encrypted, rather than by name. Owners whose names don't exist on this system are always restored by ID.")
+			flag.Var(mapUsers, "map-user", "(Optional) Restore files owned by user old as owned by user new, given as old:new. Either may be a name or a numeric ID. May be repeated.")
+			flag.Var(mapGroups, "map-group", "(Optional) Restore files owned by group old as owned by group new, given as old:new. Either may be a name or a numeric ID. May be repeated.")
+		}
+		if command == "merge" {
+			mergeFrom = flag.String("from", "", "Metadata file (e.g. one written using --meta-file) whose entries to merge into the repository's metadata.")
+			mergeConflict = flag.String("conflict", "fail", "What to do with entries which differ between the two: fail (merge nothing), newest (keep the entry from whichever metadata was written most recently), or keep-both (also keep the merged entry, at its path suffixed with .merged-<time>).")
+		}
+		if metaCommand == "export" || metaCommand == "import" {
+			formatFlag = flag.String("format", "json", "Format of the exported metadata: json (a single object, with entries and decoys arrays), or jsonl (an object per line, for each entry and decoy).")
+			dumpFile = flag.String("dump-file", "", "(Optional) File to write the exported metadata to, or read it from. Defaults to stdout or stdin.")
+		}
+		if command == "cat" {
+			offset = flag.Int64("offset", 0, "(Optional) Byte offset in the file to start writing from.")
+			length = flag.Int64("length", -1, "(Optional) Maximum number of bytes to write. -1 means until the end of the file.")
 		}
 	}
 
 	flag.Parse()
 
+	if command == "daemon" {
+		if *configFile == "" {
+			fatal("Need to specify --config", true)
+		}
+		runDaemon(*configFile)
+		return
+	}
+
+	if metaCommand == "convert" {
+		if *convertFrom == "" || *convertTo == "" {
+			fatal("Need to specify --from and --to", true)
+		}
+		if _, err := os.Stat(*convertTo); !os.IsNotExist(err) {
+			fatal(fmt.Sprintf("--to %v already exists", *convertTo), false)
+		}
+		n, err := convertMetadata(*convertFrom, *convertFromBackend, *convertTo, *convertToBackend)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Fprintf(os.Stderr, "Converted %d entries\n", n)
+		return
+	}
+
 	if *keyFile == "" {
 		fatal("Need to specify --key-file", true)
 	}
@@ -74,7 +169,26 @@ func main() {
 		return
 	}
 
-	if filepath.IsAbs(*file) {
+	if command == "cat" {
+		if flag.NArg() != 1 {
+			fatal(fmt.Sprintf("Usage: %s [flags] path", os.Args[0]), true)
+		}
+		path := filepath.Clean(flag.Arg(0))
+		file = &path
+	}
+
+	if command == "list" {
+		if flag.NArg() > 1 {
+			fatal(fmt.Sprintf("Usage: %s [flags] [path]", os.Args[0]), true)
+		}
+		path := "."
+		if flag.NArg() == 1 {
+			path = filepath.Clean(flag.Arg(0))
+		}
+		file = &path
+	}
+
+	if file != nil && filepath.IsAbs(*file) {
 		fatal("--file must be a relative file", true)
 	}
 
@@ -83,102 +197,226 @@ func main() {
 		log.Fatal("Error reading key file: ", err)
 	}
 	keys := crypto.ReadKeys(keyBytes)
-	aesKey := keys["Encryption"]
-	hmacKey := keys["Authentication"]
-	if len(aesKey) != keySize || len(hmacKey) != keySize {
-		fatal("Bad keys: Want each to be 256 bits", false)
-	}
 
 	chunkStore, err := parseChunkSpec(*chunkSpec, keys)
 	if err != nil {
 		log.Fatal("Error parsing chunk spec: ", err)
 	}
+	if chunkStore, err = limitChunkStore(chunkStore, *limitUpload, *limitDownload, *limitSchedule); err != nil {
+		fatal(err.Error(), true)
+	}
+	chunkStore = &retry.ChunkStore{
+		Store:    chunkStore,
+		Attempts: *attempts,
+		Backoff:  *retryBackoff,
+	}
 
-	tempDir, err := ioutil.TempDir("", "cloudbackuptmp")
+	repo, err := backup.NewRepository(keys["Encryption"], keys["Authentication"], chunkStore, *metaFileFlag)
+	if err == backup.ErrBadKeys {
+		fatal("Bad keys: Want each to be 256 bits", false)
+	}
 	if err != nil {
-		log.Fatal("Unable to make temporary directory: ", err)
+		log.Fatal(err)
 	}
+	repo.SetMetadataCache(*metadataCache)
 
-	var metaFile string
-
-	if *metaFileFlag == "" {
-		metaFile = fetchMetadataFile(aesKey, hmacKey, chunkStore, tempDir)
-	} else {
-		metaFile = *metaFileFlag
-	}
+	ctx := context.Background()
 
-	db, err := meta.NewDB(metaFile)
-	if err != nil {
-		log.Fatalf("Error opening database at %v: %v", metaFile, err)
+	var progress func(backup.Progress)
+	if progressFlag != nil {
+		if progress, err = progressPrinter(*progressFlag, os.Stderr); err != nil {
+			fatal(fmt.Sprintf("Bad --progress: %v", err), true)
+		}
 	}
-	defer db.Close()
 
 	switch command {
 	case "encrypt":
-		if *chunkBytes <= 0 || *chunkBytes%aes.BlockSize != 0 {
-			fatal(fmt.Sprintf("Need -chunk-bytes greater than zero, and a multiple of %v got %v", aes.BlockSize, *chunkBytes), true)
+		now := time.Now()
+		newerThan, err := parseTimeFlag(*newerThanFlag, now)
+		if err != nil {
+			fatal(fmt.Sprintf("Bad --newer-than: %v", err), true)
 		}
-		fi, err := os.Stat(*file)
+		olderThan, err := parseTimeFlag(*olderThanFlag, now)
 		if err != nil {
-			log.Fatal("Error stating file for encryption: ", err)
+			fatal(fmt.Sprintf("Bad --older-than: %v", err), true)
 		}
-
-		excludeNames := make(map[string]bool)
-		for _, n := range strings.Split(*excludeNamesFlag, ";") {
-			excludeNames[n] = true
+		opts := backup.BackupOptions{
+			ChunkBytes:      *chunkBytes,
+			Reupload:        *reupload,
+			SkipExisting:    *skipExisting,
+			PadChunks:       *padChunks,
+			PadChunkQuantum: *padChunkQuantum,
+			PadMetadata:     *padMetadata,
+			ExcludeNames:    strings.Split(*excludeNamesFlag, ";"),
+			MaxFileSize:     *maxFileSize,
+			NewerThan:       newerThan,
+			OlderThan:       olderThan,
+			OneFileSystem:   *oneFileSystem,
+			ExcludeCaches:   *excludeCaches,
+			Progress:        progress,
 		}
-
-		fn := func(file string, fi os.FileInfo, err error) error {
-			if err != nil {
-				log.Fatalf("Error walking files: %v: %v", file, err)
+		if *obfuscate {
+			opts.Obfuscate = &backup.ObfuscateOptions{
+				BatchChunks: *obfuscateBatch,
+				MaxDelay:    *obfuscateMaxDelay,
+				DecoyRate:   *decoyRate,
 			}
-			if excludeNames[fi.Name()] {
-				if fi.IsDir() {
-					return filepath.SkipDir
-				} else {
-					return nil
-				}
-			}
-			if !fi.IsDir() {
-				encryptFileAndStoreMetadata(aesKey, hmacKey, chunkStore, *chunkBytes, db, file, fi, *reupload)
-			}
-			return nil
 		}
-		if fi.IsDir() {
-			if !excludeNames[filepath.Base(*file)] {
-				filepath.Walk(*file, fn)
+
+		var stats backup.BackupStats
+		if *stdin {
+			if *stdinName == "" || filepath.IsAbs(*stdinName) {
+				fatal("--stdin requires a relative --stdin-name", true)
 			}
+			stats, err = repo.BackupStream(ctx, *stdinName, os.Stdin, opts)
 		} else {
-			fn(*file, fi, nil)
+			stats, err = repo.Backup(ctx, []string{*file}, opts)
 		}
-
-		if *metaFileFlag == "" {
-			db.Close()
-			uploadMetadataFile(aesKey, hmacKey, chunkStore, metaFile, *chunkBytes)
+		if stats.ChunksAlreadyStored > 0 {
+			fmt.Fprintf(os.Stderr, "Skipped uploading %d chunks (%d bytes) which were already stored\n", stats.ChunksAlreadyStored, stats.BytesAlreadyStored)
+		}
+		partial, ok := err.(*backup.PartialError)
+		if err == nil || ok {
+			reportSummary(command, stats.Summary, *summaryFile)
+		}
+		if ok {
+			fmt.Fprintf(os.Stderr, "Skipped %d files which could not be encrypted:\n", len(partial.Skipped))
+			for _, s := range partial.Skipped {
+				fmt.Fprintf(os.Stderr, "  %v: %v\n", s.Path, s.Err)
+			}
+			os.Exit(exitPartialSuccess)
+		}
+		if err != nil {
+			log.Fatal(err)
 		}
 	case "decrypt":
-		entries, err := db.Get(*file)
+		summary, err := repo.Restore(ctx, []string{*file}, backup.RestoreOptions{
+			NumericOwner: *numericOwner,
+			MapUsers:     mapUsers,
+			MapGroups:    mapGroups,
+			Progress:     progress,
+		})
 		if err != nil {
-			log.Fatalf("Error getting entries: %v", err)
-		}
-		paths := make([]string, 0, len(entries))
-		for path, _ := range entries {
-			paths = append(paths, path)
-		}
-		// Ensure that directories are made before the files in them.
-		sort.Strings(paths)
-		for _, path := range paths {
-			e := entries[path]
-			if e.Mode.IsDir() {
-				if !fscache.Exists(path) {
-					if err := os.Mkdir(path, e.Mode); err != nil {
-						log.Fatalf("Unable to mkdir %q: %v", path, err)
-					}
-					chown(path, path, &e)
-				}
+			log.Fatal(err)
+		}
+		reportSummary(command, summary, *summaryFile)
+	case "list":
+		out := bufio.NewWriter(os.Stdout)
+		if err := repo.Walk(ctx, *file, func(path string, e meta.Entry) error {
+			_, err := fmt.Fprintln(out, formatListEntry(path, e))
+			return err
+		}); err != nil {
+			log.Fatal(err)
+		}
+		if err := out.Flush(); err != nil {
+			log.Fatal(err)
+		}
+	case "merge":
+		if *mergeFrom == "" {
+			fatal("Need to specify --from", true)
+		}
+		policy, err := backup.ParseMergePolicy(*mergeConflict)
+		if err != nil {
+			fatal(fmt.Sprintf("Bad --conflict: %v", err), true)
+		}
+		stats, err := repo.Merge(ctx, *mergeFrom, backup.MergeOptions{
+			Policy:      policy,
+			ChunkBytes:  *chunkBytes,
+			PadMetadata: *padMetadata,
+		})
+		if conflict, ok := err.(*backup.ConflictError); ok {
+			fmt.Fprintf(os.Stderr, "Merged nothing, as %d entries conflict:\n", len(conflict.Paths))
+			for _, path := range conflict.Paths {
+				fmt.Fprintf(os.Stderr, "  %v\n", path)
+			}
+			os.Exit(1)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Fprintf(os.Stderr, "Merged %d new entries and %d conflicting entries; %d entries were already present\n", stats.Added, stats.Conflicts, stats.Identical)
+	case "meta":
+		switch metaCommand {
+		case "upgrade":
+			from, err := repo.Upgrade(ctx, backup.MetadataOptions{
+				ChunkBytes:  *chunkBytes,
+				PadMetadata: *padMetadata,
+			})
+			if err != nil {
+				log.Fatal(err)
+			}
+			if from == meta.SchemaVersion {
+				fmt.Fprintf(os.Stderr, "Metadata is already at schema version %d\n", from)
 			} else {
-				decryptFile(aesKey, hmacKey, chunkStore, &e, tempDir, path)
+				fmt.Fprintf(os.Stderr, "Upgraded metadata from schema version %d to %d\n", from, meta.SchemaVersion)
 			}
+		case "export":
+			format, err := meta.ParseFormat(*formatFlag)
+			if err != nil {
+				fatal(fmt.Sprintf("Bad --format: %v", err), true)
+			}
+			dst := os.Stdout
+			if *dumpFile != "" {
+				if dst, err = os.OpenFile(*dumpFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600); err != nil {
+					log.Fatal(err)
+				}
+			}
+			if err := repo.ExportMetadata(ctx, dst, format); err != nil {
+				log.Fatal(err)
+			}
+			if err := dst.Close(); err != nil {
+				log.Fatal(err)
+			}
+		case "import":
+			format, err := meta.ParseFormat(*formatFlag)
+			if err != nil {
+				fatal(fmt.Sprintf("Bad --format: %v", err), true)
+			}
+			src := os.Stdin
+			if *dumpFile != "" {
+				if src, err = os.Open(*dumpFile); err != nil {
+					log.Fatal(err)
+				}
+				defer src.Close()
+			}
+			if err := repo.ImportMetadata(ctx, src, format, backup.MetadataOptions{
+				ChunkBytes:  *chunkBytes,
+				PadMetadata: *padMetadata,
+			}); err != nil {
+				log.Fatal(err)
+			}
+		case "history":
+			summaries, err := repo.Summaries(ctx)
+			if err != nil {
+				log.Fatal(err)
+			}
+			enc := json.NewEncoder(os.Stdout)
+			for _, s := range summaries {
+				if err := enc.Encode(toJSONSummary("", s)); err != nil {
+					log.Fatal(err)
+				}
+			}
+		}
+	case "cat":
+		if *offset < 0 {
+			fatal(fmt.Sprintf("Need --offset to be non-negative, got %v", *offset), true)
+		}
+		err := repo.Cat(ctx, *file, os.Stdout, *offset, *length)
+		if err == backup.ErrNotFile {
+			log.Fatalf("%q is not a file", *file)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// reportSummary prints the summary of command to stdout, and writes it to summaryFile if that is non-empty.
+func reportSummary(command string, summary backup.Summary, summaryFile string) {
+	fmt.Print(formatSummary(command, summary))
+	if summaryFile != "" {
+		if err := writeSummaryFile(summaryFile, command, summary); err != nil {
+			log.Fatalf("Error writing summary file: %v", err)
 		}
 	}
 }
@@ -209,7 +447,7 @@ func generateKeys(path string) {
 	}
 }
 
-func parseChunkSpec(chunkSpec string, keys map[string][]byte) (chunkStoreInterface, error) {
+func parseChunkSpec(chunkSpec string, keys map[string][]byte) (chunkstore.ChunkStore, error) {
 	var wantParts int
 	if strings.HasPrefix(chunkSpec, "local:") {
 		wantParts = 2
@@ -226,7 +464,7 @@ func parseChunkSpec(chunkSpec string, keys map[string][]byte) (chunkStoreInterfa
 			return nil, fmt.Errorf("error making chunk directory: %v", err)
 		}
 		return &files.ChunkStore{
-			dir,
+			RootDirectory: dir,
 		}, nil
 	case "gcs":
 		if len(parts) != 3 {
@@ -242,276 +480,123 @@ func parseChunkSpec(chunkSpec string, keys map[string][]byte) (chunkStoreInterfa
 	}
 }
 
-func fetchMetadataFile(aesKey, hmacKey []byte, chunkStore chunkStoreInterface, tempDir string) string {
-	path := filepath.Join(tempDir, "metadb")
-
-	metaPointerCiphertext, err := chunkStore.Read("meta")
-	if err != nil && (err == os.ErrNotExist || strings.Contains(err.Error(), "no such file")) {
-		return path
-	}
-	if err != nil {
-		log.Fatalf("Error reading meta file from chunk storage: %v", err)
-	}
-	metaPointerPlaintext, err := crypto.Decrypt(aesKey, nil, metaIV, metaPointerCiphertext, nil)
-	if err != nil {
-		log.Fatalf("Error decrypting meta file: %v", err)
-	}
-	entry, err := meta.DecodeEntry(metaPointerPlaintext)
-	if err != nil {
-		log.Fatalf("Error decoding meta file: %v", err)
-	}
-	buf := bytes.NewBuffer(nil)
-	decryptChunks(aesKey, hmacKey, buf, chunkStore, entry)
-	unzipped, err := gzip.NewReader(buf)
-	if err != nil {
-		log.Fatalf("Error making gzip reader: %v", err)
-	}
-	f, err := os.Create(path)
-	if err != nil {
-		log.Fatalf("Error creating metadb file: %v", err)
-	}
-	if err := f.Chmod(0600); err != nil {
-		log.Fatalf("Error chmoding metadb file: %v", err)
-	}
-	if _, err := io.Copy(f, unzipped); err != nil {
-		log.Fatalf("Error writing metadb file: %v", err)
-	}
-	if err := unzipped.Close(); err != nil {
-		log.Fatalf("Error closing gzip decoder: %v", err)
-	}
-	if err := f.Close(); err != nil {
-		log.Fatalf("Error closing metadb file: %v", err)
-	}
-	return path
-}
-
-func uploadMetadataFile(aesKey, hmacKey []byte, chunkStore chunkStoreInterface, metaFile string, chunkBytes int) {
-	dbFile, err := ioutil.ReadFile(metaFile)
-	if err != nil {
-		log.Fatalf("Error reading boltdb file: %v", err)
-	}
-	zipped := bytes.NewBuffer(nil)
-	zipper := gzip.NewWriter(zipped)
-	if _, err := zipper.Write(dbFile); err != nil {
-		log.Fatalf("Error gzipping boltdb file: %v", err)
-	}
-	if err := zipper.Close(); err != nil {
-		log.Fatalf("Error gzipping boltdb file: %v", err)
-	}
-	zippedBytes := int64(zipped.Len())
-	chunks, err := encryptFile(aesKey, hmacKey, makeIV, nil, chunkStore, chunkBytes, "boltdbmeta", zipped, zippedBytes, true)
-	if err != nil {
-		log.Fatal(err)
-	}
-	entry := meta.Entry{
-		zippedBytes,
-		chunks,
-		0600,
-		"",
-		"",
-	}
-	encoded, err := meta.EncodeEntry(&entry)
-	if err != nil {
-		log.Fatalf("Error encoding entry: %v", err)
-	}
-	ciphertext, _, err := crypto.Encrypt(aesKey, hmacKey, metaIV, encoded, chunkBytes)
-	if err := chunkStore.Save("meta", ciphertext); err != nil {
-		log.Fatalf("Error uploading meta file: %v", err)
-	}
-}
-
-func encryptFileAndStoreMetadata(aesKey, hmacKey []byte, chunkStore chunkStoreInterface, chunkBytes int, db *meta.DB, file string, fi os.FileInfo, uploadIfUnchanged bool) {
-	f, err := os.Open(file)
-	if err != nil {
-		log.Fatal("Error opening file for encryption: ", err)
-	}
-	defer f.Close()
-
-	chunks, err := encryptFile(aesKey, hmacKey, makeIV, db, chunkStore, chunkBytes, fi.Name(), f, fi.Size(), uploadIfUnchanged)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	entry, err := makeEntry(fi, chunks)
-	if err != nil {
-		log.Fatalf("Error making entry for %q: %v", file, err)
-	}
-	newBuckets, err := db.Put(file, entry)
-	if err != nil {
-		log.Fatalf("Error putting dir %q in database: %v", file, err)
-	}
-	for _, newBucket := range newBuckets {
-		dirFI, err := os.Stat(newBucket)
-		if err != nil {
-			log.Fatalf("Error stating dir %q: %v", newBucket, err)
+// limitChunkStore wraps chunkStore to limit its transfer rates, either to the given rates, or to those in the schedule file.
+func limitChunkStore(chunkStore chunkstore.ChunkStore, upload, download, scheduleFile string) (chunkstore.ChunkStore, error) {
+	if scheduleFile != "" {
+		if upload != "" || download != "" {
+			return nil, fmt.Errorf("--limit-schedule may not be combined with --limit-upload or --limit-download")
 		}
-		dirEntry, err := makeEntry(dirFI, nil)
+		f, err := os.Open(scheduleFile)
 		if err != nil {
-			log.Fatalf("Error making entry for dir %q: %v", newBucket, err)
+			return nil, fmt.Errorf("error opening --limit-schedule: %v", err)
 		}
-		if _, err := db.Put(newBucket+"/.", dirEntry); err != nil {
-			log.Fatalf("Error putting dir %q in database: %v", newBucket, err)
+		defer f.Close()
+		schedule, err := ratelimit.ParseSchedule(f)
+		if err != nil {
+			return nil, fmt.Errorf("bad --limit-schedule: %v", err)
 		}
+		return &ratelimit.ChunkStore{
+			Store:    chunkStore,
+			Upload:   &ratelimit.Bucket{Rate: schedule.Upload},
+			Download: &ratelimit.Bucket{Rate: schedule.Download},
+		}, nil
 	}
-}
 
-func makeEntry(fi os.FileInfo, chunks []meta.Chunk) (*meta.Entry, error) {
-	st := fi.Sys().(*syscall.Stat_t)
-	owningUser, err := fscache.LookupUID(st.Uid)
+	uploadRate, err := ratelimit.ParseRate(upload)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("bad --limit-upload: %v", err)
 	}
-	owningGroup, err := fscache.LookupGID(st.Gid)
+	downloadRate, err := ratelimit.ParseRate(download)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("bad --limit-download: %v", err)
 	}
-
-	var bytes int64
-	if !fi.IsDir() {
-		bytes = fi.Size()
+	if uploadRate == 0 && downloadRate == 0 {
+		return chunkStore, nil
 	}
-
-	return &meta.Entry{
-		bytes,
-		chunks,
-		fi.Mode(),
-		owningUser,
-		owningGroup,
+	return &ratelimit.ChunkStore{
+		Store:    chunkStore,
+		Upload:   &ratelimit.Bucket{Rate: ratelimit.Constant(uploadRate)},
+		Download: &ratelimit.Bucket{Rate: ratelimit.Constant(downloadRate)},
 	}, nil
 }
 
-type ivFunc func() ([]byte, error)
-
-func makeIV() (iv []byte, err error) {
-	iv = make([]byte, aes.BlockSize)
-	if _, err = rand.Read(iv); err != nil {
-		return nil, err
-	}
-	return iv, nil
-}
-
-// db may be nil if uploadIfUnchanged is true.
-func encryptFile(aesKey, hmacKey []byte, makeIV ivFunc, db *meta.DB, chunkStore chunkStoreInterface, chunkBytes int, name string, f io.Reader, fileSize int64, uploadIfUnchanged bool) ([]meta.Chunk, error) {
-	nextChunk := files.ReadChunks(name, f, chunkBytes, fileSize)
-
-	var chunks []meta.Chunk
-
-	var oldChunks []meta.Chunk
-	if !uploadIfUnchanged {
-		oldChunks = getKnownChunks(name, db)
-	}
-
-	for i := 0; true; i++ {
-		plaintext, _, err := nextChunk()
-		if err != nil {
-			return nil, fmt.Errorf("reading file for encryption: %v", err)
-		}
-		if plaintext == nil {
-			break
-		}
-
-		if !uploadIfUnchanged && i < len(oldChunks) {
-			iv := oldChunks[i].IV
-			_, ciphertextMAC, err := crypto.Encrypt(aesKey, hmacKey, iv, plaintext, chunkBytes)
-			if err == nil && hmac.Equal(ciphertextMAC, oldChunks[i].CiphertextMAC) {
-				chunks = append(chunks, oldChunks[i])
-				continue
-			}
-		}
-
-		iv, err := makeIV()
-		if err != nil {
-			return nil, fmt.Errorf("making IV: %v", err)
-		}
-
-		ciphertext, ciphertextMAC, err := crypto.Encrypt(aesKey, hmacKey, iv, plaintext, chunkBytes)
-		if err != nil {
-			return nil, fmt.Errorf("encrypting file: %v", err)
-		}
-		ciphertextMACString := hex.EncodeToString(ciphertextMAC)
-
-		if err := chunkStore.Save(ciphertextMACString, ciphertext); err != nil {
-			return nil, fmt.Errorf("saving encrypted file: %v", err)
-		}
-
-		chunks = append(chunks, meta.Chunk{iv, ciphertextMAC})
+// convertMetadata copies every entry in the metadata database at from into a new one at to, using the named backends.
+// Decoys are only stored by the bolt backend, so aren't copied.
+func convertMetadata(from, fromBackend, to, toBackend string) (int, error) {
+	if _, err := os.Stat(from); err != nil {
+		return 0, err
 	}
-	return chunks, nil
-}
-
-func getKnownChunks(name string, db *meta.DB) []meta.Chunk {
-	entries, err := db.Get(name)
+	src, err := openMetadataStore(from, fromBackend)
 	if err != nil {
-		return nil
+		return 0, err
 	}
-	entry, ok := entries[name]
-	if !ok {
-		return nil
+	defer src.Close()
+	dst, err := openMetadataStore(to, toBackend)
+	if err != nil {
+		return 0, err
 	}
-	return entry.Chunks
+	defer dst.Close()
+	return meta.Copy(dst, src)
 }
 
-func decryptFile(aesKey, hmacKey []byte, chunkStore chunkStoreInterface, e *meta.Entry, tempDir, file string) {
-	outFile, err := ioutil.TempFile(tempDir, filepath.Base(file))
-	defer outFile.Close()
-	if err != nil {
-		log.Fatal("Error making temporary file for writing: ", err)
+func openMetadataStore(path, backend string) (meta.Store, error) {
+	switch backend {
+	case "bolt":
+		return meta.NewDB(path)
+	case "sqlite":
+		return sqlite.NewDB(path)
 	}
+	return nil, fmt.Errorf("metadata backend must be bolt or sqlite, got %q", backend)
+}
 
-	if err := decryptChunks(aesKey, hmacKey, outFile, chunkStore, e); err != nil {
-		log.Fatal(err)
+// formatListEntry formats an entry like ls -l: its mode, owner, group, size in bytes, and path. Directories' paths end in "/".
+// Owners without names are shown by numeric ID.
+func formatListEntry(path string, e meta.Entry) string {
+	if e.Mode.IsDir() && path != "." {
+		path += "/"
 	}
-
-	if err := os.Chmod(outFile.Name(), e.Mode); err != nil {
-		log.Fatalf("Error chmoding file %v to %v: %v", outFile.Name(), strconv.FormatUint(uint64(e.Mode), 8), err)
+	owner, group := e.User, e.Group
+	if owner == "" && e.HasIDs {
+		owner = strconv.FormatUint(uint64(e.UID), 10)
 	}
-	chown(file, outFile.Name(), e)
-	if err := os.Rename(outFile.Name(), file); err != nil {
-		log.Fatalf("Error renaming temporary file %v to output file %v: %v", outFile.Name(), file, err)
+	if group == "" && e.HasIDs {
+		group = strconv.FormatUint(uint64(e.GID), 10)
 	}
+	return fmt.Sprintf("%v %v %v %d %v", e.Mode, owner, group, e.Bytes, path)
 }
 
-func decryptChunks(aesKey, hmacKey []byte, dst io.Writer, chunkStore chunkStoreInterface, e *meta.Entry) error {
-	var accumulatedLength int64
+// mappingFlag is a flag which may be repeated, each time with a value of the form old:new.
+type mappingFlag map[string]string
 
-	for _, chunk := range e.Chunks {
-		ciphertext, err := chunkStore.Read(hex.EncodeToString(chunk.CiphertextMAC))
-		if err != nil {
-			return fmt.Errorf("error reading encrypted chunk: %v", err)
-		}
+func (m mappingFlag) String() string {
+	pairs := make([]string, 0, len(m))
+	for from, to := range m {
+		pairs = append(pairs, from+":"+to)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
 
-		plaintextChunk, err := crypto.Decrypt(aesKey, hmacKey, chunk.IV, ciphertext, chunk.CiphertextMAC)
-		if err != nil {
-			return fmt.Errorf("decrypting chunk %s (length: %v) with IV %s got error %v", chunk.CiphertextMAC, len(ciphertext), chunk.IV, err)
-		}
-		if accumulatedLength+int64(len(plaintextChunk)) > e.Bytes {
-			plaintextChunk = plaintextChunk[:int(e.Bytes-accumulatedLength)]
-		}
-		accumulatedLength += int64(len(plaintextChunk))
-		if _, err := dst.Write(plaintextChunk); err != nil {
-			return fmt.Errorf("error writing decrypted file: %v", err)
-		}
+func (m mappingFlag) Set(value string) error {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("want old:new, got %q", value)
 	}
+	m[parts[0]] = parts[1]
 	return nil
 }
 
-func chown(nameForErrors, path string, e *meta.Entry) {
-	uid, err := fscache.LookupUser(e.User)
+// parseTimeFlag parses either a duration (e.g. 72h), which is interpreted as relative to now, or an RFC 3339 timestamp.
+func parseTimeFlag(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
 	if err != nil {
-		log.Printf("Could not find user %q on this system - skipping chown for %q (%v)", e.User, nameForErrors, err)
-	} else {
-		gid, err := fscache.LookupGroup(e.Group)
-		if err != nil {
-			log.Printf("Could not find group %q on this system - skipping chown for %q (%v)", e.Group, nameForErrors, err)
-		} else {
-			if err := os.Chown(path, int(uid), int(gid)); err != nil {
-				log.Printf("Error chowning file %v (for %q): %v", path, nameForErrors, err)
-			}
-		}
+		return time.Time{}, fmt.Errorf("%q is neither a duration nor an RFC 3339 timestamp", value)
 	}
-}
-
-type chunkStoreInterface interface {
-	Read(hmac string) ([]byte, error)
-	Save(hmac string, contents []byte) error
+	return t, nil
 }
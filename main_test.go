@@ -1,120 +1,107 @@
 package main
 
 import (
-	"bytes"
-	"crypto/aes"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/illicitonion/cloudbackup/meta"
 )
 
-func TestEncryptUploads(t *testing.T) {
-	chunkStore := &recordingChunkStore{}
-	db := makeDB(t)
-	do(t, db, chunkStore, "01234567890123456", true, 0x01)
-	want := map[string][]byte{
-		"500002b7d895d882170ea0823388708be81ca5f5f64f2c358e6cb7ee7ca16e37": []byte{
-			0x09, 0xB3, 0x76, 0x13, 0x6D, 0x0B, 0xF6, 0x2E,
-			0xD6, 0xD0, 0x1C, 0x73, 0xE7, 0xF3, 0xD3, 0x99,
-		},
-		"bfda79581f572a70cd481efb63ef6f07e52f3e45afb21ca35a452a3e49e77e4b": []byte{
-			0x87, 0x6B, 0x7D, 0xE4, 0xE8, 0xFF, 0xD0, 0x59,
-			0xF0, 0x79, 0x30, 0x9E, 0xC1, 0xE9, 0x8C, 0xC0,
-		},
-	}
-	if !reflect.DeepEqual(want, chunkStore.saves) {
-		t.Errorf("saves: want %v got %v", want, chunkStore.saves)
+func TestFormatListEntry(t *testing.T) {
+	for _, tc := range []struct {
+		path  string
+		entry meta.Entry
+		want  string
+	}{
+		{"dir", meta.Entry{Mode: 0750 | os.ModeDir, User: "foo", Group: "bar"}, "drwxr-x--- foo bar 0 dir/"},
+		{"dir/file", meta.Entry{Bytes: 10, Mode: 0600, User: "foo", Group: "bar"}, "-rw------- foo bar 10 dir/file"},
+		{"unnamed", meta.Entry{Mode: 0600, Group: "bar", UID: 1234, GID: 5, HasIDs: true}, "-rw------- 1234 bar 0 unnamed"},
+	} {
+		if got := formatListEntry(tc.path, tc.entry); got != tc.want {
+			t.Errorf("%q: want %q got %q", tc.path, tc.want, got)
+		}
 	}
 }
 
-func TestEncryptNoChangeUpload(t *testing.T) {
-	chunkStore := &recordingChunkStore{}
-	db := makeDB(t)
-	do(t, db, chunkStore, "01234567890123456", true, 0x01)
-	chunkStore.Reset()
-	do(t, db, chunkStore, "11234567890123456", true, 0x02)
-	want := map[string][]byte{
-		"cd6ebe78f3a66a4db47e8c8a704970b341192f8d9f4035ee9c63455f9915c644": []byte{
-			0xA2, 0xF8, 0x17, 0x63, 0x1C, 0x54, 0x34, 0xAC,
-			0xDB, 0x20, 0x87, 0x4E, 0xC2, 0xAD, 0x18, 0x21,
-		},
-		"3016e83f0931efa1ffff6529af142588dbe5dc63968693ad1fe0ee8452adb1cc": []byte{
-			0xDF, 0x1D, 0x67, 0xA3, 0x5C, 0xD2, 0x2F, 0xEE,
-			0x75, 0x18, 0x44, 0x0B, 0x15, 0x10, 0x4A, 0xA4,
-		},
+func TestMappingFlag(t *testing.T) {
+	m := make(mappingFlag)
+	for _, value := range []string{"alice:bob", "1000:0", "alice:carol"} {
+		if err := m.Set(value); err != nil {
+			t.Errorf("%q: %v", value, err)
+		}
+	}
+	if want := "1000:0,alice:carol"; m.String() != want {
+		t.Errorf("want %q got %q", want, m.String())
 	}
-	if !reflect.DeepEqual(want, chunkStore.saves) {
-		t.Errorf("saves: want %v got % X", want, chunkStore.saves)
+	for _, value := range []string{"alice", ":bob", "alice:"} {
+		if err := m.Set(value); err == nil {
+			t.Errorf("%q: want error got nil", value)
+		}
 	}
 }
 
-func TestEncryptNoChangeNoUpload(t *testing.T) {
-	chunkStore := &recordingChunkStore{}
-	db := makeDB(t)
-	do(t, db, chunkStore, "01234567890123456", false, 0x01)
-	chunkStore.Reset()
-	do(t, db, chunkStore, "01234567890123456", false, 0x02)
-	want := map[string][]byte{}
-	if !reflect.DeepEqual(want, chunkStore.saves) {
-		t.Errorf("saves: want %v got %v", want, chunkStore.saves)
+func TestParseTimeFlag(t *testing.T) {
+	now := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	for value, want := range map[string]time.Time{
+		"":                     time.Time{},
+		"2h":                   time.Date(2017, 6, 1, 10, 0, 0, 0, time.UTC),
+		"2017-01-02T03:04:05Z": time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC),
+	} {
+		got, err := parseTimeFlag(value, now)
+		if err != nil {
+			t.Errorf("%q: want nil err got %v", value, err)
+		}
+		if !got.Equal(want) {
+			t.Errorf("%q: want %v got %v", value, want, got)
+		}
+	}
+	if _, err := parseTimeFlag("yesterday", now); err == nil {
+		t.Errorf("yesterday: want err got nil")
 	}
 }
 
-func makeDB(t *testing.T) *meta.DB {
-	f, err := ioutil.TempFile("", "")
+func TestConvertMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
 	if err != nil {
 		t.Fatal(err)
 	}
-	dbPath := f.Name()
-	if err := f.Close(); err != nil {
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	db, err := meta.NewDB(src)
+	if err != nil {
 		t.Fatal(err)
 	}
-	db, err := meta.NewDB(dbPath)
-	if err != nil {
+	want := meta.Entry{Bytes: 3, Mode: 0600, User: "foo", Group: "bar"}
+	if _, err := db.Put("dir/file", &want); err != nil {
 		t.Fatal(err)
 	}
-	return db
-}
+	db.Close()
 
-func do(t *testing.T, db *meta.DB, chunkStore chunkStoreInterface, v string, uploadIfUnchanged bool, ivByte byte) {
-	makeIV := func() ([]byte, error) {
-		return bytes.Repeat([]byte{ivByte}, aes.BlockSize), nil
+	converted, back := filepath.Join(dir, "converted"), filepath.Join(dir, "back")
+	if n, err := convertMetadata(src, "bolt", converted, "sqlite"); err != nil || n != 1 {
+		t.Fatalf("to sqlite: want 1 converted got %v, %v", n, err)
 	}
-
-	path := "filename"
-	chunks, err := encryptFile(bytes.Repeat([]byte{0x02}, 32), bytes.Repeat([]byte{0x03}, 32), makeIV, db, chunkStore, 16, path, bytes.NewBufferString(v), int64(len(v)), uploadIfUnchanged)
+	if n, err := convertMetadata(converted, "sqlite", back, "bolt"); err != nil || n != 1 {
+		t.Fatalf("to bolt: want 1 converted got %v, %v", n, err)
+	}
+	db, err = meta.NewDB(back)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if _, err := db.Put(path, &meta.Entry{
-		Bytes:  int64(len(v)),
-		Chunks: chunks,
-		Mode:   0777,
-		User:   "",
-		Group:  "",
-	}); err != nil {
+	defer db.Close()
+	got, err := db.Get("dir/file")
+	if err != nil {
 		t.Fatal(err)
 	}
-}
-
-type recordingChunkStore struct {
-	saves map[string][]byte
-}
-
-func (s *recordingChunkStore) Save(hmac string, contents []byte) error {
-	if s.saves == nil {
-		s.Reset()
+	if !reflect.DeepEqual(want, got["dir/file"]) {
+		t.Errorf("want %v got %v", want, got["dir/file"])
 	}
-	s.saves[hmac] = contents
-	return nil
-}
-
-func (s *recordingChunkStore) Read(hmac string) ([]byte, error) {
-	return nil, nil
-}
 
-func (s *recordingChunkStore) Reset() {
-	s.saves = make(map[string][]byte)
+	if _, err := convertMetadata(src, "csv", filepath.Join(dir, "csv"), "bolt"); err == nil {
+		t.Errorf("bad backend: want error got nil")
+	}
 }
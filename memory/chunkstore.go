@@ -0,0 +1,143 @@
+// Package memory implements a chunkstore.ChunkStore which keeps chunks in memory. It is mostly useful for tests.
+package memory
+
+import (
+	"context"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/illicitonion/cloudbackup/chunkstore"
+)
+
+// ChunkStore is safe for concurrent use. The zero value is an empty store ready to use.
+type ChunkStore struct {
+	mu     sync.Mutex
+	chunks map[string]chunk
+}
+
+type chunk struct {
+	contents []byte
+	modTime  time.Time
+	version  int64
+}
+
+func (b *ChunkStore) Read(ctx context.Context, hmac string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, ok := b.chunks[hmac]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return append([]byte(nil), c.contents...), nil
+}
+
+func (b *ChunkStore) Save(ctx context.Context, hmac string, contents []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.save(hmac, contents)
+	return nil
+}
+
+// save stores contents under name, with the next version. b.mu must be held.
+func (b *ChunkStore) save(name string, contents []byte) {
+	if b.chunks == nil {
+		b.chunks = make(map[string]chunk)
+	}
+	b.chunks[name] = chunk{append([]byte(nil), contents...), time.Now(), b.chunks[name].version + 1}
+}
+
+func (b *ChunkStore) ReadVersion(ctx context.Context, name string) ([]byte, int64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, ok := b.chunks[name]
+	if !ok {
+		return nil, 0, os.ErrNotExist
+	}
+	return append([]byte(nil), c.contents...), c.version, nil
+}
+
+func (b *ChunkStore) SaveIfVersion(ctx context.Context, name string, contents []byte, version int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// Deleted blobs keep no version, so a blob which is re-created can't be mistaken for the one which was deleted.
+	if b.chunks[name].version != version {
+		return chunkstore.ErrVersionMismatch
+	}
+	b.save(name, contents)
+	return nil
+}
+
+func (b *ChunkStore) Exists(ctx context.Context, hmac string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.chunks[hmac]
+	return ok, nil
+}
+
+func (b *ChunkStore) List(ctx context.Context, prefix string, fn func(hmac string) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// Copy the names so that fn may call back into the store.
+	b.mu.Lock()
+	var names []string
+	for name := range b.chunks {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	b.mu.Unlock()
+	for _, name := range names {
+		if err := fn(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *ChunkStore) Delete(ctx context.Context, hmac string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.chunks[hmac]; !ok {
+		return os.ErrNotExist
+	}
+	delete(b.chunks, hmac)
+	return nil
+}
+
+func (b *ChunkStore) Stat(ctx context.Context, hmac string) (chunkstore.Info, error) {
+	if err := ctx.Err(); err != nil {
+		return chunkstore.Info{}, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, ok := b.chunks[hmac]
+	if !ok {
+		return chunkstore.Info{}, os.ErrNotExist
+	}
+	return chunkstore.Info{
+		Name:    hmac,
+		Size:    int64(len(c.contents)),
+		ModTime: c.modTime,
+	}, nil
+}
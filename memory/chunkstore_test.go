@@ -0,0 +1,14 @@
+package memory
+
+import (
+	"testing"
+
+	"github.com/illicitonion/cloudbackup/chunkstore"
+	"github.com/illicitonion/cloudbackup/chunkstore/chunkstoretest"
+)
+
+func TestChunkStoreConformance(t *testing.T) {
+	chunkstoretest.Run(t, func(t *testing.T) (chunkstore.ChunkStore, func()) {
+		return &ChunkStore{}, func() {}
+	})
+}
@@ -0,0 +1,254 @@
+package meta
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+// Format is a format which the DB can be exported to and imported from, which, unlike the DB itself, can be read without this package.
+type Format int
+
+const (
+	// JSON is a single JSON object, with "entries" and "decoys" arrays.
+	JSON Format = iota
+	// JSONLines is one JSON object per line: either an entry, or an object with a "decoy" field naming a decoy chunk.
+	JSONLines
+)
+
+// ParseFormat parses "json" or "jsonl".
+func ParseFormat(value string) (Format, error) {
+	switch value {
+	case "json":
+		return JSON, nil
+	case "jsonl":
+		return JSONLines, nil
+	}
+	return 0, fmt.Errorf("format must be json or jsonl, got %q", value)
+}
+
+// jsonEntry is the exported form of the Entry at Path. Directories are exported at their own path, rather than at "dir/.".
+// Mode is an os.FileMode: the permission bits, with 1<<31 set for directories. UID and GID are omitted if the Entry has no numeric IDs.
+type jsonEntry struct {
+	Path   string      `json:"path"`
+	Bytes  int64       `json:"bytes"`
+	Mode   os.FileMode `json:"mode"`
+	User   string      `json:"user"`
+	Group  string      `json:"group"`
+	UID    *uint32     `json:"uid,omitempty"`
+	GID    *uint32     `json:"gid,omitempty"`
+	Chunks []jsonChunk `json:"chunks"`
+}
+
+// jsonChunk is the exported form of a Chunk, with its IV and MAC hex-encoded.
+type jsonChunk struct {
+	IV  string `json:"iv"`
+	MAC string `json:"mac"`
+}
+
+type jsonDump struct {
+	Entries []jsonEntry `json:"entries"`
+	Decoys  []string    `json:"decoys"`
+}
+
+// jsonLine is a line of JSONLines, which is a decoy if Decoy is set, and an entry otherwise.
+type jsonLine struct {
+	jsonEntry
+	Decoy string `json:"decoy"`
+}
+
+// Export writes every entry, in the order Walk visits them, and every decoy, to w. Entries are written as they are read, rather than all being held in memory.
+func (d *DB) Export(w io.Writer, format Format) error {
+	decoys, err := d.Decoys()
+	if err != nil {
+		return err
+	}
+	if decoys == nil {
+		decoys = []string{}
+	}
+
+	if format == JSON {
+		return d.exportJSON(w, decoys)
+	}
+	enc := json.NewEncoder(w)
+	if err := d.walkExported(func(je *jsonEntry) error {
+		return enc.Encode(je)
+	}); err != nil {
+		return err
+	}
+	for _, decoy := range decoys {
+		if err := enc.Encode(map[string]string{"decoy": decoy}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportJSON writes a jsonDump to w an entry at a time.
+func (d *DB) exportJSON(w io.Writer, decoys []string) error {
+	if _, err := io.WriteString(w, "{\n  \"entries\": ["); err != nil {
+		return err
+	}
+	separator := "\n    "
+	if err := d.walkExported(func(je *jsonEntry) error {
+		encoded, err := json.MarshalIndent(je, "    ", "  ")
+		if err != nil {
+			return fmt.Errorf("meta: error encoding entry for path %q: %v", je.Path, err)
+		}
+		if _, err := io.WriteString(w, separator); err != nil {
+			return err
+		}
+		separator = ",\n    "
+		_, err = w.Write(encoded)
+		return err
+	}); err != nil {
+		return err
+	}
+	encoded, err := json.MarshalIndent(decoys, "  ", "  ")
+	if err != nil {
+		return fmt.Errorf("meta: error encoding decoys: %v", err)
+	}
+	_, err = fmt.Fprintf(w, "\n  ],\n  \"decoys\": %s\n}\n", encoded)
+	return err
+}
+
+// walkExported calls fn with every entry, converted for export. An empty DB has no entries.
+func (d *DB) walkExported(fn func(*jsonEntry) error) error {
+	if empty, err := d.Empty(); err != nil || empty {
+		return err
+	}
+	return d.Walk(string(root), func(path string, e Entry) error {
+		je := jsonEntry{
+			Path:   path,
+			Bytes:  e.Bytes,
+			Mode:   e.Mode,
+			User:   e.User,
+			Group:  e.Group,
+			Chunks: make([]jsonChunk, 0, len(e.Chunks)),
+		}
+		if e.HasIDs {
+			je.UID, je.GID = &e.UID, &e.GID
+		}
+		for _, c := range e.Chunks {
+			je.Chunks = append(je.Chunks, jsonChunk{hex.EncodeToString(c.IV), hex.EncodeToString(c.CiphertextMAC)})
+		}
+		return fn(&je)
+	})
+}
+
+// Import replaces every entry and decoy with those read from r, as written by Export. Nothing is replaced if r can't be read.
+func (d *DB) Import(r io.Reader, format Format) error {
+	var dump jsonDump
+	if format == JSON {
+		if err := json.NewDecoder(r).Decode(&dump); err != nil {
+			return fmt.Errorf("meta: error decoding entries: %v", err)
+		}
+	} else {
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(nil, 64<<20)
+		for n := 1; scanner.Scan(); n++ {
+			if strings.TrimSpace(scanner.Text()) == "" {
+				continue
+			}
+			var line jsonLine
+			if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+				return fmt.Errorf("meta: error decoding line %d: %v", n, err)
+			}
+			if line.Decoy != "" {
+				dump.Decoys = append(dump.Decoys, line.Decoy)
+			} else {
+				dump.Entries = append(dump.Entries, line.jsonEntry)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("meta: error reading entries: %v", err)
+		}
+	}
+
+	paths := make([]string, 0, len(dump.Entries))
+	encoded := make([][]byte, 0, len(dump.Entries))
+	for _, je := range dump.Entries {
+		path, buf, err := decodeJSONEntry(&je)
+		if err != nil {
+			return err
+		}
+		paths = append(paths, path)
+		encoded = append(encoded, buf)
+	}
+
+	d.mu.Lock()
+	for _, path := range paths {
+		d.changed[path] = true
+	}
+	d.mu.Unlock()
+
+	return d.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{root, decoysBucket} {
+			if tx.Bucket(name) != nil {
+				if err := tx.DeleteBucket(name); err != nil {
+					return fmt.Errorf("meta: error deleting %s bucket: %v", name, err)
+				}
+			}
+		}
+		for i, path := range paths {
+			if _, err := put(tx, path, encoded[i]); err != nil {
+				return err
+			}
+		}
+		if len(dump.Decoys) == 0 {
+			return nil
+		}
+		bucket, err := tx.CreateBucket(decoysBucket)
+		if err != nil {
+			return fmt.Errorf("meta: creating decoys bucket: %v", err)
+		}
+		for _, decoy := range dump.Decoys {
+			if err := bucket.Put([]byte(decoy), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// decodeJSONEntry returns the path at which to Put je, and its encoded Entry.
+func decodeJSONEntry(je *jsonEntry) (string, []byte, error) {
+	if je.Path == "" || je.Path == string(root) || strings.HasPrefix(je.Path, "/") {
+		return "", nil, fmt.Errorf("meta: bad path %q: want a relative path", je.Path)
+	}
+	e := Entry{
+		Bytes: je.Bytes,
+		Mode:  je.Mode,
+		User:  je.User,
+		Group: je.Group,
+	}
+	if je.UID != nil && je.GID != nil {
+		e.UID, e.GID, e.HasIDs = *je.UID, *je.GID, true
+	}
+	for _, c := range je.Chunks {
+		iv, err := hex.DecodeString(c.IV)
+		if err != nil {
+			return "", nil, fmt.Errorf("meta: bad IV for %q: %v", je.Path, err)
+		}
+		mac, err := hex.DecodeString(c.MAC)
+		if err != nil {
+			return "", nil, fmt.Errorf("meta: bad MAC for %q: %v", je.Path, err)
+		}
+		e.Chunks = append(e.Chunks, Chunk{iv, mac})
+	}
+	buf, err := EncodeEntry(&e)
+	if err != nil {
+		return "", nil, fmt.Errorf("meta: error encoding entry for path %q: %v", je.Path, err)
+	}
+	path := je.Path
+	if e.Mode.IsDir() {
+		path += "/" + string(root)
+	}
+	return path, buf, nil
+}
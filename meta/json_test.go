@@ -0,0 +1,116 @@
+package meta
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExportImportRoundTrip(t *testing.T) {
+	dirEntry := Entry{Mode: 0750 | os.ModeDir, User: "foo", Group: "bar"}
+	want := map[string]Entry{
+		"file":        entry,
+		"dir/":        dirEntry,
+		"dir/file":    otherEntry,
+		"dir/sub/new": {Bytes: 0, Chunks: nil, Mode: 0600, User: "", Group: "bar", UID: 0, GID: 20, HasIDs: true},
+	}
+	for _, format := range []Format{JSON, JSONLines} {
+		exported, cleanup := makeDB(t)
+		defer cleanup()
+		for path, e := range map[string]Entry{"file": entry, "dir/.": dirEntry, "dir/file": otherEntry, "dir/sub/new": want["dir/sub/new"]} {
+			e := e
+			if _, err := exported.Put(path, &e); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := exported.PutDecoy("aa"); err != nil {
+			t.Fatal(err)
+		}
+		buf := bytes.NewBuffer(nil)
+		if err := exported.Export(buf, format); err != nil {
+			t.Fatal(err)
+		}
+
+		imported, cleanup := makeDB(t)
+		defer cleanup()
+		if _, err := imported.Put("stale", &entry); err != nil {
+			t.Fatal(err)
+		}
+		if err := imported.PutDecoy("bb"); err != nil {
+			t.Fatal(err)
+		}
+		if err := imported.Import(bytes.NewReader(buf.Bytes()), format); err != nil {
+			t.Fatalf("format %v: %v\n%s", format, err, buf)
+		}
+		got, err := imported.Get(".")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(want, got) {
+			t.Errorf("format %v: want %v got %v", format, want, got)
+		}
+		if decoys, err := imported.Decoys(); err != nil || !reflect.DeepEqual(decoys, []string{"aa"}) {
+			t.Errorf("format %v: decoys: want [aa] got %v, %v", format, decoys, err)
+		}
+	}
+}
+
+func TestExportJSONLines(t *testing.T) {
+	db, cleanup := makeDB(t)
+	defer cleanup()
+	if _, err := db.Put("file", &entry); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutDecoy("aa"); err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := db.Export(buf, JSONLines); err != nil {
+		t.Fatal(err)
+	}
+	want := `{"path":"file","bytes":10,"mode":448,"user":"foo","group":"bar","chunks":[{"iv":"00000000000000000000000000000000","mac":"ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff"}]}
+{"decoy":"aa"}
+`
+	if got := buf.String(); got != want {
+		t.Errorf("want:\n%s\ngot:\n%s", want, got)
+	}
+}
+
+func TestImportErrors(t *testing.T) {
+	for _, tc := range []struct {
+		format Format
+		dump   string
+	}{
+		{JSON, `{"entries": [`},
+		{JSON, `{"entries": [{"path": "", "mode": 384}]}`},
+		{JSON, `{"entries": [{"path": "/abs", "mode": 384}]}`},
+		{JSONLines, `{"path": "file", "chunks": [{"iv": "zz", "mac": "00"}]}`},
+		{JSONLines, `{"path": "file", "chunks": [{"iv": "00", "mac": "zz"}]}`},
+		{JSONLines, "{\"path\": \"file\"}\nnot json"},
+	} {
+		db, cleanup := makeDB(t)
+		if _, err := db.Put("kept", &entry); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Import(strings.NewReader(tc.dump), tc.format); err == nil {
+			t.Errorf("%q: want error got nil", tc.dump)
+		}
+		if got, err := db.Get("kept"); err != nil || len(got) != 1 {
+			t.Errorf("%q: want existing entries kept got %v, %v", tc.dump, got, err)
+		}
+		cleanup()
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	for value, want := range map[string]Format{"json": JSON, "jsonl": JSONLines} {
+		if got, err := ParseFormat(value); err != nil || got != want {
+			t.Errorf("%q: want %v got %v, %v", value, want, got, err)
+		}
+	}
+	if _, err := ParseFormat("xml"); err == nil {
+		t.Errorf("xml: want error got nil")
+	}
+}
@@ -6,7 +6,9 @@ import (
 	"fmt"
 	"os"
 	"reflect"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/boltdb/bolt"
 )
@@ -17,6 +19,11 @@ type Entry struct {
 	Mode   os.FileMode
 	User   string
 	Group  string
+	// UID and GID are the numeric IDs of the owning user and group, if HasIDs is set; entries stored by older versions only have names.
+	// User and Group are empty if the IDs had no name on the backed up system.
+	UID    uint32
+	GID    uint32
+	HasIDs bool
 }
 
 type Chunk struct {
@@ -24,16 +31,63 @@ type Chunk struct {
 	CiphertextMAC []byte
 }
 
+// Store is a metadata database. DB is the one used by backups; other implementations store the same entries in ways which suit other queries.
+// Repositories only ever use a DB, as they rely on what a Store doesn't provide: tracking which paths changed, decoys, and storing the DB's
+// buckets as shards in the chunk store. Other Stores hold copies of a repository's entries, made with Copy, e.g. to be queried offline.
+type Store interface {
+	// Put stores entry at path, where the entry for a directory is stored at "dir/.".
+	// It returns the paths of the directories containing path which didn't already exist.
+	Put(path string, entry *Entry) ([]string, error)
+	// Get returns the entry at path, along with the entries of the directories containing it. If path is a directory, it instead returns
+	// every entry under it, with the keys of directories' own entries ending in "/". A path of "." returns every entry.
+	Get(path string) (map[string]Entry, error)
+	Close()
+}
+
+// Copy puts every entry in src into dst, returning how many entries were copied. src must not be empty.
+func Copy(dst, src Store) (int, error) {
+	entries, err := src.Get(string(root))
+	if err != nil {
+		return 0, err
+	}
+	paths := make([]string, 0, len(entries))
+	for path := range entries {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for i, path := range paths {
+		e := entries[path]
+		putPath := path
+		if strings.HasSuffix(path, "/") {
+			putPath += string(root)
+		}
+		if _, err := dst.Put(putPath, &e); err != nil {
+			return i, err
+		}
+	}
+	return len(paths), nil
+}
+
+// NewDB opens the database at path, creating it if it doesn't exist, and upgrading it to SchemaVersion if it is older.
 func NewDB(path string) (*DB, error) {
 	db, err := bolt.Open(path, 0600, nil)
 	if err != nil {
 		return nil, err
 	}
-	return &DB{db}, nil
+	if err := db.Update(func(tx *bolt.Tx) error {
+		return migrate(tx, schemaVersion(tx))
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &DB{db: db, changed: make(map[string]bool)}, nil
 }
 
 type DB struct {
 	db *bolt.DB
+
+	mu      sync.Mutex
+	changed map[string]bool
 }
 
 var root = []byte{'.'}
@@ -44,31 +98,44 @@ func (d *DB) Put(path string, entry *Entry) ([]string, error) {
 		return nil, fmt.Errorf("meta: error encoding entry for path %q: %v", path, err)
 	}
 
+	d.mu.Lock()
+	d.changed[path] = true
+	d.mu.Unlock()
+
+	var createdBuckets []string
+	err = d.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		createdBuckets, err = put(tx, path, buf)
+		return err
+	})
+	return createdBuckets, err
+}
+
+// put stores the encoded entry buf at path, returning the paths of the buckets it created.
+func put(tx *bolt.Tx, path string, buf []byte) ([]string, error) {
 	createdBuckets := make([]string, 0)
 
-	return createdBuckets, d.db.Update(func(tx *bolt.Tx) error {
-		bucket, err := tx.CreateBucketIfNotExists(root)
-		if err != nil {
-			return fmt.Errorf("meta: creating/getting root bucket: %v", err)
-		}
-		parts := strings.Split(path, "/")
-		last := len(parts) - 1
+	bucket, err := tx.CreateBucketIfNotExists(root)
+	if err != nil {
+		return nil, fmt.Errorf("meta: creating/getting root bucket: %v", err)
+	}
+	parts := strings.Split(path, "/")
+	last := len(parts) - 1
 
-		for i, part := range parts[:last] {
-			child := bucket.Bucket([]byte(part))
-			if child != nil {
-				bucket = child
-			} else {
-				bucket, err = bucket.CreateBucket([]byte(part))
-				bucketPath := strings.Join(parts[:i+1], "/")
-				if err != nil {
-					return fmt.Errorf("meta: creating/getting bucket %v: %v", bucketPath, err)
-				}
-				createdBuckets = append(createdBuckets, bucketPath)
+	for i, part := range parts[:last] {
+		child := bucket.Bucket([]byte(part))
+		if child != nil {
+			bucket = child
+		} else {
+			bucket, err = bucket.CreateBucket([]byte(part))
+			bucketPath := strings.Join(parts[:i+1], "/")
+			if err != nil {
+				return nil, fmt.Errorf("meta: creating/getting bucket %v: %v", bucketPath, err)
 			}
+			createdBuckets = append(createdBuckets, bucketPath)
 		}
-		return bucket.Put([]byte(parts[last]), buf)
-	})
+	}
+	return createdBuckets, bucket.Put([]byte(parts[last]), buf)
 }
 
 func (d *DB) Get(path string) (entries map[string]Entry, err error) {
@@ -168,6 +235,138 @@ func (d *DB) Get(path string) (entries map[string]Entry, err error) {
 	return
 }
 
+// Walk calls fn with the entries of the directories containing prefix, with prefix's own entry, and, if prefix is a directory, with every entry under it.
+// Entries are visited in lexical order of their paths' components, so each directory's entry is visited before anything in it. Directories' entries are
+// passed with the directory's path. A prefix of "." walks every entry.
+//
+// Unlike Get, Walk doesn't hold every entry in memory at once. fn must not modify the DB. If fn returns an error, Walk stops and returns it.
+func (d *DB) Walk(prefix string, fn func(path string, e Entry) error) error {
+	return d.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(root)
+		if bucket == nil {
+			return fmt.Errorf("meta: no root bucket")
+		}
+		if prefix == string(root) {
+			return walkBucket(bucket, "", fn)
+		}
+		parts := strings.Split(prefix, "/")
+		last := len(parts) - 1
+		for i, part := range parts[:last] {
+			bucket = bucket.Bucket([]byte(part))
+			bucketPath := strings.Join(parts[:i+1], "/")
+			if bucket == nil {
+				return fmt.Errorf("meta: no bucket %v", bucketPath)
+			}
+			if v := bucket.Get(root); v != nil {
+				if err := visitEntry(bucketPath, v, fn); err != nil {
+					return err
+				}
+			}
+		}
+		if v := bucket.Get([]byte(parts[last])); v != nil {
+			return visitEntry(prefix, v, fn)
+		}
+		child := bucket.Bucket([]byte(parts[last]))
+		if child == nil {
+			return fmt.Errorf("meta: could not find file %q", prefix)
+		}
+		return walkBucket(child, prefix, fn)
+	})
+}
+
+// walkBucket visits the entries in bucket, which is the directory at path (or the root, if path is empty), and in its subdirectories.
+func walkBucket(bucket *bolt.Bucket, path string, fn func(string, Entry) error) error {
+	// Names can sort before ".", so the directory's own entry is visited explicitly.
+	if v := bucket.Get(root); v != nil {
+		ownPath := path
+		if ownPath == "" {
+			ownPath = string(root)
+		}
+		if err := visitEntry(ownPath, v, fn); err != nil {
+			return err
+		}
+	}
+	cursor := bucket.Cursor()
+	for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+		if bytes.Equal(k, root) {
+			continue
+		}
+		childPath := string(k)
+		if path != "" {
+			childPath = path + "/" + childPath
+		}
+		var err error
+		if v == nil {
+			err = walkBucket(bucket.Bucket(k), childPath, fn)
+		} else {
+			err = visitEntry(childPath, v, fn)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func visitEntry(path string, v []byte, fn func(string, Entry) error) error {
+	e, err := DecodeEntry(v)
+	if err != nil {
+		return err
+	}
+	return fn(path, *e)
+}
+
+// Empty returns whether nothing has been Put in the DB, in which case Get fails for every path.
+func (d *DB) Empty() (bool, error) {
+	empty := true
+	err := d.db.View(func(tx *bolt.Tx) error {
+		empty = tx.Bucket(root) == nil
+		return nil
+	})
+	return empty, err
+}
+
+// Changed returns every path passed to Put since the DB was opened, in lexical order.
+func (d *DB) Changed() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	paths := make([]string, 0, len(d.changed))
+	for path := range d.changed {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+var decoysBucket = []byte("decoys")
+
+// PutDecoy records that the chunk called name is a decoy, containing random bytes, which no entry refers to.
+func (d *DB) PutDecoy(name string) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(decoysBucket)
+		if err != nil {
+			return fmt.Errorf("meta: creating/getting decoys bucket: %v", err)
+		}
+		return bucket.Put([]byte(name), nil)
+	})
+}
+
+// Decoys returns the names of every chunk recorded by PutDecoy, in lexical order.
+func (d *DB) Decoys() ([]string, error) {
+	var names []string
+	err := d.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(decoysBucket)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			names = append(names, string(k))
+			return nil
+		})
+	})
+	return names, err
+}
+
 func (d *DB) Close() {
 	d.db.Close()
 }
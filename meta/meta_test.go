@@ -3,6 +3,7 @@ package meta
 import (
 	"bytes"
 	"encoding/gob"
+	"errors"
 	"io/ioutil"
 	"log"
 	"os"
@@ -148,7 +149,7 @@ func makeDB(t *testing.T) (*DB, func()) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	return &DB{b}, func() { os.Remove(f.Name()) }
+	return &DB{db: b, changed: make(map[string]bool)}, func() { os.Remove(f.Name()) }
 }
 
 func testPut(t *testing.T, before func(*DB, *testing.T), after func(*DB, *testing.T), wantNewBuckets []string) {
@@ -208,7 +209,7 @@ func TestGetInRoot(t *testing.T) {
 		t.Fatal(err)
 	}
 	if want := map[string]Entry{"file": entry}; !reflect.DeepEqual(got, want) {
-		t.Errorf("file want % X got % X", want, got)
+		t.Errorf("file want %v got %v", want, got)
 	}
 }
 
@@ -228,7 +229,7 @@ func TestGetInDir(t *testing.T) {
 		t.Fatal(err)
 	}
 	if want := map[string]Entry{"dir/subdir/file": entry}; !reflect.DeepEqual(got, want) {
-		t.Errorf("dir/subdir/file want % X got % X", want, got)
+		t.Errorf("dir/subdir/file want %v got %v", want, got)
 	}
 }
 
@@ -308,6 +309,43 @@ func TestGetRoot(t *testing.T) {
 	}
 }
 
+func TestDecoys(t *testing.T) {
+	db, cleanup := makeDB(t)
+	defer cleanup()
+
+	got, err := db.Decoys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Errorf("decoys: want none got %v", got)
+	}
+
+	if _, err := db.Put("file", &entry); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"bb", "aa"} {
+		if err := db.PutDecoy(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err = db.Decoys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"aa", "bb"}; !reflect.DeepEqual(want, got) {
+		t.Errorf("decoys: want %v got %v", want, got)
+	}
+
+	entries, err := db.Get(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]Entry{"file": entry}; !reflect.DeepEqual(want, entries) {
+		t.Errorf("entries: want %v got %v", want, entries)
+	}
+}
+
 func encode(e *Entry) []byte {
 	buf := &bytes.Buffer{}
 	enc := gob.NewEncoder(buf)
@@ -316,3 +354,148 @@ func encode(e *Entry) []byte {
 	}
 	return buf.Bytes()[:]
 }
+
+func TestEmpty(t *testing.T) {
+	db, cleanup := makeDB(t)
+	defer cleanup()
+
+	if empty, err := db.Empty(); err != nil || !empty {
+		t.Errorf("before put: want empty got %v, %v", empty, err)
+	}
+	if _, err := db.Put("file", &entry); err != nil {
+		t.Fatal(err)
+	}
+	if empty, err := db.Empty(); err != nil || empty {
+		t.Errorf("after put: want not empty got %v, %v", empty, err)
+	}
+}
+
+func TestChanged(t *testing.T) {
+	db, cleanup := makeDB(t)
+	defer cleanup()
+
+	if got := db.Changed(); len(got) != 0 {
+		t.Errorf("changed: want none got %v", got)
+	}
+	for _, path := range []string{"dir/file", "dir/.", "file", "dir/file"} {
+		if _, err := db.Put(path, &entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want, got := []string{"dir/.", "dir/file", "file"}, db.Changed(); !reflect.DeepEqual(want, got) {
+		t.Errorf("changed: want %v got %v", want, got)
+	}
+}
+
+type walked struct {
+	path  string
+	entry Entry
+}
+
+func walk(db *DB, prefix string) ([]walked, error) {
+	var got []walked
+	err := db.Walk(prefix, func(path string, e Entry) error {
+		got = append(got, walked{path, e})
+		return nil
+	})
+	return got, err
+}
+
+func TestWalk(t *testing.T) {
+	db, cleanup := makeDB(t)
+	defer cleanup()
+
+	dirEntry := Entry{Mode: 0750 | os.ModeDir, User: "foo", Group: "bar"}
+	for path, e := range map[string]Entry{
+		"dir-file":         entry,
+		"dir/.":            dirEntry,
+		"dir/sub/.":        dirEntry,
+		"dir/sub/file":     otherEntry,
+		"dir/-file":        entry,
+		"dir/file":         entry,
+		"file":             otherEntry,
+		"nodirentry/other": otherEntry,
+	} {
+		e := e
+		if _, err := db.Put(path, &e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		prefix string
+		want   []walked
+	}{
+		{".", []walked{
+			{"dir", dirEntry},
+			{"dir/-file", entry},
+			{"dir/file", entry},
+			{"dir/sub", dirEntry},
+			{"dir/sub/file", otherEntry},
+			{"dir-file", entry},
+			{"file", otherEntry},
+			{"nodirentry/other", otherEntry},
+		}},
+		{"dir/sub", []walked{
+			{"dir", dirEntry},
+			{"dir/sub", dirEntry},
+			{"dir/sub/file", otherEntry},
+		}},
+		{"dir/sub/file", []walked{
+			{"dir", dirEntry},
+			{"dir/sub", dirEntry},
+			{"dir/sub/file", otherEntry},
+		}},
+		{"file", []walked{{"file", otherEntry}}},
+	} {
+		got, err := walk(db, tc.prefix)
+		if err != nil {
+			t.Errorf("%q: %v", tc.prefix, err)
+			continue
+		}
+		if !reflect.DeepEqual(tc.want, got) {
+			t.Errorf("%q: want %v got %v", tc.prefix, tc.want, got)
+		}
+	}
+
+	for _, prefix := range []string{"missing", "dir/missing", "missing/file"} {
+		if _, err := walk(db, prefix); err == nil {
+			t.Errorf("%q: want error got nil", prefix)
+		}
+	}
+}
+
+func TestWalkStops(t *testing.T) {
+	db, cleanup := makeDB(t)
+	defer cleanup()
+
+	for _, path := range []string{"a", "b", "c"} {
+		if _, err := db.Put(path, &entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stop := errors.New("stop")
+	var visited []string
+	err := db.Walk(".", func(path string, e Entry) error {
+		visited = append(visited, path)
+		if path == "b" {
+			return stop
+		}
+		return nil
+	})
+	if err != stop {
+		t.Errorf("want %v got %v", stop, err)
+	}
+	if want := []string{"a", "b"}; !reflect.DeepEqual(want, visited) {
+		t.Errorf("visited: want %v got %v", want, visited)
+	}
+}
+
+func TestWalkEmpty(t *testing.T) {
+	db, cleanup := makeDB(t)
+	defer cleanup()
+
+	if _, err := walk(db, "."); err == nil {
+		t.Errorf("want error got nil")
+	}
+}
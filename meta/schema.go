@@ -0,0 +1,83 @@
+package meta
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/boltdb/bolt"
+)
+
+// SchemaVersion is the version of the format of the database written by this package.
+// Databases written in older formats are upgraded by NewDB, by running each of migrations in turn.
+const SchemaVersion = 2
+
+// migration upgrades a database from one schema version to the next, within tx.
+type migration struct {
+	description string
+	migrate     func(tx *bolt.Tx) error
+}
+
+// migrations[i] upgrades a database from schema version i to i+1. Every change to Entry, or to how entries are stored,
+// must bump SchemaVersion and add a migration, even if the migration does nothing, so that older binaries refuse to misread newer databases.
+var migrations = []migration{
+	// Version 0 is every database written before versions were recorded. Its format is otherwise identical to version 1.
+	{"record schema version", func(tx *bolt.Tx) error { return nil }},
+	// Version 2 adds Entry's UID, GID and HasIDs. Entries written before decode with HasIDs unset, so they need no rewriting.
+	{"record numeric owner IDs", func(tx *bolt.Tx) error { return nil }},
+}
+
+var (
+	schemaBucket = []byte("schema")
+	versionKey   = []byte("version")
+)
+
+// SchemaVersionOf returns the schema version of the database at path, without upgrading it.
+func SchemaVersionOf(path string) (int, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{ReadOnly: true})
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	var version int
+	err = db.View(func(tx *bolt.Tx) error {
+		version = schemaVersion(tx)
+		return nil
+	})
+	return version, err
+}
+
+// schemaVersion returns the schema version recorded in tx, which is 0 if none is.
+func schemaVersion(tx *bolt.Tx) int {
+	bucket := tx.Bucket(schemaBucket)
+	if bucket == nil {
+		return 0
+	}
+	v := bucket.Get(versionKey)
+	if len(v) != 8 {
+		return 0
+	}
+	return int(binary.BigEndian.Uint64(v))
+}
+
+func setSchemaVersion(tx *bolt.Tx, version int) error {
+	bucket, err := tx.CreateBucketIfNotExists(schemaBucket)
+	if err != nil {
+		return fmt.Errorf("meta: creating/getting schema bucket: %v", err)
+	}
+	var v [8]byte
+	binary.BigEndian.PutUint64(v[:], uint64(version))
+	return bucket.Put(versionKey, v[:])
+}
+
+// migrate upgrades the database in tx from schema version from to SchemaVersion.
+func migrate(tx *bolt.Tx, from int) error {
+	if from > SchemaVersion {
+		return fmt.Errorf("meta: database has schema version %d, but only versions up to %d are supported; a newer version of cloudbackup is needed", from, SchemaVersion)
+	}
+	for version := from; version < SchemaVersion; version++ {
+		if err := migrations[version].migrate(tx); err != nil {
+			return fmt.Errorf("meta: error migrating from schema version %d (%s): %v", version, migrations[version].description, err)
+		}
+	}
+	return setSchemaVersion(tx, SchemaVersion)
+}
@@ -0,0 +1,184 @@
+package meta
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestMigrationsCoverSchemaVersion(t *testing.T) {
+	if len(migrations) != SchemaVersion {
+		t.Errorf("want a migration to each version up to %v got %v migrations", SchemaVersion, len(migrations))
+	}
+}
+
+// TestNewDBReadsVersion0 reads a database as written before schema versions were recorded.
+func TestNewDBReadsVersion0(t *testing.T) {
+	encodedOther, err := EncodeEntry(&otherEntry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := makeDBFile(t, func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucket(root)
+		if err != nil {
+			return err
+		}
+		if err := bucket.Put([]byte("file"), entryBytes); err != nil {
+			return err
+		}
+		dir, err := bucket.CreateBucket([]byte("dir"))
+		if err != nil {
+			return err
+		}
+		if err := dir.Put(root, encodedOther); err != nil {
+			return err
+		}
+		if err := dir.Put([]byte("file"), encodedOther); err != nil {
+			return err
+		}
+		decoys, err := tx.CreateBucket(decoysBucket)
+		if err != nil {
+			return err
+		}
+		return decoys.Put([]byte("aa"), nil)
+	})
+	defer os.Remove(path)
+
+	if version, err := SchemaVersionOf(path); err != nil || version != 0 {
+		t.Errorf("before opening: want version 0 got %v, %v", version, err)
+	}
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := db.Get(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]Entry{
+		"file":     entry,
+		"dir/":     otherEntry,
+		"dir/file": otherEntry,
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("entries: want %v got %v", want, got)
+	}
+	if decoys, err := db.Decoys(); err != nil || !reflect.DeepEqual(decoys, []string{"aa"}) {
+		t.Errorf("decoys: want [aa] got %v, %v", decoys, err)
+	}
+	db.Close()
+
+	if version, err := SchemaVersionOf(path); err != nil || version != SchemaVersion {
+		t.Errorf("after opening: want version %v got %v, %v", SchemaVersion, version, err)
+	}
+}
+
+// v1Entry is Entry as it was at schema version 1, before numeric owner IDs were recorded.
+type v1Entry struct {
+	Bytes  int64
+	Chunks []Chunk
+	Mode   os.FileMode
+	User   string
+	Group  string
+}
+
+// TestNewDBReadsVersion1 reads a database as written before numeric owner IDs were recorded.
+func TestNewDBReadsVersion1(t *testing.T) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&v1Entry{Bytes: entry.Bytes, Chunks: entry.Chunks, Mode: entry.Mode, User: entry.User, Group: entry.Group}); err != nil {
+		t.Fatal(err)
+	}
+	path := makeDBFile(t, func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucket(root)
+		if err != nil {
+			return err
+		}
+		if err := bucket.Put([]byte("file"), buf.Bytes()); err != nil {
+			return err
+		}
+		return setSchemaVersion(tx, 1)
+	})
+	defer os.Remove(path)
+
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := db.Get(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]Entry{"file": entry}; !reflect.DeepEqual(want, got) {
+		t.Errorf("entries: want %v got %v", want, got)
+	}
+	db.Close()
+
+	if version, err := SchemaVersionOf(path); err != nil || version != SchemaVersion {
+		t.Errorf("after opening: want version %v got %v, %v", SchemaVersion, version, err)
+	}
+}
+
+func TestNewDBRejectsNewerSchema(t *testing.T) {
+	path := makeDBFile(t, func(tx *bolt.Tx) error {
+		return setSchemaVersion(tx, SchemaVersion+1)
+	})
+	defer os.Remove(path)
+
+	if db, err := NewDB(path); err == nil {
+		db.Close()
+		t.Errorf("want error got nil")
+	}
+	if version, err := SchemaVersionOf(path); err != nil || version != SchemaVersion+1 {
+		t.Errorf("after refusing: want version %v got %v, %v", SchemaVersion+1, version, err)
+	}
+}
+
+func TestImportTreeUpgrades(t *testing.T) {
+	exported, cleanup := makeDB(t)
+	defer cleanup()
+	if _, err := exported.Put("file", &entry); err != nil {
+		t.Fatal(err)
+	}
+	shard, err := exported.ExportTree(1<<20, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imported, cleanup := makeDB(t)
+	defer cleanup()
+	if err := imported.ImportTree(shard, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	imported.db.View(func(tx *bolt.Tx) error {
+		if version := schemaVersion(tx); version != SchemaVersion {
+			t.Errorf("want version %v got %v", SchemaVersion, version)
+		}
+		return nil
+	})
+	if err := imported.ImportTree(shard, SchemaVersion+1, nil); err == nil {
+		t.Errorf("newer version: want error got nil")
+	}
+}
+
+// makeDBFile makes a database file by calling fn, without going through NewDB, so it can be in any format.
+func makeDBFile(t *testing.T, fn func(tx *bolt.Tx) error) string {
+	f, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	db, err := bolt.Open(f.Name(), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Update(fn); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
@@ -0,0 +1,139 @@
+package meta
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+
+	"github.com/boltdb/bolt"
+)
+
+// shard is the encoded form of a directory bucket: the raw entries in it (including its own entry, named "."), and its subdirectories.
+// Entries and Children are sorted by name, so that the same directory always encodes to the same bytes.
+type shard struct {
+	Entries  []shardEntry
+	Children []shardChild
+}
+
+type shardEntry struct {
+	Name  string
+	Value []byte
+}
+
+// shardChild is a subdirectory, which is either encoded inline, or stored separately and referred to by Ref.
+type shardChild struct {
+	Name   string
+	Ref    []byte
+	Inline []byte
+}
+
+// ExportTree encodes the directory tree as a Merkle tree of shards, and returns the encoded root shard.
+//
+// Each directory is encoded as a shard containing its entries and its subdirectories. Subdirectories whose encoded shard is at most inlineBytes long
+// are included directly in their parent's shard; larger ones are passed to store, which must store them and return an opaque reference to them,
+// which is included in the parent's shard instead. Children are always stored before their parents, and as a directory always encodes to the same
+// bytes, store can avoid storing shards which have been stored before, and return the same reference for them.
+func (d *DB) ExportTree(inlineBytes int, store func(shard []byte) ([]byte, error)) ([]byte, error) {
+	var encoded []byte
+	err := d.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(root)
+		if bucket == nil {
+			var err error
+			encoded, err = encodeShard(&shard{})
+			return err
+		}
+		var err error
+		encoded, err = exportBucket(bucket, inlineBytes, store)
+		return err
+	})
+	return encoded, err
+}
+
+func exportBucket(bucket *bolt.Bucket, inlineBytes int, store func([]byte) ([]byte, error)) ([]byte, error) {
+	var s shard
+	cursor := bucket.Cursor()
+	for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+		if v != nil {
+			s.Entries = append(s.Entries, shardEntry{string(k), v})
+			continue
+		}
+		child, err := exportBucket(bucket.Bucket(k), inlineBytes, store)
+		if err != nil {
+			return nil, err
+		}
+		if len(child) <= inlineBytes {
+			s.Children = append(s.Children, shardChild{Name: string(k), Inline: child})
+			continue
+		}
+		ref, err := store(child)
+		if err != nil {
+			return nil, err
+		}
+		s.Children = append(s.Children, shardChild{Name: string(k), Ref: ref})
+	}
+	return encodeShard(&s)
+}
+
+func encodeShard(s *shard) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	if err := gob.NewEncoder(buf).Encode(s); err != nil {
+		return nil, fmt.Errorf("meta: error encoding shard: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// ImportTree replaces the directory tree with the one encoded in rootShard by ExportTree, calling fetch to read the shards which were stored separately.
+// Each shard is decoded as it is read from fetch's reader, which is closed once it has been, so that shards needn't be held in memory in full.
+// version is the SchemaVersion of the database which was exported, which is upgraded as by NewDB once imported.
+func (d *DB) ImportTree(rootShard []byte, version int, fetch func(ref []byte) (io.ReadCloser, error)) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(root) != nil {
+			if err := tx.DeleteBucket(root); err != nil {
+				return fmt.Errorf("meta: error deleting root bucket: %v", err)
+			}
+		}
+		bucket, err := tx.CreateBucket(root)
+		if err != nil {
+			return fmt.Errorf("meta: creating root bucket: %v", err)
+		}
+		if err := importBucket(bucket, bytes.NewReader(rootShard), fetch); err != nil {
+			return err
+		}
+		return migrate(tx, version)
+	})
+}
+
+func importBucket(bucket *bolt.Bucket, encoded io.Reader, fetch func([]byte) (io.ReadCloser, error)) error {
+	var s shard
+	if err := gob.NewDecoder(encoded).Decode(&s); err != nil {
+		return fmt.Errorf("meta: error decoding shard: %v", err)
+	}
+	for _, e := range s.Entries {
+		if err := bucket.Put([]byte(e.Name), e.Value); err != nil {
+			return err
+		}
+	}
+	for _, c := range s.Children {
+		child, err := bucket.CreateBucket([]byte(c.Name))
+		if err != nil {
+			return fmt.Errorf("meta: creating bucket %v: %v", c.Name, err)
+		}
+		if c.Ref == nil {
+			if err := importBucket(child, bytes.NewReader(c.Inline), fetch); err != nil {
+				return err
+			}
+			continue
+		}
+		encodedChild, err := fetch(c.Ref)
+		if err != nil {
+			return err
+		}
+		err = importBucket(child, encodedChild, fetch)
+		encodedChild.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package meta
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestExportImportTree(t *testing.T) {
+	db, cleanup := makeDB(t)
+	defer cleanup()
+	for _, path := range []string{"file", "dir/file", "dir/subdir/otherfile", "big/a", "big/b", "big/c"} {
+		if _, err := db.Put(path, &entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Put("dir/.", &otherEntry); err != nil {
+		t.Fatal(err)
+	}
+
+	stored := make(map[string][]byte)
+	store := func(shard []byte) ([]byte, error) {
+		sum := sha256.Sum256(shard)
+		stored[string(sum[:])] = shard
+		return sum[:], nil
+	}
+	// Every directory is large enough to be stored separately.
+	rootShard, err := db.ExportTree(0, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := 3; len(stored) != want {
+		t.Errorf("want %v shards stored got %v", want, len(stored))
+	}
+
+	again, err := db.ExportTree(0, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(rootShard, again) || len(stored) != 3 {
+		t.Errorf("want the same tree to encode to the same shards")
+	}
+
+	inline, err := db.ExportTree(1<<20, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want, err := db.Get(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, shard := range [][]byte{rootShard, inline} {
+		testImportTree(t, shard, stored, want)
+	}
+}
+
+func testImportTree(t *testing.T, rootShard []byte, stored map[string][]byte, want map[string]Entry) {
+	imported, cleanupImported := makeDB(t)
+	defer cleanupImported()
+	if _, err := imported.Put("stale", &entry); err != nil {
+		t.Fatal(err)
+	}
+	if err := imported.ImportTree(rootShard, SchemaVersion, func(ref []byte) (io.ReadCloser, error) {
+		shard, ok := stored[string(ref)]
+		if !ok {
+			return nil, fmt.Errorf("no shard %q", ref)
+		}
+		return ioutil.NopCloser(bytes.NewReader(shard)), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := imported.Get(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("want %v got %v", want, got)
+	}
+}
+
+func TestExportEmptyTree(t *testing.T) {
+	db, cleanup := makeDB(t)
+	defer cleanup()
+	rootShard, err := db.ExportTree(0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imported, cleanupImported := makeDB(t)
+	defer cleanupImported()
+	if err := imported.ImportTree(rootShard, SchemaVersion, nil); err != nil {
+		t.Fatal(err)
+	}
+	got, err := imported.Get(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Errorf("want no entries got %v", got)
+	}
+}
@@ -0,0 +1,79 @@
+package metrics
+
+import (
+	"context"
+	"os"
+
+	"github.com/illicitonion/cloudbackup/chunkstore"
+)
+
+// ChunkStore counts the errors returned by Store in Errors, which must have the labels backend and op, labelled with Backend and the
+// name of the method which failed.
+// Errors which are part of normal operation, i.e. those for which os.IsNotExist returns true, and chunkstore.ErrVersionMismatch, aren't counted.
+type ChunkStore struct {
+	Store   chunkstore.ChunkStore
+	Backend string
+	Errors  *Family
+}
+
+func (s *ChunkStore) Read(ctx context.Context, name string) ([]byte, error) {
+	contents, err := s.Store.Read(ctx, name)
+	s.count("read", err)
+	return contents, err
+}
+
+func (s *ChunkStore) Save(ctx context.Context, name string, contents []byte) error {
+	err := s.Store.Save(ctx, name, contents)
+	s.count("save", err)
+	return err
+}
+
+func (s *ChunkStore) ReadVersion(ctx context.Context, name string) ([]byte, int64, error) {
+	contents, version, err := s.Store.ReadVersion(ctx, name)
+	s.count("read_version", err)
+	return contents, version, err
+}
+
+func (s *ChunkStore) SaveIfVersion(ctx context.Context, name string, contents []byte, version int64) error {
+	err := s.Store.SaveIfVersion(ctx, name, contents, version)
+	s.count("save_if_version", err)
+	return err
+}
+
+func (s *ChunkStore) Exists(ctx context.Context, name string) (bool, error) {
+	exists, err := s.Store.Exists(ctx, name)
+	s.count("exists", err)
+	return exists, err
+}
+
+func (s *ChunkStore) List(ctx context.Context, prefix string, fn func(name string) error) error {
+	// Errors returned by fn stop the listing, but aren't the store's fault.
+	var fnErr error
+	err := s.Store.List(ctx, prefix, func(name string) error {
+		fnErr = fn(name)
+		return fnErr
+	})
+	if err != fnErr {
+		s.count("list", err)
+	}
+	return err
+}
+
+func (s *ChunkStore) Delete(ctx context.Context, name string) error {
+	err := s.Store.Delete(ctx, name)
+	s.count("delete", err)
+	return err
+}
+
+func (s *ChunkStore) Stat(ctx context.Context, name string) (chunkstore.Info, error) {
+	info, err := s.Store.Stat(ctx, name)
+	s.count("stat", err)
+	return info, err
+}
+
+func (s *ChunkStore) count(op string, err error) {
+	if err == nil || os.IsNotExist(err) || err == chunkstore.ErrVersionMismatch {
+		return
+	}
+	s.Errors.Add(1, s.Backend, op)
+}
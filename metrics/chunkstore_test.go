@@ -0,0 +1,55 @@
+package metrics
+
+import (
+	"context"
+	"testing"
+
+	"github.com/illicitonion/cloudbackup/chunkstore"
+	"github.com/illicitonion/cloudbackup/chunkstore/chunkstoretest"
+	"github.com/illicitonion/cloudbackup/memory"
+)
+
+func TestChunkStoreConformance(t *testing.T) {
+	chunkstoretest.Run(t, func(t *testing.T) (chunkstore.ChunkStore, func()) {
+		var r Registry
+		return &ChunkStore{
+			Store:   &memory.ChunkStore{},
+			Backend: "memory",
+			Errors:  r.Counter("errors_total", "", "backend", "op"),
+		}, func() {}
+	})
+}
+
+func TestChunkStoreCountsErrors(t *testing.T) {
+	var r Registry
+	errors := r.Counter("errors_total", "", "backend", "op")
+	s := &ChunkStore{Store: &memory.ChunkStore{}, Backend: "memory", Errors: errors}
+	ctx := context.Background()
+
+	// Missing chunks, version conflicts, and errors from List's callback are expected, so aren't counted.
+	if _, err := s.Read(ctx, "missing"); err == nil {
+		t.Fatal("want error reading missing chunk")
+	}
+	if err := s.SaveIfVersion(ctx, "meta", []byte("foo"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveIfVersion(ctx, "meta", []byte("bar"), 0); err != chunkstore.ErrVersionMismatch {
+		t.Fatalf("want %v got %v", chunkstore.ErrVersionMismatch, err)
+	}
+	stop := context.DeadlineExceeded
+	if err := s.List(ctx, "", func(string) error { return stop }); err != stop {
+		t.Fatalf("want %v got %v", stop, err)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	s.Save(cancelled, "foo", []byte("foo"))
+	s.Save(cancelled, "foo", []byte("foo"))
+	s.Read(cancelled, "meta")
+
+	for op, want := range map[string]float64{"read": 1, "save": 2, "save_if_version": 0, "list": 0} {
+		if got := errors.Value("memory", op); got != want {
+			t.Errorf("%v errors: want %v got %v", op, want, got)
+		}
+	}
+}
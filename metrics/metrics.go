@@ -0,0 +1,169 @@
+// Package metrics collects gauges and counters, and serves them in the Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Registry holds families of metrics. Its zero value is empty and ready to use, and it is safe for concurrent use.
+type Registry struct {
+	mu       sync.Mutex
+	families []*Family
+}
+
+// Family is a metric with a value for each combination of values of its labels.
+type Family struct {
+	name, help, kind string
+	labels           []string
+
+	mu     sync.Mutex
+	values map[string]*value
+}
+
+type value struct {
+	labelValues []string
+	v           float64
+}
+
+// Gauge registers a metric which may go up and down.
+func (r *Registry) Gauge(name, help string, labels ...string) *Family {
+	return r.register(name, help, "gauge", labels)
+}
+
+// Counter registers a metric which only goes up. By convention, its name should end in _total.
+func (r *Registry) Counter(name, help string, labels ...string) *Family {
+	return r.register(name, help, "counter", labels)
+}
+
+func (r *Registry) register(name, help, kind string, labels []string) *Family {
+	f := &Family{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		values: make(map[string]*value),
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, existing := range r.families {
+		if existing.name == name {
+			panic(fmt.Sprintf("metrics: %v registered twice", name))
+		}
+	}
+	r.families = append(r.families, f)
+	return f
+}
+
+// Set sets the value with the given label values, which must be given in the order the labels were registered in.
+func (f *Family) Set(v float64, labelValues ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.get(labelValues).v = v
+}
+
+// Add adds delta to the value with the given label values. Values start at zero.
+func (f *Family) Add(delta float64, labelValues ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.get(labelValues).v += delta
+}
+
+// Value returns the value with the given label values, or zero if it has never been set.
+func (f *Family) Value(labelValues ...string) float64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if v, ok := f.values[labelKey(labelValues)]; ok {
+		return v.v
+	}
+	return 0
+}
+
+func (f *Family) get(labelValues []string) *value {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %v has labels %v, got values %v", f.name, f.labels, labelValues))
+	}
+	key := labelKey(labelValues)
+	v, ok := f.values[key]
+	if !ok {
+		v = &value{labelValues: append([]string(nil), labelValues...)}
+		f.values[key] = v
+	}
+	return v
+}
+
+func labelKey(labelValues []string) string {
+	return strings.Join(labelValues, "\x00")
+}
+
+// WriteText writes every metric to w in the Prometheus text exposition format, in the order they were registered, with values sorted by label values.
+// Families without values are described, but have no samples.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	families := append([]*Family(nil), r.families...)
+	r.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, f := range families {
+		fmt.Fprintf(bw, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+		fmt.Fprintf(bw, "# TYPE %s %s\n", f.name, f.kind)
+		f.mu.Lock()
+		keys := make([]string, 0, len(f.values))
+		for key := range f.values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			v := f.values[key]
+			bw.WriteString(f.name)
+			if len(f.labels) > 0 {
+				pairs := make([]string, len(f.labels))
+				for i, label := range f.labels {
+					pairs[i] = fmt.Sprintf("%s=\"%s\"", label, escapeLabelValue(v.labelValues[i]))
+				}
+				fmt.Fprintf(bw, "{%s}", strings.Join(pairs, ","))
+			}
+			fmt.Fprintf(bw, " %s\n", formatValue(v.v))
+		}
+		f.mu.Unlock()
+	}
+	return bw.Flush()
+}
+
+// ServeHTTP serves every metric, as WriteText writes them.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteText(w)
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(help string) string {
+	return helpEscaper.Replace(help)
+}
+
+func escapeLabelValue(v string) string {
+	return labelValueEscaper.Replace(v)
+}
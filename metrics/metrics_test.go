@@ -0,0 +1,69 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	var r Registry
+	runs := r.Counter("runs_total", "Runs, by result.", "job", "result")
+	size := r.Gauge("size_bytes", "Size in bytes.")
+	r.Gauge("unset", "Never set.\nReally.")
+
+	runs.Add(1, "home", "success")
+	runs.Add(2, "home", "success")
+	runs.Add(1, `a "quoted"\job`, "failure")
+	size.Set(1.5e9)
+
+	buf := &bytes.Buffer{}
+	if err := r.WriteText(buf); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP runs_total Runs, by result.
+# TYPE runs_total counter
+runs_total{job="a \"quoted\"\\job",result="failure"} 1
+runs_total{job="home",result="success"} 3
+# HELP size_bytes Size in bytes.
+# TYPE size_bytes gauge
+size_bytes 1.5e+09
+# HELP unset Never set.\nReally.
+# TYPE unset gauge
+`
+	if got := buf.String(); got != want {
+		t.Errorf("want:\n%s\ngot:\n%s", want, got)
+	}
+	if got := runs.Value("home", "success"); got != 3 {
+		t.Errorf("value: want 3 got %v", got)
+	}
+	if got := runs.Value("home", "failure"); got != 0 {
+		t.Errorf("unset value: want 0 got %v", got)
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	var r Registry
+	r.Gauge("up", "Whether it's up.").Set(1)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if got := w.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/plain; version=0.0.4") {
+		t.Errorf("content type: got %q", got)
+	}
+	if got := w.Body.String(); !strings.HasSuffix(got, "\nup 1\n") {
+		t.Errorf("body: got %q", got)
+	}
+}
+
+func TestRegisterTwicePanics(t *testing.T) {
+	var r Registry
+	r.Gauge("up", "")
+	defer func() {
+		if recover() == nil {
+			t.Error("want panic")
+		}
+	}()
+	r.Counter("up", "")
+}
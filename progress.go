@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/illicitonion/cloudbackup/backup"
+)
+
+// progressPrinter returns a function which renders progress to f as mode describes: auto (a status line if f is a terminal, otherwise nothing),
+// tty (a status line, rewritten in place), json (a JSON object per line), or none (nothing, represented by a nil function).
+func progressPrinter(mode string, f *os.File) (func(backup.Progress), error) {
+	switch mode {
+	case "auto":
+		if fi, err := f.Stat(); err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+			return nil, nil
+		}
+		return ttyProgress(f), nil
+	case "tty":
+		return ttyProgress(f), nil
+	case "json":
+		return jsonProgress(f), nil
+	case "none":
+		return nil, nil
+	}
+	return nil, fmt.Errorf("want auto, tty, json or none, got %q", mode)
+}
+
+func ttyProgress(w io.Writer) func(backup.Progress) {
+	return func(p backup.Progress) {
+		// Clear the rest of the previous line, in case it was longer.
+		fmt.Fprintf(w, "\r%s\033[K", formatProgress(p))
+		if p.Done {
+			fmt.Fprintln(w)
+		}
+	}
+}
+
+// formatProgress describes p in a line, e.g. "12/40 files, 1.5 MiB/8.0 MiB (18%), 20 chunks uploaded, 4 reused, 512.0 KiB/s, ETA 13s".
+func formatProgress(p backup.Progress) string {
+	var line string
+	if p.TotalBytes > 0 {
+		line = fmt.Sprintf("%d/%d files, %s/%s (%d%%)", p.Files, p.TotalFiles, formatBytes(float64(p.Bytes)), formatBytes(float64(p.TotalBytes)), percent(p.Bytes, p.TotalBytes))
+	} else {
+		line = fmt.Sprintf("%d files, %s", p.Files, formatBytes(float64(p.Bytes)))
+	}
+	if p.ChunksUploaded > 0 || p.ChunksReused > 0 {
+		line += fmt.Sprintf(", %d chunks uploaded, %d reused", p.ChunksUploaded, p.ChunksReused)
+	}
+	line += fmt.Sprintf(", %s/s", formatBytes(p.BytesPerSecond()))
+	if p.Done {
+		line += fmt.Sprintf(", done in %v", p.Elapsed.Round(time.Second))
+	} else if eta, ok := p.ETA(); ok {
+		line += fmt.Sprintf(", ETA %v", eta.Round(time.Second))
+	}
+	return line
+}
+
+func percent(n, total int64) int64 {
+	if n >= total {
+		return 100
+	}
+	return n * 100 / total
+}
+
+func formatBytes(n float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	i := 0
+	for ; n >= 1024 && i < len(units)-1; i++ {
+		n /= 1024
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f %s", n, units[i])
+	}
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
+
+// jsonProgressLine is the form in which --progress=json writes each report. ETASeconds is omitted if it can't be estimated.
+type jsonProgressLine struct {
+	Time           time.Time `json:"time"`
+	Files          int64     `json:"files"`
+	TotalFiles     int64     `json:"total_files"`
+	Bytes          int64     `json:"bytes"`
+	TotalBytes     int64     `json:"total_bytes"`
+	ChunksUploaded int64     `json:"chunks_uploaded"`
+	ChunksReused   int64     `json:"chunks_reused"`
+	ElapsedSeconds float64   `json:"elapsed_seconds"`
+	BytesPerSecond float64   `json:"bytes_per_second"`
+	ETASeconds     *float64  `json:"eta_seconds,omitempty"`
+	Done           bool      `json:"done"`
+}
+
+func jsonProgress(w io.Writer) func(backup.Progress) {
+	enc := json.NewEncoder(w)
+	return func(p backup.Progress) {
+		line := jsonProgressLine{
+			Time:           time.Now().UTC(),
+			Files:          p.Files,
+			TotalFiles:     p.TotalFiles,
+			Bytes:          p.Bytes,
+			TotalBytes:     p.TotalBytes,
+			ChunksUploaded: p.ChunksUploaded,
+			ChunksReused:   p.ChunksReused,
+			ElapsedSeconds: p.Elapsed.Seconds(),
+			BytesPerSecond: p.BytesPerSecond(),
+			Done:           p.Done,
+		}
+		if eta, ok := p.ETA(); ok && !p.Done {
+			seconds := eta.Seconds()
+			line.ETASeconds = &seconds
+		}
+		enc.Encode(&line)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/illicitonion/cloudbackup/backup"
+)
+
+func TestFormatProgress(t *testing.T) {
+	for _, tc := range []struct {
+		progress backup.Progress
+		want     string
+	}{
+		{
+			backup.Progress{TotalFiles: 40, TotalBytes: 8 << 20, Files: 12, Bytes: 2 << 20, ChunksUploaded: 20, ChunksReused: 4, Elapsed: 4 * time.Second},
+			"12/40 files, 2.0 MiB/8.0 MiB (25%), 20 chunks uploaded, 4 reused, 512.0 KiB/s, ETA 12s",
+		},
+		{
+			backup.Progress{Files: 1, Bytes: 100, Elapsed: time.Second},
+			"1 files, 100 B, 100 B/s",
+		},
+		{
+			backup.Progress{TotalFiles: 2, TotalBytes: 100, Files: 2, Bytes: 120, Elapsed: 2 * time.Second, Done: true},
+			"2/2 files, 120 B/100 B (100%), 60 B/s, done in 2s",
+		},
+	} {
+		if got := formatProgress(tc.progress); got != tc.want {
+			t.Errorf("want %q got %q", tc.want, got)
+		}
+	}
+}
+
+func TestJSONProgress(t *testing.T) {
+	buf := &bytes.Buffer{}
+	report := jsonProgress(buf)
+	report(backup.Progress{TotalFiles: 2, TotalBytes: 100, Files: 1, Bytes: 50, ChunksUploaded: 3, Elapsed: time.Second})
+	report(backup.Progress{TotalFiles: 2, TotalBytes: 100, Files: 2, Bytes: 100, ChunksUploaded: 6, Elapsed: 2 * time.Second, Done: true})
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("want 2 lines got %q", buf.String())
+	}
+	var first, last jsonProgressLine
+	if err := json.Unmarshal([]byte(lines[0]), &first); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &last); err != nil {
+		t.Fatal(err)
+	}
+	if first.Files != 1 || first.Bytes != 50 || first.ChunksUploaded != 3 || first.ETASeconds == nil || *first.ETASeconds != 1 || first.Done {
+		t.Errorf("first: got %+v", first)
+	}
+	if !last.Done || last.ETASeconds != nil || last.BytesPerSecond != 50 {
+		t.Errorf("last: got %+v", last)
+	}
+}
+
+func TestProgressPrinter(t *testing.T) {
+	for _, mode := range []string{"auto", "tty", "json", "none"} {
+		if _, err := progressPrinter(mode, os.Stderr); err != nil {
+			t.Errorf("%v: %v", mode, err)
+		}
+	}
+	if _, err := progressPrinter("xml", os.Stderr); err == nil {
+		t.Errorf("xml: want error got nil")
+	}
+}
@@ -0,0 +1,167 @@
+// Package ratelimit implements a chunkstore.ChunkStore which limits the rate at which bytes are uploaded to and downloaded from another chunkstore.ChunkStore.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/illicitonion/cloudbackup/chunkstore"
+)
+
+// ChunkStore limits the bytes passed to Store.Save by Upload, and the bytes returned by Store.Read by Download.
+// A nil Bucket means no limit.
+type ChunkStore struct {
+	Store    chunkstore.ChunkStore
+	Upload   *Bucket
+	Download *Bucket
+}
+
+func (s *ChunkStore) Read(ctx context.Context, name string) ([]byte, error) {
+	contents, err := s.Store.Read(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	// The size of a chunk isn't known until it has been read, so wait afterwards, which still limits the average rate.
+	if err := s.Download.Wait(ctx, len(contents)); err != nil {
+		return nil, err
+	}
+	return contents, nil
+}
+
+func (s *ChunkStore) Save(ctx context.Context, name string, contents []byte) error {
+	if err := s.Upload.Wait(ctx, len(contents)); err != nil {
+		return err
+	}
+	return s.Store.Save(ctx, name, contents)
+}
+
+func (s *ChunkStore) ReadVersion(ctx context.Context, name string) ([]byte, int64, error) {
+	contents, version, err := s.Store.ReadVersion(ctx, name)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := s.Download.Wait(ctx, len(contents)); err != nil {
+		return nil, 0, err
+	}
+	return contents, version, nil
+}
+
+func (s *ChunkStore) SaveIfVersion(ctx context.Context, name string, contents []byte, version int64) error {
+	if err := s.Upload.Wait(ctx, len(contents)); err != nil {
+		return err
+	}
+	return s.Store.SaveIfVersion(ctx, name, contents, version)
+}
+
+func (s *ChunkStore) Exists(ctx context.Context, name string) (bool, error) {
+	return s.Store.Exists(ctx, name)
+}
+
+func (s *ChunkStore) List(ctx context.Context, prefix string, fn func(name string) error) error {
+	return s.Store.List(ctx, prefix, fn)
+}
+
+func (s *ChunkStore) Delete(ctx context.Context, name string) error {
+	return s.Store.Delete(ctx, name)
+}
+
+func (s *ChunkStore) Stat(ctx context.Context, name string) (chunkstore.Info, error) {
+	return s.Store.Stat(ctx, name)
+}
+
+// Bucket is a token bucket which holds at most one second's worth of bytes at the current rate. It is safe for concurrent use.
+type Bucket struct {
+	// Rate returns the number of bytes per second allowed at a given time. A rate of zero or less means no limit.
+	Rate func(time.Time) int64
+
+	now func() time.Time
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// Constant returns a Rate function which always returns bytesPerSecond.
+func Constant(bytesPerSecond int64) func(time.Time) int64 {
+	return func(time.Time) int64 { return bytesPerSecond }
+}
+
+// Wait blocks until n bytes may be transferred, or ctx is done. Transfers larger than the bucket are allowed, but delay subsequent ones.
+func (b *Bucket) Wait(ctx context.Context, n int) error {
+	if b == nil {
+		return nil
+	}
+	wait := b.take(n)
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// take removes n tokens from the bucket, and returns how long to wait until the bucket is no longer in debt.
+func (b *Bucket) take(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if b.now != nil {
+		now = b.now()
+	}
+	rate := float64(b.Rate(now))
+	if rate <= 0 {
+		b.tokens = 0
+		b.last = now
+		return 0
+	}
+	if b.last.IsZero() {
+		b.tokens = rate
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * rate
+	}
+	if b.tokens > rate {
+		b.tokens = rate
+	}
+	b.last = now
+
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / rate * float64(time.Second))
+}
+
+// ParseRate parses a number of bytes per second, optionally suffixed with K, M or G (powers of 1024). An empty string means zero.
+func ParseRate(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	value := s
+	multiplier := int64(1)
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		multiplier = 1 << 10
+	case "M":
+		multiplier = 1 << 20
+	case "G":
+		multiplier = 1 << 30
+	}
+	if multiplier != 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("rate must be a non-negative number of bytes per second, optionally suffixed with K, M or G, got %q", value)
+	}
+	return n * multiplier, nil
+}
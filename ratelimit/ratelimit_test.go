@@ -0,0 +1,134 @@
+package ratelimit
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/illicitonion/cloudbackup/chunkstore"
+	"github.com/illicitonion/cloudbackup/chunkstore/chunkstoretest"
+	"github.com/illicitonion/cloudbackup/memory"
+)
+
+func TestChunkStoreConformance(t *testing.T) {
+	chunkstoretest.Run(t, func(t *testing.T) (chunkstore.ChunkStore, func()) {
+		return &ChunkStore{
+			Store:    &memory.ChunkStore{},
+			Upload:   &Bucket{Rate: Constant(1 << 30)},
+			Download: &Bucket{Rate: Constant(1 << 30)},
+		}, func() {}
+	})
+}
+
+func TestBucketTake(t *testing.T) {
+	now := time.Date(2017, 1, 2, 15, 4, 5, 0, time.UTC)
+	b := &Bucket{Rate: Constant(100), now: func() time.Time { return now }}
+
+	for _, tc := range []struct {
+		advance time.Duration
+		n       int
+		want    time.Duration
+	}{
+		// The bucket starts full.
+		{0, 50, 0},
+		{0, 100, 500 * time.Millisecond},
+		{500 * time.Millisecond, 100, time.Second},
+		// The bucket never holds more than a second's worth.
+		{time.Hour, 100, 0},
+		{0, 10, 100 * time.Millisecond},
+	} {
+		now = now.Add(tc.advance)
+		if got := b.take(tc.n); got != tc.want {
+			t.Errorf("after %v, take %v: want wait %v got %v", tc.advance, tc.n, tc.want, got)
+		}
+	}
+}
+
+func TestBucketUnlimited(t *testing.T) {
+	b := &Bucket{Rate: Constant(0)}
+	if got := b.take(1 << 30); got != 0 {
+		t.Errorf("want no wait got %v", got)
+	}
+}
+
+func TestBucketWaitCancelled(t *testing.T) {
+	b := &Bucket{Rate: Constant(1)}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := b.Wait(ctx, 100); err != context.DeadlineExceeded {
+		t.Errorf("want %v got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	for value, want := range map[string]int64{
+		"":     0,
+		"0":    0,
+		"1000": 1000,
+		"512K": 512 << 10,
+		"2m":   2 << 20,
+		"1G":   1 << 30,
+	} {
+		got, err := ParseRate(value)
+		if err != nil {
+			t.Errorf("%q: %v", value, err)
+		} else if got != want {
+			t.Errorf("%q: want %v got %v", value, want, got)
+		}
+	}
+	for _, value := range []string{"K", "-1", "fast", "1T"} {
+		if _, err := ParseRate(value); err == nil {
+			t.Errorf("%q: want error got nil", value)
+		}
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	s, err := ParseSchedule(strings.NewReader(`
+# time  upload  download
+19:00   0       0
+08:00   512K    2M
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		clock            string
+		upload, download int64
+	}{
+		{"00:00", 0, 0},
+		{"07:59", 0, 0},
+		{"08:00", 512 << 10, 2 << 20},
+		{"12:30", 512 << 10, 2 << 20},
+		{"19:00", 0, 0},
+		{"23:59", 0, 0},
+	} {
+		clock, err := time.Parse("15:04", tc.clock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		at := time.Date(2017, 1, 2, clock.Hour(), clock.Minute(), 0, 0, time.Local)
+		if got := s.Upload(at); got != tc.upload {
+			t.Errorf("%v upload: want %v got %v", tc.clock, tc.upload, got)
+		}
+		if got := s.Download(at); got != tc.download {
+			t.Errorf("%v download: want %v got %v", tc.clock, tc.download, got)
+		}
+	}
+}
+
+func TestParseScheduleErrors(t *testing.T) {
+	for _, schedule := range []string{
+		"",
+		"# only a comment",
+		"08:00 1M",
+		"8am 1M 1M",
+		"08:00 fast 1M",
+		"08:00 1M fast",
+	} {
+		if _, err := ParseSchedule(strings.NewReader(schedule)); err == nil {
+			t.Errorf("%q: want error got nil", schedule)
+		}
+	}
+}
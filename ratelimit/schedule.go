@@ -0,0 +1,93 @@
+package ratelimit
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Schedule sets upload and download rates by local time of day. It is read from a file with one line per change of rate:
+//
+//	# time  upload  download
+//	08:00   512K    2M
+//	19:00   0       0
+//
+// Each line applies from its time until the time of the next line, wrapping around midnight, so the above limits uploads to 512KiB/s
+// and downloads to 2MiB/s during the day, and doesn't limit them at night. Rates are as accepted by ParseRate, and zero means no limit.
+// Blank lines and lines starting with # are ignored.
+type Schedule struct {
+	// entries are sorted by start.
+	entries []scheduleEntry
+}
+
+type scheduleEntry struct {
+	// start is the time since midnight from which the entry applies.
+	start            time.Duration
+	upload, download int64
+}
+
+func ParseSchedule(r io.Reader) (*Schedule, error) {
+	var s Schedule
+	scanner := bufio.NewScanner(r)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("schedule line %d: want time, upload rate and download rate, got %q", lineNumber, line)
+		}
+		start, err := time.Parse("15:04", fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("schedule line %d: time must be of form HH:MM, got %q", lineNumber, fields[0])
+		}
+		upload, err := ParseRate(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("schedule line %d: bad upload rate: %v", lineNumber, err)
+		}
+		download, err := ParseRate(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("schedule line %d: bad download rate: %v", lineNumber, err)
+		}
+		s.entries = append(s.entries, scheduleEntry{
+			start:    time.Duration(start.Hour())*time.Hour + time.Duration(start.Minute())*time.Minute,
+			upload:   upload,
+			download: download,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading schedule: %v", err)
+	}
+	if len(s.entries) == 0 {
+		return nil, fmt.Errorf("schedule has no entries")
+	}
+	sort.SliceStable(s.entries, func(i, j int) bool { return s.entries[i].start < s.entries[j].start })
+	return &s, nil
+}
+
+// Upload returns the upload rate at t, for use as a Bucket's Rate.
+func (s *Schedule) Upload(t time.Time) int64 {
+	return s.at(t).upload
+}
+
+// Download returns the download rate at t, for use as a Bucket's Rate.
+func (s *Schedule) Download(t time.Time) int64 {
+	return s.at(t).download
+}
+
+func (s *Schedule) at(t time.Time) scheduleEntry {
+	sinceMidnight := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	// Before the first entry of the day, the last entry of the previous day still applies.
+	entry := s.entries[len(s.entries)-1]
+	for _, e := range s.entries {
+		if e.start > sinceMidnight {
+			break
+		}
+		entry = e
+	}
+	return entry
+}
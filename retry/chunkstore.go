@@ -0,0 +1,161 @@
+// Package retry implements a chunkstore.ChunkStore which retries operations on another chunkstore.ChunkStore when they fail with a transient error.
+package retry
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/illicitonion/cloudbackup/chunkstore"
+)
+
+const (
+	DefaultAttempts   = 5
+	DefaultBackoff    = time.Second
+	DefaultMaxBackoff = time.Minute
+)
+
+// ChunkStore retries operations on Store which fail with an error for which chunkstore.IsTransient returns true.
+// Other errors, including those for which os.IsNotExist returns true, are returned immediately.
+//
+// The zero values of the other fields mean their Default values.
+type ChunkStore struct {
+	Store chunkstore.ChunkStore
+	// Attempts is the maximum number of times each operation is tried.
+	Attempts int
+	// Backoff is the delay before the first retry. Each subsequent delay is twice as long, up to MaxBackoff.
+	// Delays are jittered by choosing them uniformly at random between half and all of their nominal length.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+func (s *ChunkStore) Read(ctx context.Context, name string) ([]byte, error) {
+	var contents []byte
+	err := s.do(ctx, func() error {
+		var err error
+		contents, err = s.Store.Read(ctx, name)
+		return err
+	})
+	return contents, err
+}
+
+func (s *ChunkStore) Save(ctx context.Context, name string, contents []byte) error {
+	return s.do(ctx, func() error {
+		return s.Store.Save(ctx, name, contents)
+	})
+}
+
+func (s *ChunkStore) ReadVersion(ctx context.Context, name string) ([]byte, int64, error) {
+	var contents []byte
+	var version int64
+	err := s.do(ctx, func() error {
+		var err error
+		contents, version, err = s.Store.ReadVersion(ctx, name)
+		return err
+	})
+	return contents, version, err
+}
+
+// SaveIfVersion may return chunkstore.ErrVersionMismatch if an attempt which appeared to fail actually succeeded,
+// in which case the blob will already contain contents.
+func (s *ChunkStore) SaveIfVersion(ctx context.Context, name string, contents []byte, version int64) error {
+	return s.do(ctx, func() error {
+		return s.Store.SaveIfVersion(ctx, name, contents, version)
+	})
+}
+
+func (s *ChunkStore) Exists(ctx context.Context, name string) (bool, error) {
+	var exists bool
+	err := s.do(ctx, func() error {
+		var err error
+		exists, err = s.Store.Exists(ctx, name)
+		return err
+	})
+	return exists, err
+}
+
+// List restarts the listing if it fails part way through, but never calls fn with the same name twice.
+// Errors returned by fn are never retried.
+func (s *ChunkStore) List(ctx context.Context, prefix string, fn func(name string) error) error {
+	seen := make(map[string]bool)
+	var fnErr error
+	err := s.do(ctx, func() error {
+		err := s.Store.List(ctx, prefix, func(name string) error {
+			if seen[name] {
+				return nil
+			}
+			seen[name] = true
+			fnErr = fn(name)
+			return fnErr
+		})
+		if fnErr != nil {
+			return nil
+		}
+		return err
+	})
+	if fnErr != nil {
+		return fnErr
+	}
+	return err
+}
+
+func (s *ChunkStore) Delete(ctx context.Context, name string) error {
+	return s.do(ctx, func() error {
+		return s.Store.Delete(ctx, name)
+	})
+}
+
+func (s *ChunkStore) Stat(ctx context.Context, name string) (chunkstore.Info, error) {
+	var info chunkstore.Info
+	err := s.do(ctx, func() error {
+		var err error
+		info, err = s.Store.Stat(ctx, name)
+		return err
+	})
+	return info, err
+}
+
+func (s *ChunkStore) do(ctx context.Context, op func() error) error {
+	attempts := s.Attempts
+	if attempts <= 0 {
+		attempts = DefaultAttempts
+	}
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || !chunkstore.IsTransient(err) {
+			return err
+		}
+		if attempt >= attempts {
+			return fmt.Errorf("giving up after %d attempts: %v", attempt, err)
+		}
+
+		timer := time.NewTimer(s.delay(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// delay returns how long to wait after the given (1-indexed) failed attempt.
+func (s *ChunkStore) delay(attempt int) time.Duration {
+	backoff := s.Backoff
+	if backoff <= 0 {
+		backoff = DefaultBackoff
+	}
+	maxBackoff := s.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = DefaultMaxBackoff
+	}
+	for i := 1; i < attempt && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	half := backoff / 2
+	return half + time.Duration(rand.Int63n(int64(backoff-half)+1))
+}
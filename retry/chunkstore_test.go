@@ -0,0 +1,222 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/illicitonion/cloudbackup/chunkstore"
+	"github.com/illicitonion/cloudbackup/chunkstore/chunkstoretest"
+	"github.com/illicitonion/cloudbackup/memory"
+)
+
+func TestChunkStoreConformance(t *testing.T) {
+	chunkstoretest.Run(t, func(t *testing.T) (chunkstore.ChunkStore, func()) {
+		return &ChunkStore{Store: &faultyChunkStore{failures: 1}, Backoff: time.Millisecond}, func() {}
+	})
+}
+
+func TestRetriesTransientErrors(t *testing.T) {
+	faulty := &faultyChunkStore{failures: 2}
+	s := &ChunkStore{Store: faulty, Attempts: 3, Backoff: time.Millisecond}
+	if err := s.Save(context.Background(), "foo", []byte("bar")); err != nil {
+		t.Fatal(err)
+	}
+	if want := 3; faulty.calls != want {
+		t.Errorf("calls: want %v got %v", want, faulty.calls)
+	}
+	got, err := faulty.ChunkStore.Read(context.Background(), "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "bar" {
+		t.Errorf("contents: want %q got %q", "bar", got)
+	}
+}
+
+func TestGivesUpAfterAttempts(t *testing.T) {
+	faulty := &faultyChunkStore{failures: 5}
+	s := &ChunkStore{Store: faulty, Attempts: 3, Backoff: time.Millisecond}
+	if _, err := s.Read(context.Background(), "foo"); err == nil {
+		t.Fatal("want error got nil")
+	}
+	if want := 3; faulty.calls != want {
+		t.Errorf("calls: want %v got %v", want, faulty.calls)
+	}
+}
+
+func TestDoesNotRetryPermanentErrors(t *testing.T) {
+	faulty := &faultyChunkStore{failures: 5, permanent: true}
+	s := &ChunkStore{Store: faulty, Backoff: time.Millisecond}
+	if err := s.Delete(context.Background(), "foo"); err != errInjected {
+		t.Errorf("want %v got %v", errInjected, err)
+	}
+	if want := 1; faulty.calls != want {
+		t.Errorf("calls: want %v got %v", want, faulty.calls)
+	}
+}
+
+func TestDoesNotRetryNotExist(t *testing.T) {
+	faulty := &faultyChunkStore{}
+	s := &ChunkStore{Store: faulty, Backoff: time.Millisecond}
+	if _, err := s.Read(context.Background(), "foo"); !os.IsNotExist(err) {
+		t.Errorf("want not exist error got %v", err)
+	}
+	if want := 1; faulty.calls != want {
+		t.Errorf("calls: want %v got %v", want, faulty.calls)
+	}
+}
+
+func TestListRetryDoesNotRepeatNames(t *testing.T) {
+	faulty := &faultyChunkStore{failListAfter: 2}
+	for _, name := range []string{"a", "b", "c", "d"} {
+		if err := faulty.ChunkStore.Save(context.Background(), name, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := &ChunkStore{Store: faulty, Backoff: time.Millisecond}
+	var got []string
+	if err := s.List(context.Background(), "", func(name string) error {
+		got = append(got, name)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(got)
+	if want := []string{"a", "b", "c", "d"}; !reflect.DeepEqual(want, got) {
+		t.Errorf("names: want %v got %v", want, got)
+	}
+	if want := 2; faulty.calls != want {
+		t.Errorf("calls: want %v got %v", want, faulty.calls)
+	}
+}
+
+func TestListDoesNotRetryCallbackErrors(t *testing.T) {
+	faulty := &faultyChunkStore{}
+	if err := faulty.ChunkStore.Save(context.Background(), "a", nil); err != nil {
+		t.Fatal(err)
+	}
+	s := &ChunkStore{Store: faulty, Backoff: time.Millisecond}
+	fnErr := &chunkstore.TransientError{Err: errors.New("from callback")}
+	if err := s.List(context.Background(), "", func(name string) error {
+		return fnErr
+	}); err != fnErr {
+		t.Errorf("want %v got %v", fnErr, err)
+	}
+	if want := 1; faulty.calls != want {
+		t.Errorf("calls: want %v got %v", want, faulty.calls)
+	}
+}
+
+func TestBackoffStopsOnCancel(t *testing.T) {
+	faulty := &faultyChunkStore{failures: 5}
+	s := &ChunkStore{Store: faulty, Backoff: time.Hour}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := s.Exists(ctx, "foo"); err != context.DeadlineExceeded {
+		t.Errorf("want %v got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestDelay(t *testing.T) {
+	s := &ChunkStore{Backoff: time.Second, MaxBackoff: 5 * time.Second}
+	for attempt, nominal := range map[int]time.Duration{
+		1:   time.Second,
+		2:   2 * time.Second,
+		3:   4 * time.Second,
+		4:   5 * time.Second,
+		100: 5 * time.Second,
+	} {
+		for i := 0; i < 100; i++ {
+			if got := s.delay(attempt); got < nominal/2 || got > nominal {
+				t.Errorf("attempt %v: want delay between %v and %v got %v", attempt, nominal/2, nominal, got)
+			}
+		}
+	}
+}
+
+var errInjected = errors.New("injected failure")
+
+// faultyChunkStore is a memory.ChunkStore whose first failures calls fail, and whose first List call fails after failListAfter names, if it is positive.
+type faultyChunkStore struct {
+	memory.ChunkStore
+
+	mu            sync.Mutex
+	failures      int
+	permanent     bool
+	failListAfter int
+	calls         int
+}
+
+func (s *faultyChunkStore) fail() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls++
+	if s.failures == 0 {
+		return nil
+	}
+	s.failures--
+	if s.permanent {
+		return errInjected
+	}
+	return &chunkstore.TransientError{Err: errInjected}
+}
+
+func (s *faultyChunkStore) Read(ctx context.Context, name string) ([]byte, error) {
+	if err := s.fail(); err != nil {
+		return nil, err
+	}
+	return s.ChunkStore.Read(ctx, name)
+}
+
+func (s *faultyChunkStore) Save(ctx context.Context, name string, contents []byte) error {
+	if err := s.fail(); err != nil {
+		return err
+	}
+	return s.ChunkStore.Save(ctx, name, contents)
+}
+
+func (s *faultyChunkStore) Exists(ctx context.Context, name string) (bool, error) {
+	if err := s.fail(); err != nil {
+		return false, err
+	}
+	return s.ChunkStore.Exists(ctx, name)
+}
+
+func (s *faultyChunkStore) List(ctx context.Context, prefix string, fn func(name string) error) error {
+	if err := s.fail(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	failAfter := s.failListAfter
+	s.failListAfter = 0
+	s.mu.Unlock()
+
+	listed := 0
+	return s.ChunkStore.List(ctx, prefix, func(name string) error {
+		if failAfter > 0 && listed == failAfter {
+			return &chunkstore.TransientError{Err: errInjected}
+		}
+		listed++
+		return fn(name)
+	})
+}
+
+func (s *faultyChunkStore) Delete(ctx context.Context, name string) error {
+	if err := s.fail(); err != nil {
+		return err
+	}
+	return s.ChunkStore.Delete(ctx, name)
+}
+
+func (s *faultyChunkStore) Stat(ctx context.Context, name string) (chunkstore.Info, error) {
+	if err := s.fail(); err != nil {
+		return chunkstore.Info{}, err
+	}
+	return s.ChunkStore.Stat(ctx, name)
+}
@@ -0,0 +1,362 @@
+// Package sqlite implements a meta.Store which keeps entries in a SQLite database.
+// Unlike a meta.DB, it can be queried by size and owner, either using Find, or using SQL directly (e.g. with the sqlite3 command line tool).
+// It isn't a backend for repositories, which always keep their metadata in a meta.DB: a DB holds a copy of a repository's entries,
+// made with meta.Copy or the meta convert subcommand, for querying.
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+
+	_ "modernc.org/sqlite"
+
+	"github.com/illicitonion/cloudbackup/meta"
+)
+
+// schema stores each entry as a row of entries, at the path of the file or directory it describes, and its chunks as rows of chunks, in order of seq.
+// dirs has a row for each directory containing an entry (other than the root), whether or not the directory has an entry of its own.
+// Paths under a directory are found with a range query on the primary key, e.g. path >= 'dir/' AND path < 'dir0'.
+const schema = `
+CREATE TABLE IF NOT EXISTS dirs (
+	path TEXT PRIMARY KEY
+);
+CREATE TABLE IF NOT EXISTS entries (
+	path TEXT PRIMARY KEY,
+	dir INTEGER NOT NULL,
+	bytes INTEGER NOT NULL,
+	mode INTEGER NOT NULL,
+	user_name TEXT NOT NULL,
+	group_name TEXT NOT NULL,
+	uid INTEGER,
+	gid INTEGER
+);
+CREATE INDEX IF NOT EXISTS entries_bytes ON entries (bytes);
+CREATE INDEX IF NOT EXISTS entries_user_name ON entries (user_name);
+CREATE INDEX IF NOT EXISTS entries_group_name ON entries (group_name);
+CREATE TABLE IF NOT EXISTS chunks (
+	path TEXT NOT NULL,
+	seq INTEGER NOT NULL,
+	iv BLOB NOT NULL,
+	mac BLOB NOT NULL,
+	PRIMARY KEY (path, seq)
+);
+CREATE INDEX IF NOT EXISTS chunks_mac ON chunks (mac);
+`
+
+type DB struct {
+	db *sql.DB
+}
+
+var _ meta.Store = (*DB)(nil)
+
+// NewDB opens the SQLite database at path, creating it if it doesn't exist.
+func NewDB(path string) (*DB, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// Every connection to an in-memory database is a different database, and writes are serialized anyway.
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("sqlite: error creating schema: %v", err)
+	}
+	return &DB{db}, nil
+}
+
+func (d *DB) Put(path string, entry *meta.Entry) ([]string, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	created, err := put(tx, path, entry)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return created, tx.Commit()
+}
+
+func put(tx *sql.Tx, path string, entry *meta.Entry) ([]string, error) {
+	createdDirs := make([]string, 0)
+	parts := strings.Split(path, "/")
+	last := len(parts) - 1
+	for i := range parts[:last] {
+		dir := strings.Join(parts[:i+1], "/")
+		var isFile bool
+		if err := tx.QueryRow(`SELECT 1 FROM entries WHERE path = ? AND dir = 0`, dir).Scan(&isFile); err == nil {
+			return nil, fmt.Errorf("sqlite: creating directory %v: a file exists there", dir)
+		} else if err != sql.ErrNoRows {
+			return nil, err
+		}
+		res, err := tx.Exec(`INSERT OR IGNORE INTO dirs (path) VALUES (?)`, dir)
+		if err != nil {
+			return nil, err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return nil, err
+		} else if n > 0 {
+			createdDirs = append(createdDirs, dir)
+		}
+	}
+
+	entryPath, isDir := path, parts[last] == "."
+	if isDir {
+		entryPath = strings.Join(parts[:last], "/")
+	} else {
+		var exists bool
+		if err := tx.QueryRow(`SELECT 1 FROM dirs WHERE path = ?`, path).Scan(&exists); err == nil {
+			return nil, fmt.Errorf("sqlite: putting %v: a directory exists there", path)
+		} else if err != sql.ErrNoRows {
+			return nil, err
+		}
+	}
+	var uid, gid sql.NullInt64
+	if entry.HasIDs {
+		uid = sql.NullInt64{Int64: int64(entry.UID), Valid: true}
+		gid = sql.NullInt64{Int64: int64(entry.GID), Valid: true}
+	}
+	if _, err := tx.Exec(`INSERT OR REPLACE INTO entries (path, dir, bytes, mode, user_name, group_name, uid, gid) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		entryPath, isDir, entry.Bytes, int64(entry.Mode), entry.User, entry.Group, uid, gid); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`DELETE FROM chunks WHERE path = ?`, entryPath); err != nil {
+		return nil, err
+	}
+	for i, c := range entry.Chunks {
+		if _, err := tx.Exec(`INSERT INTO chunks (path, seq, iv, mac) VALUES (?, ?, ?, ?)`, entryPath, i, c.IV, c.CiphertextMAC); err != nil {
+			return nil, err
+		}
+	}
+	return createdDirs, nil
+}
+
+func (d *DB) Get(path string) (map[string]meta.Entry, error) {
+	entries := make(map[string]meta.Entry)
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var hasEntries bool
+	if err := tx.QueryRow(`SELECT 1 FROM entries LIMIT 1`).Scan(&hasEntries); err == sql.ErrNoRows {
+		return nil, fmt.Errorf("sqlite: no entries")
+	} else if err != nil {
+		return nil, err
+	}
+
+	if path == "." {
+		return entries, queryEntries(tx, entries, `path >= ''`)
+	}
+
+	parts := strings.Split(path, "/")
+	last := len(parts) - 1
+	for i := range parts[:last] {
+		dir := strings.Join(parts[:i+1], "/")
+		var exists bool
+		if err := tx.QueryRow(`SELECT 1 FROM dirs WHERE path = ?`, dir).Scan(&exists); err == sql.ErrNoRows {
+			return nil, fmt.Errorf("sqlite: no directory %v", dir)
+		} else if err != nil {
+			return nil, err
+		}
+		// The entries of containing directories are keyed without a trailing "/", as in meta.DB.
+		found := make(map[string]meta.Entry)
+		if err := queryEntries(tx, found, `path = ? AND dir = 1`, dir); err != nil {
+			return nil, err
+		}
+		if e, ok := found[dir+"/"]; ok {
+			entries[dir] = e
+		}
+	}
+
+	if parts[last] == "." {
+		found := make(map[string]meta.Entry)
+		dir := strings.Join(parts[:last], "/")
+		if err := queryEntries(tx, found, `path = ? AND dir = 1`, dir); err != nil {
+			return nil, err
+		}
+		e, ok := found[dir+"/"]
+		if !ok {
+			return nil, fmt.Errorf("sqlite: could not find file %q", path)
+		}
+		entries[path] = e
+		return entries, nil
+	}
+
+	found := make(map[string]meta.Entry)
+	if err := queryEntries(tx, found, `path = ? AND dir = 0`, path); err != nil {
+		return nil, err
+	}
+	if e, ok := found[path]; ok {
+		entries[path] = e
+		return entries, nil
+	}
+
+	var exists bool
+	if err := tx.QueryRow(`SELECT 1 FROM dirs WHERE path = ?`, path).Scan(&exists); err == sql.ErrNoRows {
+		return nil, fmt.Errorf("sqlite: could not find file %q", path)
+	} else if err != nil {
+		return nil, err
+	}
+	if err := queryEntries(tx, entries, `path = ? AND dir = 1`, path); err != nil {
+		return nil, err
+	}
+	low, high := prefixRange(path + "/")
+	return entries, queryEntries(tx, entries, `path >= ? AND path < ?`, low, high)
+}
+
+// Query describes which entries Find visits. Zero fields match every entry.
+type Query struct {
+	// Prefix matches the entries of the file or directory at Prefix, and of everything under it.
+	Prefix string
+	// MinBytes matches entries of at least this many bytes.
+	MinBytes int64
+	User     string
+	Group    string
+}
+
+// Find calls fn with each entry which matches q, in order of path, so a directory's entry is passed before those under it.
+// Directories' own entries are passed with their path followed by "/". Matches are read a row at a time, rather than all at once.
+func (d *DB) Find(q Query, fn func(path string, e meta.Entry) error) error {
+	var conditions []string
+	var args []interface{}
+	if q.Prefix != "" && q.Prefix != "." {
+		low, high := prefixRange(q.Prefix + "/")
+		conditions = append(conditions, `(entries.path = ? OR (entries.path >= ? AND entries.path < ?))`)
+		args = append(args, q.Prefix, low, high)
+	}
+	if q.MinBytes > 0 {
+		conditions = append(conditions, `bytes >= ?`)
+		args = append(args, q.MinBytes)
+	}
+	if q.User != "" {
+		conditions = append(conditions, `user_name = ?`)
+		args = append(args, q.User)
+	}
+	if q.Group != "" {
+		conditions = append(conditions, `group_name = ?`)
+		args = append(args, q.Group)
+	}
+	if len(conditions) == 0 {
+		conditions = append(conditions, `1`)
+	}
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// Each entry is joined with its chunks, so spans consecutive rows, one per chunk (or a single row with null chunk columns if it has none).
+	rows, err := tx.Query(`SELECT entries.path, dir, bytes, mode, user_name, group_name, uid, gid, iv, mac FROM entries
+		LEFT JOIN chunks ON chunks.path = entries.path
+		WHERE `+strings.Join(conditions, " AND ")+`
+		ORDER BY entries.path, seq`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var key string
+	var e *meta.Entry
+	for rows.Next() {
+		var path string
+		var dir bool
+		var mode int64
+		var uid, gid sql.NullInt64
+		var entry meta.Entry
+		var c meta.Chunk
+		if err := rows.Scan(&path, &dir, &entry.Bytes, &mode, &entry.User, &entry.Group, &uid, &gid, &c.IV, &c.CiphertextMAC); err != nil {
+			return err
+		}
+		if next := entryKey(path, dir); e == nil || next != key {
+			if e != nil {
+				if err := fn(key, *e); err != nil {
+					return err
+				}
+			}
+			entry.Mode = os.FileMode(mode)
+			if uid.Valid && gid.Valid {
+				entry.UID, entry.GID, entry.HasIDs = uint32(uid.Int64), uint32(gid.Int64), true
+			}
+			key, e = next, &entry
+		}
+		if c.CiphertextMAC != nil {
+			e.Chunks = append(e.Chunks, c)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if e != nil {
+		return fn(key, *e)
+	}
+	return nil
+}
+
+func (d *DB) Close() {
+	d.db.Close()
+}
+
+// queryEntries adds the entries matching where, and their chunks, to entries.
+func queryEntries(tx *sql.Tx, entries map[string]meta.Entry, where string, args ...interface{}) error {
+	rows, err := tx.Query(`SELECT path, dir, bytes, mode, user_name, group_name, uid, gid FROM entries WHERE `+where, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	keys := make(map[string]string)
+	for rows.Next() {
+		var path string
+		var dir bool
+		var mode int64
+		var uid, gid sql.NullInt64
+		var e meta.Entry
+		if err := rows.Scan(&path, &dir, &e.Bytes, &mode, &e.User, &e.Group, &uid, &gid); err != nil {
+			return err
+		}
+		e.Mode = os.FileMode(mode)
+		if uid.Valid && gid.Valid {
+			e.UID, e.GID, e.HasIDs = uint32(uid.Int64), uint32(gid.Int64), true
+		}
+		key := entryKey(path, dir)
+		keys[path] = key
+		entries[key] = e
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	chunkRows, err := tx.Query(`SELECT path, iv, mac FROM chunks WHERE path IN (SELECT path FROM entries WHERE `+where+`) ORDER BY path, seq`, args...)
+	if err != nil {
+		return err
+	}
+	defer chunkRows.Close()
+	for chunkRows.Next() {
+		var path string
+		var c meta.Chunk
+		if err := chunkRows.Scan(&path, &c.IV, &c.CiphertextMAC); err != nil {
+			return err
+		}
+		key := keys[path]
+		e := entries[key]
+		e.Chunks = append(e.Chunks, c)
+		entries[key] = e
+	}
+	return chunkRows.Err()
+}
+
+// entryKey returns the key of the entry at path in the entries returned by Get and Find: directories' own entries have keys ending in "/".
+func entryKey(path string, dir bool) string {
+	if dir && path != "" {
+		return path + "/"
+	}
+	return path
+}
+
+// prefixRange returns the range of strings which start with prefix, which must end in "/", as [low, high).
+func prefixRange(prefix string) (low, high string) {
+	return prefix, prefix[:len(prefix)-1] + string('/'+1)
+}
@@ -0,0 +1,213 @@
+package sqlite
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/illicitonion/cloudbackup/meta"
+)
+
+var (
+	dirEntry = meta.Entry{Mode: os.ModeDir | 0750, User: "alice", Group: "staff"}
+	small    = meta.Entry{
+		Bytes:  10,
+		Chunks: []meta.Chunk{{IV: bytes.Repeat([]byte{0x01}, 16), CiphertextMAC: bytes.Repeat([]byte{0x02}, 32)}},
+		Mode:   0600,
+		User:   "alice",
+		Group:  "staff",
+	}
+	big = meta.Entry{
+		Bytes: 2 << 30,
+		Chunks: []meta.Chunk{
+			{IV: bytes.Repeat([]byte{0x03}, 16), CiphertextMAC: bytes.Repeat([]byte{0x04}, 32)},
+			{IV: bytes.Repeat([]byte{0x05}, 16), CiphertextMAC: bytes.Repeat([]byte{0x06}, 32)},
+		},
+		Mode:   0644,
+		User:   "bob",
+		Group:  "staff",
+		UID:    0,
+		GID:    50,
+		HasIDs: true,
+	}
+
+	puts = []struct {
+		path  string
+		entry meta.Entry
+	}{
+		{"dir/.", dirEntry},
+		{"dir/small", small},
+		{"dir/sub/big", big},
+		{"dir/sub/.", dirEntry},
+		{"dir0", small},
+		{"top", big},
+		// Overwrites the earlier entry.
+		{"dir/small", big},
+	}
+)
+
+// TestMatchesBolt checks that DB behaves exactly as a meta.DB does.
+func TestMatchesBolt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bolt, err := meta.NewDB(filepath.Join(dir, "bolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bolt.Close()
+	sqlite, err := NewDB(filepath.Join(dir, "sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlite.Close()
+
+	for _, p := range puts {
+		p := p
+		want, wantErr := bolt.Put(p.path, &p.entry)
+		got, err := sqlite.Put(p.path, &p.entry)
+		if (err != nil) != (wantErr != nil) || !reflect.DeepEqual(want, got) {
+			t.Errorf("put %v: want %v, %v got %v, %v", p.path, want, wantErr, got, err)
+		}
+	}
+	for _, path := range []string{".", "dir", "dir/.", "dir/small", "dir/sub", "dir/sub/big", "dir0", "top", "missing", "dir/missing", "missing/file"} {
+		want, wantErr := bolt.Get(path)
+		got, err := sqlite.Get(path)
+		if (err != nil) != (wantErr != nil) {
+			t.Errorf("get %v: want error %v got %v", path, wantErr, err)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(want, got) {
+			t.Errorf("get %v: want %v got %v", path, want, got)
+		}
+	}
+}
+
+func TestGetEmpty(t *testing.T) {
+	db := makeDB(t)
+	defer db.Close()
+	if _, err := db.Get("."); err == nil {
+		t.Errorf("want error got nil")
+	}
+}
+
+func TestPutConflictingTypes(t *testing.T) {
+	db := makeDB(t)
+	defer db.Close()
+	if _, err := db.Put("dir/file", &small); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Put("dir", &small); err == nil {
+		t.Errorf("file over directory: want error got nil")
+	}
+	if _, err := db.Put("dir/file/child", &small); err == nil {
+		t.Errorf("directory over file: want error got nil")
+	}
+}
+
+func TestFind(t *testing.T) {
+	db := makeDB(t)
+	defer db.Close()
+	for _, p := range puts {
+		p := p
+		if _, err := db.Put(p.path, &p.entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		q    Query
+		want []string
+	}{
+		{Query{}, []string{"dir/", "dir/small", "dir/sub/", "dir/sub/big", "dir0", "top"}},
+		{Query{Prefix: "dir/sub"}, []string{"dir/sub/", "dir/sub/big"}},
+		{Query{Prefix: "dir"}, []string{"dir/", "dir/small", "dir/sub/", "dir/sub/big"}},
+		{Query{MinBytes: 1 << 30}, []string{"dir/small", "dir/sub/big", "top"}},
+		{Query{MinBytes: 1 << 30, User: "bob", Prefix: "dir"}, []string{"dir/small", "dir/sub/big"}},
+		{Query{User: "alice"}, []string{"dir/", "dir/sub/", "dir0"}},
+		{Query{Group: "wheel"}, nil},
+	} {
+		var got []string
+		if err := db.Find(tc.q, func(path string, e meta.Entry) error {
+			got = append(got, path)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(tc.want, got) {
+			t.Errorf("%+v: want %v got %v", tc.q, tc.want, got)
+		}
+	}
+
+	want, err := db.Get(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]meta.Entry)
+	if err := db.Find(Query{}, func(path string, e meta.Entry) error {
+		got[path] = e
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("want the entries Get returns, %v, got %v", want, got)
+	}
+}
+
+func TestCopyRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src, err := meta.NewDB(filepath.Join(dir, "src"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	for _, p := range puts {
+		p := p
+		if _, err := src.Put(p.path, &p.entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	converted := makeDB(t)
+	defer converted.Close()
+	dst, err := meta.NewDB(filepath.Join(dir, "dst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+
+	if n, err := meta.Copy(converted, src); err != nil || n != 6 {
+		t.Fatalf("to sqlite: want 6 copied got %v, %v", n, err)
+	}
+	if n, err := meta.Copy(dst, converted); err != nil || n != 6 {
+		t.Fatalf("from sqlite: want 6 copied got %v, %v", n, err)
+	}
+	want, err := src.Get(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := dst.Get(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("want %v got %v", want, got)
+	}
+}
+
+func makeDB(t *testing.T) *DB {
+	db, err := NewDB(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/illicitonion/cloudbackup/backup"
+)
+
+// formatSummary describes the summary of an encrypt or decrypt, as given by command, in a few lines.
+func formatSummary(command string, s backup.Summary) string {
+	if command == "decrypt" {
+		return fmt.Sprintf("Files:    %d restored\nWritten:  %s\nDuration: %v\n", s.FilesScanned, formatBytes(float64(s.BytesWritten)), s.Duration.Round(time.Millisecond))
+	}
+	return fmt.Sprintf("Files:    %d scanned (%d new, %d changed, %d unchanged), %d deleted\nRead:     %s\nChunks:   %d uploaded, %d deduplicated\nMetadata: %s\nDuration: %v\n",
+		s.FilesScanned, s.FilesNew, s.FilesChanged, s.FilesUnchanged, s.FilesDeleted,
+		formatBytes(float64(s.BytesRead)),
+		s.ChunksUploaded, s.ChunksDeduplicated,
+		formatBytes(float64(s.MetadataBytes)),
+		s.Duration.Round(time.Millisecond))
+}
+
+// jsonSummary is the form in which --summary-file and meta history write summaries. Command is omitted by meta history, as only backups are recorded.
+type jsonSummary struct {
+	Command            string    `json:"command,omitempty"`
+	Start              time.Time `json:"start"`
+	DurationSeconds    float64   `json:"duration_seconds"`
+	FilesScanned       int64     `json:"files_scanned"`
+	FilesNew           int64     `json:"files_new"`
+	FilesChanged       int64     `json:"files_changed"`
+	FilesUnchanged     int64     `json:"files_unchanged"`
+	FilesDeleted       int64     `json:"files_deleted"`
+	BytesRead          int64     `json:"bytes_read"`
+	BytesWritten       int64     `json:"bytes_written"`
+	ChunksUploaded     int64     `json:"chunks_uploaded"`
+	ChunksDeduplicated int64     `json:"chunks_deduplicated"`
+	MetadataBytes      int64     `json:"metadata_bytes"`
+}
+
+func toJSONSummary(command string, s backup.Summary) jsonSummary {
+	return jsonSummary{
+		Command:            command,
+		Start:              s.Start.UTC(),
+		DurationSeconds:    s.Duration.Seconds(),
+		FilesScanned:       s.FilesScanned,
+		FilesNew:           s.FilesNew,
+		FilesChanged:       s.FilesChanged,
+		FilesUnchanged:     s.FilesUnchanged,
+		FilesDeleted:       s.FilesDeleted,
+		BytesRead:          s.BytesRead,
+		BytesWritten:       s.BytesWritten,
+		ChunksUploaded:     s.ChunksUploaded,
+		ChunksDeduplicated: s.ChunksDeduplicated,
+		MetadataBytes:      s.MetadataBytes,
+	}
+}
+
+// writeSummaryFile writes the summary of command to path as a JSON object.
+func writeSummaryFile(path, command string, s backup.Summary) error {
+	b, err := json.MarshalIndent(toJSONSummary(command, s), "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(b, '\n'), 0600)
+}
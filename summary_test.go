@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/illicitonion/cloudbackup/backup"
+)
+
+func TestFormatSummary(t *testing.T) {
+	s := backup.Summary{
+		Duration:           1500 * time.Millisecond,
+		FilesScanned:       10,
+		FilesNew:           2,
+		FilesChanged:       3,
+		FilesUnchanged:     5,
+		FilesDeleted:       1,
+		BytesRead:          2 << 20,
+		BytesWritten:       4096,
+		ChunksUploaded:     7,
+		ChunksDeduplicated: 8,
+		MetadataBytes:      1024,
+	}
+	for _, tc := range []struct {
+		command string
+		want    string
+	}{
+		{"encrypt", "Files:    10 scanned (2 new, 3 changed, 5 unchanged), 1 deleted\nRead:     2.0 MiB\nChunks:   7 uploaded, 8 deduplicated\nMetadata: 1.0 KiB\nDuration: 1.5s\n"},
+		{"decrypt", "Files:    10 restored\nWritten:  4.0 KiB\nDuration: 1.5s\n"},
+	} {
+		if got := formatSummary(tc.command, s); got != tc.want {
+			t.Errorf("%v: want %q got %q", tc.command, tc.want, got)
+		}
+	}
+}
+
+func TestWriteSummaryFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudbackuptest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "summary.json")
+
+	start := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	if err := writeSummaryFile(path, "encrypt", backup.Summary{Start: start, Duration: 2 * time.Second, FilesScanned: 3, ChunksUploaded: 4}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got jsonSummary
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := jsonSummary{Command: "encrypt", Start: start, DurationSeconds: 2, FilesScanned: 3, ChunksUploaded: 4}
+	if got != want {
+		t.Errorf("want %+v got %+v", want, got)
+	}
+}